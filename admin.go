@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"gt-linens-light-stack/lightstack"
+)
+
+// reloadFunc reads the configuration again and applies what it can to the
+// running client. It returns the settings that only change on a restart.
+type reloadFunc func() (restartRequired []string, err error)
+
+// newReloader reloads the configuration from the same arguments, environment
+// and -config file the process was started with.
+func newReloader(args []string, running options, client *lightstack.Client) reloadFunc {
+	return func() ([]string, error) {
+		next, err := loadOptions(args)
+		if err != nil {
+			return nil, err
+		}
+		restart, err := client.Reload(next.Config)
+		if err != nil {
+			return nil, err
+		}
+		return append(restart, running.restartRequired(next)...), nil
+	}
+}
+
+// restartRequired returns the names of the binary's own settings that differ
+// in next.
+func (o options) restartRequired(next options) []string {
+	var changed []string
+	for _, s := range []struct {
+		name    string
+		changed bool
+	}{
+		{"Log", o.Log != next.Log},
+		{"MetricsAddr", o.MetricsAddr != next.MetricsAddr},
+		{"HealthAddr", o.HealthAddr != next.HealthAddr},
+		{"InjectAddr", o.InjectAddr != next.InjectAddr},
+		{"AdminAddr", o.AdminAddr != next.AdminAddr},
+		{"AdminToken", o.AdminToken != next.AdminToken},
+		{"OTelEndpoint", o.OTelEndpoint != next.OTelEndpoint},
+		{"ShutdownTimeout", o.ShutdownTimeout != next.ShutdownTimeout},
+	} {
+		if s.changed {
+			changed = append(changed, s.name)
+		}
+	}
+	return changed
+}
+
+func logReload(trigger string, restart []string, err error) {
+	if err != nil {
+		slog.Error("Failed to reload configuration, keeping the current one", "event", "config_reload_failed", "trigger", trigger, "error", err)
+		return
+	}
+	if len(restart) > 0 {
+		slog.Warn("Reloaded configuration; some changes need a restart", "event", "config_reloaded", "trigger", trigger, "restart_required", restart)
+		return
+	}
+	slog.Info("Reloaded configuration", "event", "config_reloaded", "trigger", trigger)
+}
+
+// reloadOnSignal reloads the configuration every time the process receives
+// SIGHUP.
+func reloadOnSignal(ctx context.Context, reload reloadFunc) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	defer signal.Stop(sig)
+
+	for {
+		select {
+		case <-sig:
+			restart, err := reload()
+			logReload("sighup", restart, err)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// adminHandler serves POST /reload for callers presenting token as a bearer
+// token.
+func adminHandler(token string, reload reloadFunc) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /reload", func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		restart, err := reload()
+		logReload("http", restart, err)
+		if err != nil {
+			http.Error(w, "invalid configuration: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if restart == nil {
+			restart = []string{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"restart_required": restart})
+	})
+	return mux
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"gt-linens-light-stack/lightstack"
+)
+
+// idleSource delivers nothing, leaving Client.Submit as the only way in.
+type idleSource struct{}
+
+func (idleSource) Run(ctx context.Context, out chan<- lightstack.Command) error {
+	<-ctx.Done()
+	return nil
+}
+
+func (idleSource) Ack(lightstack.Ack) error { return nil }
+
+func TestAdminReload(t *testing.T) {
+	sent := make(chan string, 8)
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sent <- r.URL.Path
+	}))
+	t.Cleanup(api.Close)
+
+	path := filepath.Join(t.TempDir(), "config.json")
+	writeConfig := func(settings map[string]any) {
+		t.Helper()
+		settings["api-base-url"] = api.URL
+		data, err := json.Marshal(settings)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeConfig(map[string]any{"ws-url": "ws://127.0.0.1:1/ws"})
+
+	args := []string{"-config", path}
+	opts, err := loadOptions(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts.Config.Source = idleSource{}
+	opts.Config.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	client, err := lightstack.New(opts.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- client.Run(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	h := adminHandler("secret", newReloader(args, opts, client))
+	reload := func(auth string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/reload", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	// send submits a command for each device and returns the device API
+	// paths requested, in order, once the last device's request arrives.
+	send := func(devices ...string) []string {
+		t.Helper()
+		for _, id := range devices {
+			if err := client.Submit(ctx, lightstack.Command{DeviceID: id, Mode: "red", TurnOn: true}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var paths []string
+		last := "/api/device/gpo/light/" + devices[len(devices)-1]
+		for {
+			select {
+			case p := <-sent:
+				paths = append(paths, p)
+				if p == last {
+					return paths
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("timed out waiting for %s, got %v", last, paths)
+			}
+		}
+	}
+
+	for _, auth := range []string{"", "Bearer wrong", "secret"} {
+		if rec := reload(auth); rec.Code != http.StatusUnauthorized {
+			t.Errorf("reload with Authorization %q = %d, want %d", auth, rec.Code, http.StatusUnauthorized)
+		}
+	}
+
+	// An invalid file is rejected as a whole, so its deny list is not
+	// applied either.
+	writeConfig(map[string]any{"ws-url": "ws://127.0.0.1:1/ws", "device-deny": "stack-1", "hello-message": "{"})
+	if rec := reload("Bearer secret"); rec.Code != http.StatusBadRequest {
+		t.Errorf("reload of an invalid config = %d %q, want %d", rec.Code, rec.Body, http.StatusBadRequest)
+	}
+	if paths := send("stack-1"); len(paths) != 1 {
+		t.Errorf("requests = %v, want stack-1 still sent", paths)
+	}
+
+	writeConfig(map[string]any{"ws-url": "ws://127.0.0.1:2/ws", "device-deny": "stack-1"})
+	rec := reload("Bearer secret")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("reload = %d %q, want %d", rec.Code, rec.Body, http.StatusOK)
+	}
+	var body struct {
+		RestartRequired []string `json:"restart_required"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(body.RestartRequired, []string{"WSURL"}) {
+		t.Errorf("restart_required = %v, want [WSURL]", body.RestartRequired)
+	}
+	if paths := send("stack-1", "stack-2"); !slices.Equal(paths, []string{"/api/device/gpo/light/stack-2"}) {
+		t.Errorf("requests = %v, want only stack-2 sent after stack-1 was denied", paths)
+	}
+}
@@ -0,0 +1,805 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gt-linens-light-stack/lightstack"
+)
+
+const (
+	defaultLogFormat         = "text"
+	defaultLogLevel          = "info"
+	defaultLogSampleInterval = 10 * time.Second
+	defaultMetricsAddr       = ":9090"
+	defaultHealthAddr        = ":8081"
+	// defaultShutdownTimeout leaves headroom inside the usual 10s or 30s
+	// SIGTERM-to-SIGKILL grace periods.
+	defaultShutdownTimeout = 5 * time.Second
+)
+
+// options holds the command-line configuration: the client settings plus the
+// ones that only concern this binary.
+type options struct {
+	lightstack.Config
+	Log         logOptions
+	MetricsAddr string
+	HealthAddr  string
+	InjectAddr  string
+	// AdminAddr serves POST /reload to callers presenting AdminToken.
+	AdminAddr  string
+	AdminToken string
+	// ConfigPath is a JSON file of flag values, applied on top of the
+	// environment and under the command line, and read again on reload.
+	ConfigPath string
+	// OTelEndpoint is the OTLP/HTTP endpoint traces are exported to. Empty
+	// disables tracing.
+	OTelEndpoint string
+	// ShutdownTimeout is how long the process waits for Run to return after
+	// SIGINT or SIGTERM before exiting anyway. 0 waits forever.
+	ShutdownTimeout time.Duration
+	// ShowVersion prints the build information and exits.
+	ShowVersion bool
+}
+
+func loadOptions(args []string) (options, error) {
+	opts := options{
+		Config: lightstack.DefaultConfig(),
+		Log: logOptions{
+			Format: envString("LIGHTSTACK_LOG_FORMAT", defaultLogFormat),
+			Level:  strings.ToLower(envString("LIGHTSTACK_LOG_LEVEL", defaultLogLevel)),
+		},
+		MetricsAddr:  envString("LIGHTSTACK_METRICS_ADDR", defaultMetricsAddr),
+		HealthAddr:   envString("LIGHTSTACK_HEALTH_ADDR", defaultHealthAddr),
+		InjectAddr:   os.Getenv("LIGHTSTACK_INJECT_ADDR"),
+		AdminAddr:    os.Getenv("LIGHTSTACK_ADMIN_ADDR"),
+		AdminToken:   os.Getenv("LIGHTSTACK_ADMIN_TOKEN"),
+		ConfigPath:   os.Getenv("LIGHTSTACK_CONFIG"),
+		OTelEndpoint: os.Getenv("LIGHTSTACK_OTEL_ENDPOINT"),
+	}
+	cfg := &opts.Config
+	cfg.WSURL = envString("LIGHTSTACK_WS_URL", cfg.WSURL)
+	cfg.WSFailoverURLs = splitList(os.Getenv("LIGHTSTACK_WS_FAILOVER_URLS"))
+	cfg.WSToken = os.Getenv("LIGHTSTACK_WS_TOKEN")
+	cfg.APIBaseURL = envString("LIGHTSTACK_API_BASE_URL", cfg.APIBaseURL)
+	cfg.ShadowAPIBaseURL = os.Getenv("LIGHTSTACK_API_SHADOW_URL")
+	cfg.AllowedModes = splitList(os.Getenv("LIGHTSTACK_ALLOWED_MODES"))
+	cfg.ExtendedModes = splitList(os.Getenv("LIGHTSTACK_EXTENDED_MODES"))
+	cfg.DeviceAllow = splitList(os.Getenv("LIGHTSTACK_DEVICE_ALLOW"))
+	cfg.DeviceDeny = splitList(os.Getenv("LIGHTSTACK_DEVICE_DENY"))
+	cfg.WebhookURL = os.Getenv("LIGHTSTACK_WEBHOOK_URL")
+	cfg.QueuePath = os.Getenv("LIGHTSTACK_QUEUE_PATH")
+	cfg.ReplayPath = os.Getenv("LIGHTSTACK_REPLAY_PATH")
+	cfg.RecordPath = os.Getenv("LIGHTSTACK_RECORD_PATH")
+	cfg.APIRoutesPath = os.Getenv("LIGHTSTACK_API_ROUTES")
+	cfg.DeviceGroupsPath = os.Getenv("LIGHTSTACK_DEVICE_GROUPS")
+	cfg.APIPath = envString("LIGHTSTACK_API_PATH", cfg.APIPath)
+	cfg.SubscriptionsPath = os.Getenv("LIGHTSTACK_SUBSCRIPTIONS")
+	cfg.NATSURL = os.Getenv("LIGHTSTACK_NATS_URL")
+	cfg.ExecCommand = os.Getenv("LIGHTSTACK_EXEC_COMMAND")
+	cfg.NATSSubject = envString("LIGHTSTACK_NATS_SUBJECT", cfg.NATSSubject)
+	cfg.WSTLSCA = os.Getenv("LIGHTSTACK_WS_TLS_CA")
+	cfg.HelloMessage = os.Getenv("LIGHTSTACK_HELLO_MESSAGE")
+	cfg.APITLSCert = os.Getenv("LIGHTSTACK_API_TLS_CERT")
+	cfg.APITLSKey = os.Getenv("LIGHTSTACK_API_TLS_KEY")
+	cfg.APITLSCA = os.Getenv("LIGHTSTACK_API_TLS_CA")
+	cfg.Proxy = os.Getenv("LIGHTSTACK_PROXY")
+	cfg.UserAgent = os.Getenv("LIGHTSTACK_USER_AGENT")
+	cfg.Preflight = envString("LIGHTSTACK_PREFLIGHT", cfg.Preflight)
+	cfg.PreflightPath = envString("LIGHTSTACK_PREFLIGHT_PATH", cfg.PreflightPath)
+
+	var err error
+	if opts.Log.SampleBurst, err = envInt("LIGHTSTACK_LOG_SAMPLE", 0); err != nil {
+		return options{}, err
+	}
+	if opts.Log.SampleInterval, err = envDuration("LIGHTSTACK_LOG_SAMPLE_INTERVAL", defaultLogSampleInterval); err != nil {
+		return options{}, err
+	}
+	if opts.ShutdownTimeout, err = envDuration("LIGHTSTACK_SHUTDOWN_TIMEOUT", defaultShutdownTimeout); err != nil {
+		return options{}, err
+	}
+	if err = parseHeaderList(os.Getenv("LIGHTSTACK_WS_HEADERS"), cfg.WSHeaders); err != nil {
+		return options{}, fmt.Errorf("invalid LIGHTSTACK_WS_HEADERS: %w", err)
+	}
+	if err = parseHeaderList(os.Getenv("LIGHTSTACK_API_HEADERS"), cfg.APIHeaders); err != nil {
+		return options{}, fmt.Errorf("invalid LIGHTSTACK_API_HEADERS: %w", err)
+	}
+	if cfg.ModePriorities, err = parsePriorityList(os.Getenv("LIGHTSTACK_MODE_PRIORITIES")); err != nil {
+		return options{}, fmt.Errorf("invalid LIGHTSTACK_MODE_PRIORITIES: %w", err)
+	}
+	cfg.APIBody = envString("LIGHTSTACK_API_BODY", cfg.APIBody)
+	cfg.APIBoolFormat = envString("LIGHTSTACK_API_BOOL_FORMAT", cfg.APIBoolFormat)
+	if cfg.APIQuery, err = envBool("LIGHTSTACK_API_QUERY", cfg.APIQuery); err != nil {
+		return options{}, err
+	}
+	if cfg.APIBodyFields, err = parseBodyFieldList(os.Getenv("LIGHTSTACK_API_BODY_FIELDS")); err != nil {
+		return options{}, fmt.Errorf("invalid LIGHTSTACK_API_BODY_FIELDS: %w", err)
+	}
+	cfg.APIMethod = strings.ToUpper(envString("LIGHTSTACK_API_METHOD", cfg.APIMethod))
+	if cfg.APIModeMethods, err = parseModeMethodList(os.Getenv("LIGHTSTACK_MODE_METHODS")); err != nil {
+		return options{}, fmt.Errorf("invalid LIGHTSTACK_MODE_METHODS: %w", err)
+	}
+	if cfg.APISuccessStatuses, err = parseStatusList(os.Getenv("LIGHTSTACK_API_SUCCESS_STATUSES")); err != nil {
+		return options{}, fmt.Errorf("invalid LIGHTSTACK_API_SUCCESS_STATUSES: %w", err)
+	}
+	if cfg.APIFollowRedirects, err = envBool("LIGHTSTACK_API_FOLLOW_REDIRECTS", cfg.APIFollowRedirects); err != nil {
+		return options{}, err
+	}
+	if cfg.WSFailoverAfter, err = envInt("LIGHTSTACK_WS_FAILOVER_AFTER", cfg.WSFailoverAfter); err != nil {
+		return options{}, err
+	}
+	if cfg.WSFailbackInterval, err = envDuration("LIGHTSTACK_WS_FAILBACK_INTERVAL", cfg.WSFailbackInterval); err != nil {
+		return options{}, err
+	}
+	if cfg.WSCompression, err = envBool("LIGHTSTACK_WS_COMPRESSION", cfg.WSCompression); err != nil {
+		return options{}, err
+	}
+	if cfg.WSCompressionLevel, err = envInt("LIGHTSTACK_WS_COMPRESSION_LEVEL", cfg.WSCompressionLevel); err != nil {
+		return options{}, err
+	}
+	if cfg.WSConnectTimeout, err = envDuration("LIGHTSTACK_WS_CONNECT_TIMEOUT", cfg.WSConnectTimeout); err != nil {
+		return options{}, err
+	}
+	if cfg.WSHandshakeTimeout, err = envDuration("LIGHTSTACK_WS_HANDSHAKE_TIMEOUT", cfg.WSHandshakeTimeout); err != nil {
+		return options{}, err
+	}
+	if cfg.WSReadBufferSize, err = envInt("LIGHTSTACK_WS_READ_BUFFER_SIZE", cfg.WSReadBufferSize); err != nil {
+		return options{}, err
+	}
+	if cfg.WSWriteBufferSize, err = envInt("LIGHTSTACK_WS_WRITE_BUFFER_SIZE", cfg.WSWriteBufferSize); err != nil {
+		return options{}, err
+	}
+	if cfg.WSInsecureSkipVerify, err = envBool("LIGHTSTACK_WS_INSECURE_SKIP_VERIFY", cfg.WSInsecureSkipVerify); err != nil {
+		return options{}, err
+	}
+	if cfg.DryRun, err = envBool("LIGHTSTACK_DRY_RUN", cfg.DryRun); err != nil {
+		return options{}, err
+	}
+	if cfg.AckState, err = envBool("LIGHTSTACK_ACK_STATE", cfg.AckState); err != nil {
+		return options{}, err
+	}
+	if cfg.SendAcks, err = envBool("LIGHTSTACK_SEND_ACKS", cfg.SendAcks); err != nil {
+		return options{}, err
+	}
+	if cfg.AdvertiseVersions, err = envBool("LIGHTSTACK_ADVERTISE_VERSIONS", cfg.AdvertiseVersions); err != nil {
+		return options{}, err
+	}
+	if cfg.KeepAliveInterval, err = envDuration("LIGHTSTACK_KEEPALIVE_INTERVAL", cfg.KeepAliveInterval); err != nil {
+		return options{}, err
+	}
+	if cfg.KeepAliveJitter, err = envInt("LIGHTSTACK_KEEPALIVE_JITTER", cfg.KeepAliveJitter); err != nil {
+		return options{}, err
+	}
+	if cfg.PingWriteTimeout, err = envDuration("LIGHTSTACK_PING_WRITE_TIMEOUT", cfg.PingWriteTimeout); err != nil {
+		return options{}, err
+	}
+	if cfg.ReadTimeout, err = envDuration("LIGHTSTACK_READ_TIMEOUT", cfg.ReadTimeout); err != nil {
+		return options{}, err
+	}
+	if cfg.StrictPing, err = envBool("LIGHTSTACK_STRICT_PING", cfg.StrictPing); err != nil {
+		return options{}, err
+	}
+	if cfg.IdleTimeout, err = envDuration("LIGHTSTACK_IDLE_TIMEOUT", cfg.IdleTimeout); err != nil {
+		return options{}, err
+	}
+	if cfg.MaxMessageSize, err = envInt("LIGHTSTACK_MAX_MESSAGE_SIZE", cfg.MaxMessageSize); err != nil {
+		return options{}, err
+	}
+	if cfg.BackoffBase, err = envDuration("LIGHTSTACK_BACKOFF_BASE", cfg.BackoffBase); err != nil {
+		return options{}, err
+	}
+	if cfg.BackoffMax, err = envDuration("LIGHTSTACK_BACKOFF_MAX", cfg.BackoffMax); err != nil {
+		return options{}, err
+	}
+	if cfg.BackoffResetAfter, err = envDuration("LIGHTSTACK_BACKOFF_RESET_AFTER", cfg.BackoffResetAfter); err != nil {
+		return options{}, err
+	}
+	if cfg.DNSBackoffBase, err = envDuration("LIGHTSTACK_DNS_BACKOFF_BASE", cfg.DNSBackoffBase); err != nil {
+		return options{}, err
+	}
+	if cfg.DNSBackoffMax, err = envDuration("LIGHTSTACK_DNS_BACKOFF_MAX", cfg.DNSBackoffMax); err != nil {
+		return options{}, err
+	}
+	if cfg.MaxConnectFailures, err = envInt("LIGHTSTACK_MAX_CONNECT_FAILURES", cfg.MaxConnectFailures); err != nil {
+		return options{}, err
+	}
+	if cfg.ConnectLogInterval, err = envDuration("LIGHTSTACK_CONNECT_LOG_INTERVAL", cfg.ConnectLogInterval); err != nil {
+		return options{}, err
+	}
+	if cfg.HTTPTimeout, err = envDuration("LIGHTSTACK_HTTP_TIMEOUT", cfg.HTTPTimeout); err != nil {
+		return options{}, err
+	}
+	if cfg.HTTPMaxTimeout, err = envDuration("LIGHTSTACK_HTTP_MAX_TIMEOUT", cfg.HTTPMaxTimeout); err != nil {
+		return options{}, err
+	}
+	if cfg.HTTPModeTimeouts, err = parseModeDurationList(os.Getenv("LIGHTSTACK_MODE_TIMEOUTS")); err != nil {
+		return options{}, fmt.Errorf("invalid LIGHTSTACK_MODE_TIMEOUTS: %w", err)
+	}
+	if cfg.ModeSettleTimes, err = parseModeDurationList(os.Getenv("LIGHTSTACK_MODE_SETTLE")); err != nil {
+		return options{}, fmt.Errorf("invalid LIGHTSTACK_MODE_SETTLE: %w", err)
+	}
+	if cfg.HTTPMaxIdleConns, err = envInt("LIGHTSTACK_HTTP_MAX_IDLE_CONNS", cfg.HTTPMaxIdleConns); err != nil {
+		return options{}, err
+	}
+	if cfg.HTTPMaxInFlight, err = envInt("LIGHTSTACK_HTTP_MAX_IN_FLIGHT", cfg.HTTPMaxInFlight); err != nil {
+		return options{}, err
+	}
+	if cfg.HTTPMaxAttempts, err = envInt("LIGHTSTACK_HTTP_MAX_ATTEMPTS", cfg.HTTPMaxAttempts); err != nil {
+		return options{}, err
+	}
+	if cfg.HTTPRetryBase, err = envDuration("LIGHTSTACK_HTTP_RETRY_BASE", cfg.HTTPRetryBase); err != nil {
+		return options{}, err
+	}
+	if cfg.HTTPRetryMax, err = envDuration("LIGHTSTACK_HTTP_RETRY_MAX", cfg.HTTPRetryMax); err != nil {
+		return options{}, err
+	}
+	if cfg.BreakerThreshold, err = envInt("LIGHTSTACK_BREAKER_THRESHOLD", cfg.BreakerThreshold); err != nil {
+		return options{}, err
+	}
+	if cfg.BreakerCooldown, err = envDuration("LIGHTSTACK_BREAKER_COOLDOWN", cfg.BreakerCooldown); err != nil {
+		return options{}, err
+	}
+	if cfg.RateLimit, err = envFloat("LIGHTSTACK_RATE_LIMIT", cfg.RateLimit); err != nil {
+		return options{}, err
+	}
+	if cfg.RateBurst, err = envInt("LIGHTSTACK_RATE_BURST", cfg.RateBurst); err != nil {
+		return options{}, err
+	}
+	if cfg.WebhookTimeout, err = envDuration("LIGHTSTACK_WEBHOOK_TIMEOUT", cfg.WebhookTimeout); err != nil {
+		return options{}, err
+	}
+	if cfg.DedupWindow, err = envDuration("LIGHTSTACK_DEDUP_WINDOW", cfg.DedupWindow); err != nil {
+		return options{}, err
+	}
+	if cfg.CoalesceInFlight, err = envBool("LIGHTSTACK_COALESCE", cfg.CoalesceInFlight); err != nil {
+		return options{}, err
+	}
+	if cfg.BatchWindow, err = envDuration("LIGHTSTACK_BATCH_WINDOW", cfg.BatchWindow); err != nil {
+		return options{}, err
+	}
+	if cfg.BatchMaxSize, err = envInt("LIGHTSTACK_BATCH_MAX_SIZE", cfg.BatchMaxSize); err != nil {
+		return options{}, err
+	}
+	cfg.BatchPath = envString("LIGHTSTACK_BATCH_PATH", cfg.BatchPath)
+	if cfg.QueueMaxSize, err = envInt("LIGHTSTACK_QUEUE_MAX_SIZE", cfg.QueueMaxSize); err != nil {
+		return options{}, err
+	}
+	if cfg.QueueReplay, err = envDuration("LIGHTSTACK_QUEUE_REPLAY_INTERVAL", cfg.QueueReplay); err != nil {
+		return options{}, err
+	}
+	if cfg.QueueFlushTimeout, err = envDuration("LIGHTSTACK_QUEUE_FLUSH_TIMEOUT", cfg.QueueFlushTimeout); err != nil {
+		return options{}, err
+	}
+	if cfg.ReplayTiming, err = envBool("LIGHTSTACK_REPLAY_TIMING", cfg.ReplayTiming); err != nil {
+		return options{}, err
+	}
+	if cfg.RecordMaxSize, err = envInt("LIGHTSTACK_RECORD_MAX_SIZE", cfg.RecordMaxSize); err != nil {
+		return options{}, err
+	}
+	if cfg.Workers, err = envInt("LIGHTSTACK_WORKERS", cfg.Workers); err != nil {
+		return options{}, err
+	}
+	if cfg.WorkerQueueSize, err = envInt("LIGHTSTACK_WORKER_QUEUE_SIZE", cfg.WorkerQueueSize); err != nil {
+		return options{}, err
+	}
+	if cfg.DrainTimeout, err = envDuration("LIGHTSTACK_DRAIN_TIMEOUT", cfg.DrainTimeout); err != nil {
+		return options{}, err
+	}
+
+	fs := flag.NewFlagSet("light-stack-connector", flag.ContinueOnError)
+	fs.StringVar(&cfg.WSURL, "ws-url", cfg.WSURL, "WebSocket server URL (env LIGHTSTACK_WS_URL)")
+	fs.Func("ws-failover-url", "comma-separated WebSocket URLs tried in order when -ws-url keeps failing (env LIGHTSTACK_WS_FAILOVER_URLS)", func(v string) error {
+		cfg.WSFailoverURLs = splitList(v)
+		return nil
+	})
+	fs.IntVar(&cfg.WSFailoverAfter, "ws-failover-after", cfg.WSFailoverAfter, "consecutive failed connection attempts before moving to the next WebSocket URL (env LIGHTSTACK_WS_FAILOVER_AFTER)")
+	fs.DurationVar(&cfg.WSFailbackInterval, "ws-failback-interval", cfg.WSFailbackInterval, "while on a failover URL, how often to try -ws-url again; 0 disables (env LIGHTSTACK_WS_FAILBACK_INTERVAL)")
+	resetWSHeaders := resetOnce(func() { cfg.WSHeaders = http.Header{} })
+	fs.Func("ws-header", "extra WebSocket handshake header as Name=Value; repeatable (env LIGHTSTACK_WS_HEADERS, comma-separated)", func(v string) error {
+		name, value, err := parseHeader(v)
+		if err != nil {
+			return err
+		}
+		resetWSHeaders()
+		cfg.WSHeaders.Add(name, value)
+		return nil
+	})
+	fs.StringVar(&cfg.WSTLSCA, "ws-tls-ca", cfg.WSTLSCA, "PEM CA bundle used to verify the WebSocket server instead of the system roots (env LIGHTSTACK_WS_TLS_CA)")
+	fs.BoolVar(&cfg.WSInsecureSkipVerify, "ws-insecure-skip-verify", cfg.WSInsecureSkipVerify, "INSECURE: do not verify the WebSocket server's certificate; local testing only (env LIGHTSTACK_WS_INSECURE_SKIP_VERIFY)")
+	fs.BoolVar(&cfg.WSCompression, "ws-compression", cfg.WSCompression, "offer permessage-deflate compression to the WebSocket server (env LIGHTSTACK_WS_COMPRESSION)")
+	fs.IntVar(&cfg.WSCompressionLevel, "ws-compression-level", cfg.WSCompressionLevel, "flate level for compressed WebSocket writes, -2 (Huffman only) to 9 (best) (env LIGHTSTACK_WS_COMPRESSION_LEVEL)")
+	fs.DurationVar(&cfg.WSConnectTimeout, "ws-connect-timeout", cfg.WSConnectTimeout, "timeout for the TCP connect to the WebSocket server or its proxy (env LIGHTSTACK_WS_CONNECT_TIMEOUT)")
+	fs.DurationVar(&cfg.WSHandshakeTimeout, "ws-handshake-timeout", cfg.WSHandshakeTimeout, "timeout for the whole WebSocket dial, including TLS and the upgrade (env LIGHTSTACK_WS_HANDSHAKE_TIMEOUT)")
+	fs.IntVar(&cfg.WSReadBufferSize, "ws-read-buffer-size", cfg.WSReadBufferSize, "WebSocket read buffer size in bytes (env LIGHTSTACK_WS_READ_BUFFER_SIZE)")
+	fs.IntVar(&cfg.WSWriteBufferSize, "ws-write-buffer-size", cfg.WSWriteBufferSize, "WebSocket write buffer size in bytes (env LIGHTSTACK_WS_WRITE_BUFFER_SIZE)")
+	fs.StringVar(&cfg.HelloMessage, "hello-message", cfg.HelloMessage, "JSON message sent to the WebSocket server right after each connect, e.g. to subscribe to device groups (env LIGHTSTACK_HELLO_MESSAGE)")
+	fs.StringVar(&cfg.SubscriptionsPath, "subscriptions", cfg.SubscriptionsPath, "JSON file listing WebSocket subscriptions (url, hello, device filters) to connect to at once instead of -ws-url (env LIGHTSTACK_SUBSCRIPTIONS)")
+	fs.StringVar(&cfg.APIBaseURL, "api-base-url", cfg.APIBaseURL, "device API base URL (env LIGHTSTACK_API_BASE_URL)")
+	fs.StringVar(&cfg.ShadowAPIBaseURL, "api-shadow-url", cfg.ShadowAPIBaseURL, "also send every command to this device API base URL, best effort, and log responses that differ from the primary's (env LIGHTSTACK_API_SHADOW_URL)")
+	resetAPIHeaders := resetOnce(func() { cfg.APIHeaders = http.Header{} })
+	fs.Func("api-header", "extra device API request header as Name=Value; repeatable (env LIGHTSTACK_API_HEADERS, comma-separated)", func(v string) error {
+		name, value, err := parseHeader(v)
+		if err != nil {
+			return err
+		}
+		resetAPIHeaders()
+		cfg.APIHeaders.Add(name, value)
+		return nil
+	})
+	fs.StringVar(&cfg.APIPath, "api-path", cfg.APIPath, "Go template for the device API path, with {{.DeviceID}}, {{.Mode}} and {{.TurnOn}} (env LIGHTSTACK_API_PATH)")
+	fs.StringVar(&cfg.APIRoutesPath, "api-routes", cfg.APIRoutesPath, "JSON file mapping device IDs or prefixes to other device API base URLs (env LIGHTSTACK_API_ROUTES)")
+	fs.StringVar(&cfg.DeviceGroupsPath, "device-groups", cfg.DeviceGroupsPath, "JSON file mapping group names to device IDs, for commands addressed to group:<name> or * (env LIGHTSTACK_DEVICE_GROUPS)")
+	fs.StringVar(&cfg.NATSURL, "nats-url", cfg.NATSURL, "publish commands as JSON to this NATS server, e.g. nats://localhost:4222, instead of calling the device API (env LIGHTSTACK_NATS_URL)")
+	fs.StringVar(&cfg.NATSSubject, "nats-subject", cfg.NATSSubject, "NATS subject commands are published to with -nats-url (env LIGHTSTACK_NATS_SUBJECT)")
+	fs.StringVar(&cfg.ExecCommand, "exec-command", cfg.ExecCommand, "run this program for every command, with the command as JSON on stdin, instead of calling the device API (env LIGHTSTACK_EXEC_COMMAND)")
+	fs.StringVar(&cfg.APITLSCert, "api-tls-cert", cfg.APITLSCert, "PEM client certificate for mutual TLS with the device API (env LIGHTSTACK_API_TLS_CERT)")
+	fs.StringVar(&cfg.APITLSKey, "api-tls-key", cfg.APITLSKey, "PEM private key for -api-tls-cert (env LIGHTSTACK_API_TLS_KEY)")
+	fs.StringVar(&cfg.APITLSCA, "api-tls-ca", cfg.APITLSCA, "PEM CA bundle used to verify the device API instead of the system roots (env LIGHTSTACK_API_TLS_CA)")
+	fs.Func("api-method", "HTTP method for device API requests: GET, POST, PUT, PATCH or DELETE (env LIGHTSTACK_API_METHOD)", func(v string) error {
+		cfg.APIMethod = strings.ToUpper(strings.TrimSpace(v))
+		return nil
+	})
+	resetAPIModeMethods := resetOnce(func() { cfg.APIModeMethods = map[string]string{} })
+	fs.Func("mode-method", "HTTP method for one mode as mode=METHOD, overriding -api-method; repeatable (env LIGHTSTACK_MODE_METHODS, comma-separated)", func(v string) error {
+		mode, method, err := parseModeMethod(v)
+		if err != nil {
+			return err
+		}
+		resetAPIModeMethods()
+		cfg.APIModeMethods[mode] = method
+		return nil
+	})
+	fs.BoolVar(&cfg.APIQuery, "api-query", cfg.APIQuery, "send command fields as query parameters (env LIGHTSTACK_API_QUERY)")
+	fs.StringVar(&cfg.APIBody, "api-body", cfg.APIBody, "also send command fields in the request body: none, json or form (env LIGHTSTACK_API_BODY)")
+	fs.StringVar(&cfg.APIBoolFormat, "api-bool-format", cfg.APIBoolFormat, "how turnOn is spelled in the query string and form bodies: true/false, 1/0 or on/off (env LIGHTSTACK_API_BOOL_FORMAT)")
+	resetAPIBodyFields := resetOnce(func() { cfg.APIBodyFields = map[string]string{} })
+	fs.Func("api-body-field", "rename a request body field as field=name, or drop it with field=-; repeatable (env LIGHTSTACK_API_BODY_FIELDS, comma-separated)", func(v string) error {
+		field, name, err := parseBodyField(v)
+		if err != nil {
+			return err
+		}
+		resetAPIBodyFields()
+		cfg.APIBodyFields[field] = name
+		return nil
+	})
+	fs.Func("api-success-status", "comma-separated device API response statuses treated as success; empty means any 2xx (env LIGHTSTACK_API_SUCCESS_STATUSES)", func(v string) error {
+		codes, err := parseStatusList(v)
+		if err != nil {
+			return err
+		}
+		cfg.APISuccessStatuses = codes
+		return nil
+	})
+	fs.BoolVar(&cfg.APIFollowRedirects, "api-follow-redirects", cfg.APIFollowRedirects, "follow 3xx responses from the device API; if false they are treated as errors unless listed in -api-success-status (env LIGHTSTACK_API_FOLLOW_REDIRECTS)")
+	fs.StringVar(&cfg.UserAgent, "user-agent", cfg.UserAgent, "User-Agent for device API requests and the WebSocket handshake; empty means laundris-light-stack/<version> (env LIGHTSTACK_USER_AGENT)")
+	fs.StringVar(&cfg.Proxy, "proxy", cfg.Proxy, "http:// or socks5:// proxy for device API and WebSocket connections; overrides HTTP_PROXY, HTTPS_PROXY and NO_PROXY (env LIGHTSTACK_PROXY)")
+	fs.StringVar(&cfg.Preflight, "preflight", cfg.Preflight, "check the device API on startup: off, warn to log failures, or fail to exit (env LIGHTSTACK_PREFLIGHT)")
+	fs.StringVar(&cfg.PreflightPath, "preflight-path", cfg.PreflightPath, "device API path requested by the startup check (env LIGHTSTACK_PREFLIGHT_PATH)")
+	fs.BoolVar(&cfg.DryRun, "dry-run", cfg.DryRun, "log device API requests instead of sending them (env LIGHTSTACK_DRY_RUN)")
+	fs.BoolVar(&cfg.AckState, "ack-state", cfg.AckState, "include the device state returned by the device API in acks (env LIGHTSTACK_ACK_STATE)")
+	fs.BoolVar(&cfg.SendAcks, "send-acks", cfg.SendAcks, "write an ack back to the WebSocket server for every processed command (env LIGHTSTACK_SEND_ACKS)")
+	fs.BoolVar(&cfg.AdvertiseVersions, "advertise-versions", cfg.AdvertiseVersions, "add the supported schema_versions to a JSON object -hello-message (env LIGHTSTACK_ADVERTISE_VERSIONS)")
+	fs.DurationVar(&cfg.KeepAliveInterval, "keepalive-interval", cfg.KeepAliveInterval, "interval between pings (env LIGHTSTACK_KEEPALIVE_INTERVAL)")
+	fs.IntVar(&cfg.KeepAliveJitter, "keepalive-jitter", cfg.KeepAliveJitter, "randomize each ping interval by up to this many percent, 0 to 50 (env LIGHTSTACK_KEEPALIVE_JITTER)")
+	fs.DurationVar(&cfg.PingWriteTimeout, "ping-write-timeout", cfg.PingWriteTimeout, "reconnect if a ping cannot be written within this long (env LIGHTSTACK_PING_WRITE_TIMEOUT)")
+	fs.DurationVar(&cfg.ReadTimeout, "read-timeout", cfg.ReadTimeout, "read deadline for the WebSocket connection (env LIGHTSTACK_READ_TIMEOUT)")
+	fs.BoolVar(&cfg.StrictPing, "strict-ping", cfg.StrictPing, "extend the read deadline on pongs only, not on every message from the server (env LIGHTSTACK_STRICT_PING)")
+	fs.DurationVar(&cfg.IdleTimeout, "idle-timeout", cfg.IdleTimeout, "reconnect if no message, not counting pongs, arrives for this long; 0 disables (env LIGHTSTACK_IDLE_TIMEOUT)")
+	fs.IntVar(&cfg.MaxMessageSize, "max-message-size", cfg.MaxMessageSize, "largest WebSocket message accepted, in bytes, after decompression (env LIGHTSTACK_MAX_MESSAGE_SIZE)")
+	fs.DurationVar(&cfg.BackoffBase, "backoff-base", cfg.BackoffBase, "initial reconnect delay (env LIGHTSTACK_BACKOFF_BASE)")
+	fs.DurationVar(&cfg.BackoffMax, "backoff-max", cfg.BackoffMax, "maximum reconnect delay (env LIGHTSTACK_BACKOFF_MAX)")
+	fs.DurationVar(&cfg.BackoffResetAfter, "backoff-reset-after", cfg.BackoffResetAfter, "connection uptime after which the reconnect delay resets (env LIGHTSTACK_BACKOFF_RESET_AFTER)")
+	fs.DurationVar(&cfg.DNSBackoffBase, "dns-backoff-base", cfg.DNSBackoffBase, "initial reconnect delay after a DNS or network-unreachable failure (env LIGHTSTACK_DNS_BACKOFF_BASE)")
+	fs.DurationVar(&cfg.DNSBackoffMax, "dns-backoff-max", cfg.DNSBackoffMax, "maximum reconnect delay after a DNS or network-unreachable failure (env LIGHTSTACK_DNS_BACKOFF_MAX)")
+	fs.IntVar(&cfg.MaxConnectFailures, "max-connect-failures", cfg.MaxConnectFailures, "exit after this many consecutive failed WebSocket connection attempts; 0 retries forever (env LIGHTSTACK_MAX_CONNECT_FAILURES)")
+	fs.DurationVar(&cfg.ConnectLogInterval, "connect-log-interval", cfg.ConnectLogInterval, "log repeated identical connection failures as one summary per interval; 0 logs every failure (env LIGHTSTACK_CONNECT_LOG_INTERVAL)")
+	fs.DurationVar(&cfg.HTTPTimeout, "http-timeout", cfg.HTTPTimeout, "timeout for device API requests (env LIGHTSTACK_HTTP_TIMEOUT)")
+	resetHTTPModeTimeouts := resetOnce(func() { cfg.HTTPModeTimeouts = map[string]time.Duration{} })
+	fs.Func("mode-timeout", "device API timeout for one mode as mode=duration, overriding -http-timeout; repeatable (env LIGHTSTACK_MODE_TIMEOUTS, comma-separated)", func(v string) error {
+		mode, d, err := parseModeDuration(v)
+		if err != nil {
+			return err
+		}
+		resetHTTPModeTimeouts()
+		cfg.HTTPModeTimeouts[mode] = d
+		return nil
+	})
+	fs.DurationVar(&cfg.HTTPMaxTimeout, "http-max-timeout", cfg.HTTPMaxTimeout, "upper bound for timeouts set by a command's timeout_ms (env LIGHTSTACK_HTTP_MAX_TIMEOUT)")
+	fs.IntVar(&cfg.HTTPMaxIdleConns, "http-max-idle-conns", cfg.HTTPMaxIdleConns, "maximum idle connections kept to the device API (env LIGHTSTACK_HTTP_MAX_IDLE_CONNS)")
+	fs.IntVar(&cfg.HTTPMaxInFlight, "http-max-in-flight", cfg.HTTPMaxInFlight, "maximum device API requests in flight at once, 0 for no limit (env LIGHTSTACK_HTTP_MAX_IN_FLIGHT)")
+	fs.IntVar(&cfg.HTTPMaxAttempts, "http-max-attempts", cfg.HTTPMaxAttempts, "attempts per command before giving up (env LIGHTSTACK_HTTP_MAX_ATTEMPTS)")
+	fs.DurationVar(&cfg.HTTPRetryBase, "http-retry-base", cfg.HTTPRetryBase, "initial delay between device API retries (env LIGHTSTACK_HTTP_RETRY_BASE)")
+	fs.DurationVar(&cfg.HTTPRetryMax, "http-retry-max", cfg.HTTPRetryMax, "maximum delay between device API retries (env LIGHTSTACK_HTTP_RETRY_MAX)")
+	fs.IntVar(&cfg.BreakerThreshold, "breaker-threshold", cfg.BreakerThreshold, "consecutive device API failures that open the circuit breaker, 0 to disable (env LIGHTSTACK_BREAKER_THRESHOLD)")
+	fs.DurationVar(&cfg.BreakerCooldown, "breaker-cooldown", cfg.BreakerCooldown, "how long the circuit breaker stays open before probing the device API (env LIGHTSTACK_BREAKER_COOLDOWN)")
+	fs.Float64Var(&cfg.RateLimit, "rate-limit", cfg.RateLimit, "maximum device API requests per second, 0 for no limit (env LIGHTSTACK_RATE_LIMIT)")
+	fs.IntVar(&cfg.RateBurst, "rate-burst", cfg.RateBurst, "device API requests allowed in a burst above rate-limit (env LIGHTSTACK_RATE_BURST)")
+	fs.Func("allowed-modes", "comma-separated list of accepted command modes; empty accepts any (env LIGHTSTACK_ALLOWED_MODES)", func(v string) error {
+		cfg.AllowedModes = splitList(v)
+		return nil
+	})
+	fs.Func("extended-modes", "comma-separated list of modes that accept brightness and color; empty means all (env LIGHTSTACK_EXTENDED_MODES)", func(v string) error {
+		cfg.ExtendedModes = splitList(v)
+		return nil
+	})
+	resetModePriorities := resetOnce(func() { cfg.ModePriorities = map[string]int{} })
+	fs.Func("mode-priority", "dispatch priority for a mode as mode=N, higher first; repeatable (env LIGHTSTACK_MODE_PRIORITIES, comma-separated)", func(v string) error {
+		mode, n, err := parsePriority(v)
+		if err != nil {
+			return err
+		}
+		resetModePriorities()
+		cfg.ModePriorities[mode] = n
+		return nil
+	})
+	resetModeSettleTimes := resetOnce(func() { cfg.ModeSettleTimes = map[string]time.Duration{} })
+	fs.Func("mode-settle", "minimum time after a successful command in a mode before the next command to the same device, as mode=duration; repeatable (env LIGHTSTACK_MODE_SETTLE, comma-separated)", func(v string) error {
+		mode, d, err := parseModeDuration(v)
+		if err != nil {
+			return err
+		}
+		resetModeSettleTimes()
+		cfg.ModeSettleTimes[mode] = d
+		return nil
+	})
+	fs.Func("device-allow", "comma-separated device ID patterns to act on, e.g. dock-*; empty allows all (env LIGHTSTACK_DEVICE_ALLOW)", func(v string) error {
+		cfg.DeviceAllow = splitList(v)
+		return nil
+	})
+	fs.Func("device-deny", "comma-separated device ID patterns to ignore; takes precedence over -device-allow (env LIGHTSTACK_DEVICE_DENY)", func(v string) error {
+		cfg.DeviceDeny = splitList(v)
+		return nil
+	})
+	fs.StringVar(&cfg.WebhookURL, "webhook-url", cfg.WebhookURL, "URL notified with a JSON POST after every processed command; empty disables (env LIGHTSTACK_WEBHOOK_URL)")
+	fs.DurationVar(&cfg.WebhookTimeout, "webhook-timeout", cfg.WebhookTimeout, "timeout for each webhook notification (env LIGHTSTACK_WEBHOOK_TIMEOUT)")
+	fs.BoolVar(&opts.ShowVersion, "version", false, "print the version, commit and build date, then exit")
+	fs.StringVar(&opts.ConfigPath, "config", opts.ConfigPath, "JSON file of flag values, e.g. {\"device-allow\": \"dock-*\"}; command-line flags take precedence, and it is read again on SIGHUP or POST /reload (env LIGHTSTACK_CONFIG)")
+	fs.StringVar(&opts.Log.Format, "log-format", opts.Log.Format, "log output format, text or json (env LIGHTSTACK_LOG_FORMAT)")
+	fs.Func("log-level", "minimum log level: debug, info, warn or error (env LIGHTSTACK_LOG_LEVEL)", func(v string) error {
+		opts.Log.Level = strings.ToLower(strings.TrimSpace(v))
+		return nil
+	})
+	fs.IntVar(&opts.Log.SampleBurst, "log-sample", opts.Log.SampleBurst, "keep at most this many debug and info entries per event every -log-sample-interval; 0 keeps all (env LIGHTSTACK_LOG_SAMPLE)")
+	fs.DurationVar(&opts.Log.SampleInterval, "log-sample-interval", opts.Log.SampleInterval, "window for -log-sample (env LIGHTSTACK_LOG_SAMPLE_INTERVAL)")
+	fs.StringVar(&opts.MetricsAddr, "metrics-addr", opts.MetricsAddr, "listen address for the Prometheus /metrics endpoint; empty disables it (env LIGHTSTACK_METRICS_ADDR)")
+	fs.StringVar(&opts.HealthAddr, "health-addr", opts.HealthAddr, "listen address for the /healthz and /readyz probes; empty disables them (env LIGHTSTACK_HEALTH_ADDR)")
+	fs.StringVar(&opts.InjectAddr, "inject-addr", opts.InjectAddr, "listen address for POST /command to inject commands by hand; testing only, empty disables it (env LIGHTSTACK_INJECT_ADDR)")
+	fs.StringVar(&opts.AdminAddr, "admin-addr", opts.AdminAddr, "listen address for POST /reload, which requires -admin-token; empty disables it (env LIGHTSTACK_ADMIN_ADDR)")
+	fs.StringVar(&opts.AdminToken, "admin-token", opts.AdminToken, "bearer token required by the admin server (env LIGHTSTACK_ADMIN_TOKEN)")
+	fs.StringVar(&opts.OTelEndpoint, "otel-endpoint", opts.OTelEndpoint, "OTLP/HTTP URL to export command and device API traces to, e.g. http://localhost:4318; empty disables tracing (env LIGHTSTACK_OTEL_ENDPOINT)")
+	fs.DurationVar(&opts.ShutdownTimeout, "shutdown-timeout", opts.ShutdownTimeout, "force the process to exit if shutting down after SIGINT or SIGTERM takes longer than this; 0 waits forever (env LIGHTSTACK_SHUTDOWN_TIMEOUT)")
+	fs.IntVar(&cfg.Workers, "workers", cfg.Workers, "number of goroutines processing commands (env LIGHTSTACK_WORKERS)")
+	fs.IntVar(&cfg.WorkerQueueSize, "worker-queue-size", cfg.WorkerQueueSize, "commands buffered per worker before reads block (env LIGHTSTACK_WORKER_QUEUE_SIZE)")
+	fs.DurationVar(&cfg.DrainTimeout, "drain-timeout", cfg.DrainTimeout, "how long a drain (SIGUSR1) waits for in-flight commands before cancelling them (env LIGHTSTACK_DRAIN_TIMEOUT)")
+	fs.DurationVar(&cfg.DedupWindow, "dedup-window", cfg.DedupWindow, "drop commands identical to one received within this window; 0 disables (env LIGHTSTACK_DEDUP_WINDOW)")
+	fs.BoolVar(&cfg.CoalesceInFlight, "coalesce", cfg.CoalesceInFlight, "let identical commands in flight at the same time share one device API call (env LIGHTSTACK_COALESCE)")
+	fs.DurationVar(&cfg.BatchWindow, "batch-window", cfg.BatchWindow, "collect commands for this long and send them as one batch request; 0 disables (env LIGHTSTACK_BATCH_WINDOW)")
+	fs.IntVar(&cfg.BatchMaxSize, "batch-max-size", cfg.BatchMaxSize, "maximum commands per batch request (env LIGHTSTACK_BATCH_MAX_SIZE)")
+	fs.StringVar(&cfg.BatchPath, "batch-path", cfg.BatchPath, "device API path for batch requests (env LIGHTSTACK_BATCH_PATH)")
+	fs.StringVar(&cfg.QueuePath, "queue-path", cfg.QueuePath, "file where undeliverable commands are persisted for replay; empty disables (env LIGHTSTACK_QUEUE_PATH)")
+	fs.IntVar(&cfg.QueueMaxSize, "queue-max-size", cfg.QueueMaxSize, "maximum persisted commands; the oldest is dropped when full (env LIGHTSTACK_QUEUE_MAX_SIZE)")
+	fs.DurationVar(&cfg.QueueReplay, "queue-replay-interval", cfg.QueueReplay, "how often persisted commands are replayed (env LIGHTSTACK_QUEUE_REPLAY_INTERVAL)")
+	fs.DurationVar(&cfg.QueueFlushTimeout, "queue-flush-timeout", cfg.QueueFlushTimeout, "on shutdown, keep sending pending and queued commands for up to this long before persisting the rest; 0 persists them right away (env LIGHTSTACK_QUEUE_FLUSH_TIMEOUT)")
+	fs.StringVar(&cfg.ReplayPath, "replay", cfg.ReplayPath, "replay newline-delimited JSON commands from this file instead of connecting to the WebSocket server, then exit (env LIGHTSTACK_REPLAY_PATH)")
+	fs.BoolVar(&cfg.ReplayTiming, "replay-timing", cfg.ReplayTiming, "with -replay, reproduce the gaps between the commands' recorded_at timestamps (env LIGHTSTACK_REPLAY_TIMING)")
+	fs.StringVar(&cfg.RecordPath, "record", cfg.RecordPath, "append every received command with a timestamp to this JSON-lines file, readable by -replay (env LIGHTSTACK_RECORD_PATH)")
+	fs.IntVar(&cfg.RecordMaxSize, "record-max-size", cfg.RecordMaxSize, "rotate the -record file to <file>.1 once it reaches this many bytes; 0 never rotates (env LIGHTSTACK_RECORD_MAX_SIZE)")
+	if err := fs.Parse(args); err != nil {
+		return options{}, err
+	}
+	if opts.ShowVersion {
+		return opts, nil
+	}
+	if opts.ConfigPath != "" {
+		if err := applyConfigFile(fs, opts.ConfigPath); err != nil {
+			return options{}, err
+		}
+	}
+
+	if err := opts.validate(); err != nil {
+		return options{}, err
+	}
+	return opts, nil
+}
+
+func (o options) validate() error {
+	if o.Log.Format != "text" && o.Log.Format != "json" {
+		return fmt.Errorf("log-format must be text or json, got %q", o.Log.Format)
+	}
+	switch o.Log.Level {
+	case "debug", "info", "warn", "error":
+	default:
+		return fmt.Errorf("log-level must be debug, info, warn or error, got %q", o.Log.Level)
+	}
+	if o.Log.SampleBurst < 0 {
+		return fmt.Errorf("log-sample must not be negative, got %d", o.Log.SampleBurst)
+	}
+	if o.Log.SampleBurst > 0 && o.Log.SampleInterval <= 0 {
+		return fmt.Errorf("log-sample-interval must be positive, got %s", o.Log.SampleInterval)
+	}
+	if o.AdminAddr != "" && o.AdminToken == "" {
+		return errors.New("admin-token is required with admin-addr")
+	}
+	if o.ShutdownTimeout < 0 {
+		return fmt.Errorf("shutdown-timeout must not be negative, got %s", o.ShutdownTimeout)
+	}
+	if o.QueuePath != "" && o.ShutdownTimeout > 0 && o.QueueFlushTimeout >= o.ShutdownTimeout {
+		return fmt.Errorf("queue-flush-timeout (%s) must be less than shutdown-timeout (%s)", o.QueueFlushTimeout, o.ShutdownTimeout)
+	}
+	return o.Config.Validate()
+}
+
+// applyConfigFile sets the flags named in the JSON object at path, except
+// those given on the command line. An array sets a repeatable flag once per
+// element.
+func applyConfigFile(fs *flag.FlagSet, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var settings map[string]any
+	if err := dec.Decode(&settings); err != nil {
+		return fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+
+	given := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	for _, name := range slices.Sorted(maps.Keys(settings)) {
+		if name == "config" || name == "version" || fs.Lookup(name) == nil {
+			return fmt.Errorf("invalid config file %s: unknown setting %q", path, name)
+		}
+		if given[name] {
+			continue
+		}
+		values, ok := settings[name].([]any)
+		if !ok {
+			values = []any{settings[name]}
+		}
+		for _, v := range values {
+			switch v.(type) {
+			case string, json.Number, bool:
+			default:
+				return fmt.Errorf("invalid config file %s: %s must be a string, number, boolean or an array of them", path, name)
+			}
+			if err := fs.Set(name, fmt.Sprint(v)); err != nil {
+				return fmt.Errorf("invalid config file %s: %s: %w", path, name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// resetOnce returns a function that calls reset the first time it is
+// called, so a repeatable flag replaces the list from the environment
+// instead of adding to it.
+func resetOnce(reset func()) func() {
+	var once sync.Once
+	return func() { once.Do(reset) }
+}
+
+func envString(key, fallback string) string {
+	if v, ok := os.LookupEnv(key); ok && v != "" {
+		return v
+	}
+	return fallback
+}
+
+func envDuration(key string, fallback time.Duration) (time.Duration, error) {
+	v, ok := os.LookupEnv(key)
+	if !ok || v == "" {
+		return fallback, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %w", key, v, err)
+	}
+	return d, nil
+}
+
+func envInt(key string, fallback int) (int, error) {
+	v, ok := os.LookupEnv(key)
+	if !ok || v == "" {
+		return fallback, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %w", key, v, err)
+	}
+	return n, nil
+}
+
+func envBool(key string, fallback bool) (bool, error) {
+	v, ok := os.LookupEnv(key)
+	if !ok || v == "" {
+		return fallback, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s %q: %w", key, v, err)
+	}
+	return b, nil
+}
+
+func envFloat(key string, fallback float64) (float64, error) {
+	v, ok := os.LookupEnv(key)
+	if !ok || v == "" {
+		return fallback, nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %w", key, v, err)
+	}
+	return f, nil
+}
+
+func splitList(v string) []string {
+	var out []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// parseHeader parses a "Name=Value" pair as given to the -ws-header and
+// -api-header flags.
+func parseHeader(v string) (string, string, error) {
+	name, value, ok := strings.Cut(v, "=")
+	name = strings.TrimSpace(name)
+	if !ok || name == "" {
+		return "", "", fmt.Errorf("invalid header %q: want Name=Value", v)
+	}
+	return http.CanonicalHeaderKey(name), strings.TrimSpace(value), nil
+}
+
+func parseHeaderList(v string, into http.Header) error {
+	for _, item := range splitList(v) {
+		name, value, err := parseHeader(item)
+		if err != nil {
+			return err
+		}
+		into.Add(name, value)
+	}
+	return nil
+}
+
+// parsePriority parses a "mode=N" pair as given to -mode-priority.
+func parsePriority(v string) (string, int, error) {
+	mode, value, ok := strings.Cut(v, "=")
+	mode = strings.TrimSpace(mode)
+	if !ok || mode == "" {
+		return "", 0, fmt.Errorf("invalid mode priority %q: want mode=N", v)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid mode priority %q: %w", v, err)
+	}
+	return mode, n, nil
+}
+
+func parsePriorityList(v string) (map[string]int, error) {
+	items := splitList(v)
+	if len(items) == 0 {
+		return nil, nil
+	}
+	out := map[string]int{}
+	for _, item := range items {
+		mode, n, err := parsePriority(item)
+		if err != nil {
+			return nil, err
+		}
+		out[mode] = n
+	}
+	return out, nil
+}
+
+// parseBodyField parses a "field=name" pair as given to -api-body-field.
+func parseBodyField(v string) (string, string, error) {
+	field, name, ok := strings.Cut(v, "=")
+	field, name = strings.TrimSpace(field), strings.TrimSpace(name)
+	if !ok || field == "" || name == "" {
+		return "", "", fmt.Errorf("invalid body field %q: want field=name", v)
+	}
+	return field, name, nil
+}
+
+func parseBodyFieldList(v string) (map[string]string, error) {
+	items := splitList(v)
+	if len(items) == 0 {
+		return nil, nil
+	}
+	out := map[string]string{}
+	for _, item := range items {
+		field, name, err := parseBodyField(item)
+		if err != nil {
+			return nil, err
+		}
+		out[field] = name
+	}
+	return out, nil
+}
+
+// parseModeMethod parses a "mode=METHOD" pair as given to -mode-method.
+func parseModeMethod(v string) (string, string, error) {
+	mode, method, ok := strings.Cut(v, "=")
+	mode, method = strings.TrimSpace(mode), strings.TrimSpace(method)
+	if !ok || mode == "" || method == "" {
+		return "", "", fmt.Errorf("invalid mode method %q: want mode=METHOD", v)
+	}
+	return mode, strings.ToUpper(method), nil
+}
+
+func parseModeMethodList(v string) (map[string]string, error) {
+	items := splitList(v)
+	if len(items) == 0 {
+		return nil, nil
+	}
+	out := map[string]string{}
+	for _, item := range items {
+		mode, method, err := parseModeMethod(item)
+		if err != nil {
+			return nil, err
+		}
+		out[mode] = method
+	}
+	return out, nil
+}
+
+// parseModeDuration parses a "mode=duration" pair as given to -mode-timeout
+// and -mode-settle.
+func parseModeDuration(v string) (string, time.Duration, error) {
+	mode, value, ok := strings.Cut(v, "=")
+	mode = strings.TrimSpace(mode)
+	if !ok || mode == "" {
+		return "", 0, fmt.Errorf("invalid mode duration %q: want mode=duration", v)
+	}
+	d, err := time.ParseDuration(strings.TrimSpace(value))
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid mode duration %q: %w", v, err)
+	}
+	return mode, d, nil
+}
+
+func parseModeDurationList(v string) (map[string]time.Duration, error) {
+	items := splitList(v)
+	if len(items) == 0 {
+		return nil, nil
+	}
+	out := map[string]time.Duration{}
+	for _, item := range items {
+		mode, d, err := parseModeDuration(item)
+		if err != nil {
+			return nil, err
+		}
+		out[mode] = d
+	}
+	return out, nil
+}
+
+// parseStatusList parses a comma-separated list of HTTP status codes as
+// given to -api-success-status.
+func parseStatusList(v string) ([]int, error) {
+	var out []int
+	for _, item := range splitList(v) {
+		code, err := strconv.Atoi(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid status %q: %w", item, err)
+		}
+		out = append(out, code)
+	}
+	return out, nil
+}
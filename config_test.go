@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"gt-linens-light-stack/lightstack"
+)
+
+func TestApplyConfigFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(`{
+		"ws-url": "ws://file.example/ws",
+		"workers": 8,
+		"http-timeout": "3s",
+		"mode-method": ["lift=PUT", "strobe=PATCH"]
+	}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("LIGHTSTACK_WS_URL", "ws://env.example/ws")
+	t.Setenv("LIGHTSTACK_WORKERS", "2")
+
+	opts, err := loadOptions([]string{"-config", path, "-workers", "4"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := opts.Config
+	if cfg.WSURL != "ws://file.example/ws" {
+		t.Errorf("WSURL = %q, want the file to override the environment", cfg.WSURL)
+	}
+	if cfg.Workers != 4 {
+		t.Errorf("Workers = %d, want the command line to override the file", cfg.Workers)
+	}
+	if cfg.HTTPTimeout != 3*time.Second {
+		t.Errorf("HTTPTimeout = %s, want 3s from the file", cfg.HTTPTimeout)
+	}
+	if cfg.APIModeMethods["lift"] != "PUT" || cfg.APIModeMethods["strobe"] != "PATCH" {
+		t.Errorf("APIModeMethods = %v, want both array elements applied", cfg.APIModeMethods)
+	}
+
+	for name, settings := range map[string]string{
+		"unknown setting": `{"no-such-flag": 1}`,
+		"object value":    `{"workers": {"n": 1}}`,
+		"invalid value":   `{"workers": "many"}`,
+	} {
+		if err := os.WriteFile(path, []byte(settings), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadOptions([]string{"-config", path}); err == nil || !strings.Contains(err.Error(), "invalid config file") {
+			t.Errorf("%s: err = %v, want an invalid config file error", name, err)
+		}
+	}
+}
+
+func TestRepeatableFlagsReplaceEnvironment(t *testing.T) {
+	tests := []struct {
+		flag, value, env, envValue string
+		got                        func(lightstack.Config) any
+		want                       any
+	}{
+		{"ws-header", "X-Api-Key=flag", "LIGHTSTACK_WS_HEADERS", "X-Api-Key=env,X-Tenant=env",
+			func(c lightstack.Config) any { return c.WSHeaders }, http.Header{"X-Api-Key": {"flag"}}},
+		{"api-header", "X-Api-Key=flag", "LIGHTSTACK_API_HEADERS", "X-Api-Key=env,X-Tenant=env",
+			func(c lightstack.Config) any { return c.APIHeaders }, http.Header{"X-Api-Key": {"flag"}}},
+		{"mode-method", "off=PATCH", "LIGHTSTACK_MODE_METHODS", "off=PUT,status=GET",
+			func(c lightstack.Config) any { return c.APIModeMethods }, map[string]string{"off": "PATCH"}},
+		{"api-body-field", "mode=-", "LIGHTSTACK_API_BODY_FIELDS", "mode=m,turnOn=on",
+			func(c lightstack.Config) any { return c.APIBodyFields }, map[string]string{"mode": "-"}},
+		{"mode-timeout", "lift=1m", "LIGHTSTACK_MODE_TIMEOUTS", "lift=30s,status=1s",
+			func(c lightstack.Config) any { return c.HTTPModeTimeouts }, map[string]time.Duration{"lift": time.Minute}},
+		{"mode-priority", "lift=1", "LIGHTSTACK_MODE_PRIORITIES", "lift=5,off=9",
+			func(c lightstack.Config) any { return c.ModePriorities }, map[string]int{"lift": 1}},
+		{"mode-settle", "lift=1s", "LIGHTSTACK_MODE_SETTLE", "lift=2s,strobe=1s",
+			func(c lightstack.Config) any { return c.ModeSettleTimes }, map[string]time.Duration{"lift": time.Second}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.flag, func(t *testing.T) {
+			t.Setenv(tt.env, tt.envValue)
+			opts, err := loadOptions([]string{"-" + tt.flag, tt.value})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := tt.got(opts.Config); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("-%s with %s set = %v, want %v", tt.flag, tt.env, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"gt-linens-light-stack/lightstack"
+)
+
+const (
+	maxInjectBody = 64 << 10
+	injectTimeout = 5 * time.Second
+)
+
+// injectHandler accepts commands on POST /command and feeds them into the
+// client as if they had arrived over the WebSocket connection.
+func injectHandler(client interface {
+	Submit(ctx context.Context, cmd lightstack.Command) error
+}) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /command", func(w http.ResponseWriter, r *http.Request) {
+		var cmd lightstack.Command
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxInjectBody)).Decode(&cmd); err != nil {
+			http.Error(w, "invalid command: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := cmd.Validate(nil); err != nil {
+			http.Error(w, "invalid command: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), injectTimeout)
+		defer cancel()
+		if err := client.Submit(ctx, cmd); err != nil {
+			http.Error(w, "client is not accepting commands", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte("accepted\n"))
+	})
+	return mux
+}
@@ -0,0 +1,73 @@
+package lightstack
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+)
+
+const (
+	ackOutcomeSuccess = "success"
+	ackOutcomeError   = "error"
+)
+
+// Ack reports the result of a processed command back to the server.
+type Ack struct {
+	Type       string `json:"type"`
+	DeviceID   string `json:"device_id"`
+	RequestID  string `json:"request_id,omitempty"`
+	Outcome    string `json:"outcome"`
+	StatusCode int    `json:"status_code,omitempty"`
+	Error      string `json:"error,omitempty"`
+	// Seq numbers commands in the order the client received them. The
+	// client never acks a command after a newer one for the same device, so
+	// the ack with the highest Seq for a device reports its current state.
+	Seq uint64 `json:"seq"`
+	// Attempts is how many times the command was sent, retries included.
+	Attempts int `json:"attempts,omitempty"`
+	// State is the device state reported by the device API, included when
+	// Config.AckState is set.
+	State json.RawMessage `json:"state,omitempty"`
+}
+
+// newAck reports cmd's outcome with the device API status code of res, or
+// of err if it is an HTTPStatusError.
+func newAck(cmd Command, res Result, err error) Ack {
+	ack := Ack{Type: "ack", DeviceID: cmd.DeviceID, RequestID: cmd.RequestID}
+	if err == nil {
+		ack.Outcome = ackOutcomeSuccess
+		ack.StatusCode = res.StatusCode
+		return ack
+	}
+
+	ack.Outcome = ackOutcomeError
+	ack.Error = err.Error()
+	var se *HTTPStatusError
+	if errors.As(err, &se) {
+		ack.StatusCode = se.StatusCode
+	}
+	return ack
+}
+
+// ackTracker remembers the newest command acked for each device, so the
+// outcome of an older command that finishes later is not acked after it.
+type ackTracker struct {
+	mu    sync.Mutex
+	acked map[string]uint64
+}
+
+func newAckTracker() *ackTracker {
+	return &ackTracker{acked: map[string]uint64{}}
+}
+
+// Advance records seq as acked for deviceID. It returns false without
+// recording anything if a newer command for the device was already acked.
+func (t *ackTracker) Advance(deviceID string, seq uint64) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if seq < t.acked[deviceID] {
+		return false
+	}
+	t.acked[deviceID] = seq
+	return true
+}
@@ -0,0 +1,46 @@
+package lightstack
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"text/template"
+)
+
+// DefaultAPIPath is the device API path for a single command.
+const DefaultAPIPath = "/api/device/gpo/light/{{.DeviceID}}"
+
+// apiPathData is what a Config.APIPath template is rendered with. The
+// strings are path-escaped, so a device ID cannot add path segments or a
+// query string.
+type apiPathData struct {
+	DeviceID string
+	Mode     string
+	TurnOn   bool
+}
+
+// parseAPIPath parses an APIPath template and renders it once with empty
+// data, so that unknown fields are reported at startup.
+func parseAPIPath(text string) (*template.Template, error) {
+	if !strings.HasPrefix(text, "/") {
+		return nil, fmt.Errorf("api-path must start with /, got %q", text)
+	}
+	t, err := template.New("api-path").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid api-path: %w", err)
+	}
+	if err := t.Execute(io.Discard, apiPathData{}); err != nil {
+		return nil, fmt.Errorf("invalid api-path: %w", err)
+	}
+	return t, nil
+}
+
+func renderAPIPath(t *template.Template, cmd Command) (string, error) {
+	var b strings.Builder
+	data := apiPathData{DeviceID: url.PathEscape(cmd.DeviceID), Mode: url.PathEscape(cmd.Mode), TurnOn: cmd.TurnOn}
+	if err := t.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("failed to render api-path: %w", err)
+	}
+	return b.String(), nil
+}
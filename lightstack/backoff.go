@@ -0,0 +1,50 @@
+package lightstack
+
+import (
+	"context"
+	"math/rand/v2"
+	"time"
+)
+
+// reconnectClock is the time source of the reconnect loop, so tests can
+// check its delays without waiting for them.
+type reconnectClock struct {
+	now   func() time.Time
+	sleep func(ctx context.Context, d time.Duration)
+	// jitter returns a random number in [0, n) for backoff delays.
+	jitter func(n int64) int64
+}
+
+var realClock = reconnectClock{now: time.Now, sleep: sleepContext, jitter: rand.Int64N}
+
+// backoff computes exponentially growing reconnect delays with full jitter.
+type backoff struct {
+	base    time.Duration
+	max     time.Duration
+	attempt int
+	rand    func(n int64) int64
+}
+
+func newBackoff(base, max time.Duration) *backoff {
+	return &backoff{base: base, max: max, rand: rand.Int64N}
+}
+
+// Next returns a random delay in [0, min(max, base*2^attempt)] and advances
+// the attempt counter.
+func (b *backoff) Next() time.Duration {
+	ceiling := b.base
+	for i := 0; i < b.attempt && ceiling < b.max; i++ {
+		ceiling *= 2
+	}
+	if ceiling > b.max {
+		ceiling = b.max
+	}
+	if ceiling < b.max {
+		b.attempt++
+	}
+	return time.Duration(b.rand(int64(ceiling) + 1))
+}
+
+func (b *backoff) Reset() {
+	b.attempt = 0
+}
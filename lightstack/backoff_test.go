@@ -0,0 +1,136 @@
+package lightstack
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// fakeClock records the reconnect delays instead of sleeping, advancing
+// its time by each.
+type fakeClock struct {
+	mu     sync.Mutex
+	t      time.Time
+	sleeps []time.Duration
+}
+
+func (f *fakeClock) now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.t
+}
+
+func (f *fakeClock) advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.t = f.t.Add(d)
+}
+
+func (f *fakeClock) sleep(ctx context.Context, d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.sleeps = append(f.sleeps, d)
+	f.t = f.t.Add(d)
+}
+
+func (f *fakeClock) Sleeps() []time.Duration {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.sleeps)
+}
+
+// scriptedDialer fails or dials through for each attempt in script, and
+// calls stop once the script is used up.
+type scriptedDialer struct {
+	script []bool
+	stop   func()
+	mu     sync.Mutex
+	dials  int
+}
+
+func (d *scriptedDialer) DialContext(ctx context.Context, url string, h http.Header) (*websocket.Conn, *http.Response, error) {
+	d.mu.Lock()
+	n := d.dials
+	d.dials++
+	d.mu.Unlock()
+	if n >= len(d.script) {
+		d.stop()
+		return nil, nil, context.Canceled
+	}
+	if !d.script[n] {
+		return nil, nil, errors.New("connection refused by script")
+	}
+	return websocket.DefaultDialer.DialContext(ctx, url, h)
+}
+
+func TestReconnectBackoff(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(0, 0)}
+	// Each connection delivers one command, waits for its ack, then lets
+	// holds[i] pass before closing.
+	holds := []time.Duration{time.Second, time.Minute}
+	var mu sync.Mutex
+	conns := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var upgrader websocket.Upgrader
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		mu.Lock()
+		hold := holds[conns]
+		conns++
+		mu.Unlock()
+
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(`{"device_id":"stack-1","mode":"red","turnOn":true}`)); err != nil {
+			return
+		}
+		if _, _, err := conn.ReadMessage(); err != nil {
+			return
+		}
+		clock.advance(hold)
+		conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""))
+	}))
+	t.Cleanup(srv.Close)
+	api := newFakeDeviceAPI(t, http.StatusOK)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cfg := DefaultConfig()
+	cfg.WSURL = "ws" + strings.TrimPrefix(srv.URL, "http")
+	cfg.APIBaseURL = api.URL
+	cfg.BackoffBase = 100 * time.Millisecond
+	cfg.BackoffMax = 800 * time.Millisecond
+	cfg.BackoffResetAfter = 30 * time.Second
+	cfg.Dialer = &scriptedDialer{
+		script: []bool{false, false, false, true, false, true, false},
+		stop:   cancel,
+	}
+	c := newTestClient(t, cfg)
+	c.clock = reconnectClock{now: clock.now, sleep: clock.sleep, jitter: func(n int64) int64 { return n - 1 }}
+
+	if err := c.Run(ctx); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+
+	want := []time.Duration{
+		100 * time.Millisecond, // three failed dials, doubling
+		200 * time.Millisecond,
+		400 * time.Millisecond,
+		800 * time.Millisecond, // a 1s connection keeps the backoff
+		800 * time.Millisecond, // capped at BackoffMax
+		100 * time.Millisecond, // a 1m connection resets it
+		200 * time.Millisecond,
+	}
+	if got := clock.Sleeps(); !slices.Equal(got, want) {
+		t.Errorf("reconnect delays = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,170 @@
+package lightstack
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// dispatcher hands commands from the source to whatever processes
+// them: a workerPool by default, or a batcher when batching is enabled.
+type dispatcher interface {
+	Submit(ctx context.Context, cmd Command) error
+	Close()
+}
+
+// batcher collects commands for up to window after the first one arrives,
+// or until maxSize are pending, and hands them to flush as one slice.
+// Batches are flushed one at a time, in arrival order.
+type batcher struct {
+	window  time.Duration
+	maxSize int
+	flush   func([]Command)
+	in      chan Command
+	done    chan struct{}
+}
+
+func newBatcher(window time.Duration, maxSize, queueSize int, flush func([]Command)) *batcher {
+	b := &batcher{
+		window:  window,
+		maxSize: maxSize,
+		flush:   flush,
+		in:      make(chan Command, queueSize),
+		done:    make(chan struct{}),
+	}
+	go b.run()
+	return b
+}
+
+func (b *batcher) run() {
+	defer close(b.done)
+
+	var batch []Command
+	var timer *time.Timer
+	var expired <-chan time.Time
+	send := func() {
+		if timer != nil {
+			timer.Stop()
+		}
+		expired = nil
+		b.flush(batch)
+		batch = nil
+	}
+
+	for {
+		select {
+		case cmd, ok := <-b.in:
+			if !ok {
+				if len(batch) > 0 {
+					send()
+				}
+				return
+			}
+			batch = append(batch, cmd)
+			if len(batch) == 1 {
+				timer = time.NewTimer(b.window)
+				expired = timer.C
+			}
+			if len(batch) >= b.maxSize {
+				send()
+			}
+		case <-expired:
+			send()
+		}
+	}
+}
+
+func (b *batcher) Submit(ctx context.Context, cmd Command) error {
+	select {
+	case b.in <- cmd:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close stops accepting commands and waits for the pending batch to flush.
+func (b *batcher) Close() {
+	close(b.in)
+	<-b.done
+}
+
+// DefaultBatchPath is the device API path for batch requests.
+const DefaultBatchPath = "/api/device/gpo/light/batch"
+
+// batchURL returns the batch request URL at path, or at DefaultBatchPath if
+// path is empty.
+func batchURL(baseURL, path string) string {
+	if path == "" {
+		path = DefaultBatchPath
+	}
+	return strings.TrimRight(baseURL, "/") + path
+}
+
+func (c *Client) sendBatch(ctx context.Context, baseURL, idempotencyKey string, cmds []Command) (Result, error) {
+	body, err := json.Marshal(cmds)
+	if err != nil {
+		return Result{}, fmt.Errorf("failed to encode batch: %w", err)
+	}
+
+	apiURL := batchURL(baseURL, c.cfg.BatchPath)
+	requestID := newRequestID()
+	c.log.Info("Sending HTTP POST", "event", "http_request", "method", http.MethodPost, "url", apiURL, "batch_size", len(cmds), "request_id", requestID)
+	return c.send(ctx, http.MethodPost, apiURL, c.breakers.For(batchBreaker), requestIDs{requestID, idempotencyKey}, contentTypeJSON, body, c.cfg.HTTPTimeout)
+}
+
+// sendBatchWithRetry sends cmds with one idempotency key shared by every
+// attempt, and returns the result of the last one with the number of
+// attempts made.
+func (c *Client) sendBatchWithRetry(ctx context.Context, baseURL string, cmds []Command, policy retryPolicy) (Result, error) {
+	key := newRequestID()
+	var res Result
+	attempts := 0
+	err := withRetry(ctx, policy, c.log.With("batch_size", len(cmds)), func() error {
+		var err error
+		attempts++
+		res, err = c.sendBatch(ctx, baseURL, key, cmds)
+		return err
+	})
+	res.Attempts = attempts
+	return res, err
+}
+
+// processBatch sends one batch request per gateway the commands route to.
+func (c *Client) processBatch(ctx context.Context, cmds []Command) {
+	c.startProcessing(len(cmds))
+	var baseURLs []string
+	groups := map[string][]Command{}
+	for _, cmd := range cmds {
+		u := c.live.Load().router.BaseURL(cmd.DeviceID)
+		if _, ok := groups[u]; !ok {
+			baseURLs = append(baseURLs, u)
+		}
+		groups[u] = append(groups[u], cmd)
+	}
+
+	for _, u := range baseURLs {
+		c.processGatewayBatch(ctx, u, groups[u])
+	}
+}
+
+func (c *Client) processGatewayBatch(ctx context.Context, baseURL string, cmds []Command) {
+	res, err := c.sendBatchWithRetry(ctx, baseURL, cmds, c.policy)
+	if err != nil {
+		c.log.Error("Failed to process batch", "event", "batch_failed", "batch_size", len(cmds), "error", err)
+	}
+
+	for _, cmd := range cmds {
+		if err != nil {
+			c.replay.Persist(cmd, err)
+		} else {
+			c.replay.Succeeded(cmd)
+		}
+		// The batch response describes no single device, so it is never
+		// used as a command's state.
+		c.complete(cmd, Result{StatusCode: res.StatusCode, Attempts: res.Attempts}, err)
+	}
+}
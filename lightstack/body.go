@@ -0,0 +1,91 @@
+package lightstack
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+)
+
+// Values for Config.APIBody.
+const (
+	BodyNone = "none"
+	BodyJSON = "json"
+	BodyForm = "form"
+)
+
+const (
+	contentTypeJSON = "application/json"
+	contentTypeForm = "application/x-www-form-urlencoded"
+)
+
+// bodyFieldNames are the command fields that can be sent in a body.
+var bodyFieldNames = []string{"device_id", "mode", "turnOn", "brightness", "color"}
+
+// bodyField is one command field as sent in a request body.
+type bodyField struct {
+	name  string
+	value any
+}
+
+// bodyFields lists cmd's fields under their JSON names, renamed or dropped
+// ("-") per names.
+func bodyFields(cmd Command, names map[string]string) []bodyField {
+	fields := []bodyField{
+		{"device_id", cmd.DeviceID},
+		{"mode", cmd.Mode},
+		{"turnOn", cmd.TurnOn},
+	}
+	if cmd.Brightness != nil {
+		fields = append(fields, bodyField{"brightness", *cmd.Brightness})
+	}
+	if cmd.Color != "" {
+		fields = append(fields, bodyField{"color", cmd.Color})
+	}
+
+	out := fields[:0]
+	for _, f := range fields {
+		if name, ok := names[f.name]; ok {
+			if name == "-" {
+				continue
+			}
+			f.name = name
+		}
+		out = append(out, f)
+	}
+	return out
+}
+
+// encodeBody returns the request body for cmd and its content type. With
+// BodyNone the body is empty and the content type is the JSON one the
+// device API has always been sent. Form bodies spell booleans per
+// boolFormat; JSON bodies always use JSON booleans.
+func encodeBody(encoding string, names map[string]string, boolFormat string, cmd Command) ([]byte, string, error) {
+	switch encoding {
+	case BodyJSON:
+		obj := map[string]any{}
+		for _, f := range bodyFields(cmd, names) {
+			obj[f.name] = f.value
+		}
+		body, err := json.Marshal(obj)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to encode request body: %w", err)
+		}
+		return body, contentTypeJSON, nil
+	case BodyForm:
+		form := url.Values{}
+		for _, f := range bodyFields(cmd, names) {
+			switch v := f.value.(type) {
+			case string:
+				form.Set(f.name, v)
+			case bool:
+				form.Set(f.name, formatBool(boolFormat, v))
+			case int:
+				form.Set(f.name, strconv.Itoa(v))
+			}
+		}
+		return []byte(form.Encode()), contentTypeForm, nil
+	default:
+		return nil, contentTypeJSON, nil
+	}
+}
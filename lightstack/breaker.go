@@ -0,0 +1,210 @@
+package lightstack
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// batchBreaker is the breakers key for batch requests, which carry
+// commands for many devices.
+const batchBreaker = ""
+
+// minBreakerSweep is how many breakers breakers keeps before it first
+// evicts idle ones.
+const minBreakerSweep = 1024
+
+// breakers keeps one breaker per device, so a device that keeps failing
+// does not block requests for the others. Device IDs come from the server,
+// so once sweepAt breakers are kept the idle ones, closed with no
+// failures, are evicted. A nil *breakers allows everything.
+type breakers struct {
+	threshold int
+	cooldown  time.Duration
+	log       *slog.Logger
+	// labelled reports whether a device's state is exported with its ID
+	// as the device label.
+	labelled func(deviceID string) bool
+
+	mu      sync.Mutex
+	m       map[string]*breaker
+	sweepAt int
+}
+
+func newBreakers(threshold int, cooldown time.Duration, logger *slog.Logger, labelled func(string) bool) *breakers {
+	if threshold <= 0 {
+		return nil
+	}
+	return &breakers{threshold: threshold, cooldown: cooldown, log: logger, labelled: labelled, m: make(map[string]*breaker), sweepAt: minBreakerSweep}
+}
+
+// For returns the breaker for deviceID, or batchBreaker.
+func (s *breakers) For(deviceID string) *breaker {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.m[deviceID]
+	if !ok {
+		if len(s.m) >= s.sweepAt {
+			s.sweep()
+		}
+		logger := s.log
+		if deviceID != batchBreaker {
+			logger = logger.With("device_id", deviceID)
+		}
+		b = newBreaker(s.threshold, s.cooldown, logger)
+		if deviceID != batchBreaker && s.labelled(deviceID) {
+			b.gauge = circuitState.WithLabelValues(deviceID)
+			b.gauge.Set(float64(breakerClosed))
+		}
+		s.m[deviceID] = b
+	}
+	return b
+}
+
+// sweep evicts idle breakers, which hold nothing a new one would not, and
+// waits for twice as many breakers as are left before sweeping again. The
+// caller must hold s.mu.
+func (s *breakers) sweep() {
+	for id, b := range s.m {
+		if b.idle() {
+			delete(s.m, id)
+		}
+	}
+	s.sweepAt = max(2*len(s.m), minBreakerSweep)
+}
+
+// breaker fails device API requests fast once threshold consecutive
+// requests have failed. After cooldown it lets a single probe through: if
+// that succeeds the breaker closes again, otherwise it reopens. A nil
+// *breaker allows everything.
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+	log       *slog.Logger
+	now       func() time.Time
+	// gauge exports the state, if the device is labelled in metrics.
+	gauge prometheus.Gauge
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+}
+
+func newBreaker(threshold int, cooldown time.Duration, logger *slog.Logger) *breaker {
+	if threshold <= 0 {
+		return nil
+	}
+	return &breaker{threshold: threshold, cooldown: cooldown, log: logger, now: time.Now}
+}
+
+// idle reports whether the breaker is closed with no failures counted.
+func (b *breaker) idle() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state == breakerClosed && b.failures == 0
+}
+
+// Allow returns ErrCircuitOpen if a request must not be sent.
+func (b *breaker) Allow() error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if b.now().Sub(b.openedAt) < b.cooldown {
+			break
+		}
+		b.setState(breakerHalfOpen)
+		return nil
+	case breakerHalfOpen:
+		// A probe is already in flight.
+	default:
+		return nil
+	}
+	httpShortCircuited.Inc()
+	return ErrCircuitOpen
+}
+
+// Record updates the breaker with the outcome of an allowed request.
+// Network errors and 5xx responses count as failures; any other response
+// shows the device API is reachable. Requests abandoned because ctx was
+// cancelled say nothing about the API and only release a pending probe.
+func (b *breaker) Record(ctx context.Context, err error) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ctx.Err() != nil {
+		if b.state == breakerHalfOpen {
+			b.openedAt = time.Time{}
+			b.setState(breakerOpen)
+		}
+		return
+	}
+
+	if err == nil || !retryable(ctx, err) {
+		b.failures = 0
+		if b.state != breakerClosed {
+			b.setState(breakerClosed)
+		}
+		return
+	}
+
+	b.failures++
+	if b.state == breakerHalfOpen || (b.state == breakerClosed && b.failures >= b.threshold) {
+		b.openedAt = b.now()
+		b.setState(breakerOpen)
+	}
+}
+
+func (b *breaker) setState(state breakerState) {
+	switch {
+	case b.state == breakerClosed && state != breakerClosed:
+		circuitsOpen.Inc()
+	case b.state != breakerClosed && state == breakerClosed:
+		circuitsOpen.Dec()
+	}
+	b.state = state
+	if b.gauge != nil {
+		b.gauge.Set(float64(state))
+	}
+
+	switch state {
+	case breakerOpen:
+		b.log.Warn("Device API circuit breaker opened", "event", "circuit_open", "failures", b.failures, "cooldown", b.cooldown)
+	case breakerHalfOpen:
+		b.log.Info("Device API circuit breaker probing", "event", "circuit_half_open")
+	case breakerClosed:
+		b.log.Info("Device API circuit breaker closed", "event", "circuit_closed")
+	}
+}
@@ -0,0 +1,174 @@
+package lightstack
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestBreaker(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(0, 0)
+	b := newBreaker(2, time.Minute, slog.New(slog.DiscardHandler))
+	b.now = func() time.Time { return now }
+
+	fail := &HTTPStatusError{StatusCode: http.StatusBadGateway}
+	step := func(name string, wantAllowed bool, outcome error) {
+		t.Helper()
+		err := b.Allow()
+		if allowed := err == nil; allowed != wantAllowed {
+			t.Fatalf("%s: Allow() = %v, want allowed=%v", name, err, wantAllowed)
+		}
+		if err != nil {
+			if !errors.Is(err, ErrCircuitOpen) {
+				t.Fatalf("%s: Allow() = %v, want ErrCircuitOpen", name, err)
+			}
+			return
+		}
+		b.Record(ctx, outcome)
+	}
+
+	step("first failure", true, fail)
+	step("4xx resets the count", true, &HTTPStatusError{StatusCode: http.StatusNotFound})
+	step("failure after reset", true, fail)
+	step("threshold reached", true, fail)
+	step("open", false, nil)
+
+	now = now.Add(time.Minute)
+	if err := b.Allow(); err != nil {
+		t.Fatalf("probe after cooldown: Allow() = %v", err)
+	}
+	step("probe in flight", false, nil)
+	b.Record(ctx, fail)
+	step("reopened after failed probe", false, nil)
+
+	now = now.Add(time.Minute)
+	step("second probe", true, nil)
+	step("closed", true, nil)
+	if b.state != breakerClosed {
+		t.Errorf("state = %s, want closed", b.state)
+	}
+}
+
+func TestBreakerSkipsRetries(t *testing.T) {
+	api := newFakeDeviceAPI(t, http.StatusServiceUnavailable)
+
+	cfg := DefaultConfig()
+	cfg.APIBaseURL = api.URL
+	cfg.HTTPRetryBase = time.Millisecond
+	cfg.HTTPRetryMax = time.Millisecond
+	cfg.HTTPMaxAttempts = 5
+	cfg.BreakerThreshold = 2
+	c := newTestClient(t, cfg)
+
+	cmd := Command{DeviceID: "stack-1", Mode: "red", TurnOn: true}
+	_, err := c.sendHTTPRequestWithRetry(context.Background(), cmd, c.policy)
+	if !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("error = %v, want the breaker to open during retries", err)
+	}
+	if got := len(api.Requests()); got != 2 {
+		t.Errorf("device API received %d requests, want 2 before the breaker opened", got)
+	}
+}
+
+func TestBreakersIsolateDevices(t *testing.T) {
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/isolated-1") {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	t.Cleanup(api.Close)
+
+	cfg := DefaultConfig()
+	cfg.APIBaseURL = api.URL
+	cfg.HTTPRetryBase = time.Millisecond
+	cfg.HTTPRetryMax = time.Millisecond
+	cfg.HTTPMaxAttempts = 3
+	cfg.BreakerThreshold = 2
+	cfg.DeviceAllow = []string{"isolated-1", "isolated-2"}
+	c := newTestClient(t, cfg)
+	openBefore := testutil.ToFloat64(circuitsOpen)
+
+	bad := Command{DeviceID: "isolated-1", Mode: "red", TurnOn: true}
+	if _, err := c.sendHTTPRequestWithRetry(context.Background(), bad, c.policy); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("isolated-1 error = %v, want its breaker to open", err)
+	}
+	good := Command{DeviceID: "isolated-2", Mode: "red", TurnOn: true}
+	if _, err := c.sendHTTPRequestWithRetry(context.Background(), good, c.policy); err != nil {
+		t.Errorf("isolated-2 error = %v, want it unaffected by the open breaker of isolated-1", err)
+	}
+
+	if got := testutil.ToFloat64(circuitState.WithLabelValues("isolated-1")); got != float64(breakerOpen) {
+		t.Errorf("isolated-1 breaker state metric = %v, want open", got)
+	}
+	if got := testutil.ToFloat64(circuitState.WithLabelValues("isolated-2")); got != float64(breakerClosed) {
+		t.Errorf("isolated-2 breaker state metric = %v, want closed", got)
+	}
+	if got := testutil.ToFloat64(circuitsOpen) - openBefore; got != 1 {
+		t.Errorf("open breakers went up by %v, want 1", got)
+	}
+}
+
+func TestBreakerReleasesProbe(t *testing.T) {
+	now := time.Unix(0, 0)
+	bs := newBreakers(1, time.Minute, slog.New(slog.DiscardHandler), func(string) bool { return true })
+	b := bs.For("probe-1")
+	b.now = func() time.Time { return now }
+	fail := &HTTPStatusError{StatusCode: http.StatusBadGateway}
+	b.Allow()
+	b.Record(context.Background(), fail)
+
+	// A probe that never gets as far as sending counts as a failed one.
+	c := newTestClient(t, DefaultConfig())
+	now = now.Add(time.Minute)
+	if _, err := c.send(context.Background(), "BAD METHOD", "http://api", b, requestIDs{}, contentTypeJSON, nil, time.Second); err == nil {
+		t.Fatal("send with an invalid method succeeded")
+	}
+	if b.state != breakerOpen {
+		t.Errorf("state after a probe that was never sent = %s, want open", b.state)
+	}
+
+	// A probe abandoned by cancellation reopens the breaker for the next
+	// probe, and the exported state follows.
+	now = now.Add(time.Minute)
+	if err := b.Allow(); err != nil {
+		t.Fatalf("Allow after cooldown = %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	b.Record(ctx, context.Canceled)
+	if got := testutil.ToFloat64(circuitState.WithLabelValues("probe-1")); b.state != breakerOpen || got != float64(breakerOpen) {
+		t.Errorf("state = %s, metric %v after a cancelled probe, want open", b.state, got)
+	}
+	if err := b.Allow(); err != nil {
+		t.Errorf("Allow after a cancelled probe = %v, want another probe", err)
+	}
+}
+
+func TestBreakersEvictIdle(t *testing.T) {
+	ctx := context.Background()
+	bs := newBreakers(3, time.Minute, slog.New(slog.DiscardHandler), func(string) bool { return false })
+	failing := bs.For("failing")
+	failing.Allow()
+	failing.Record(ctx, &HTTPStatusError{StatusCode: http.StatusBadGateway})
+
+	for i := range 3 * minBreakerSweep {
+		b := bs.For("device-" + strconv.Itoa(i))
+		b.Allow()
+		b.Record(ctx, nil)
+	}
+	if len(bs.m) > minBreakerSweep {
+		t.Errorf("kept %d breakers, want idle ones evicted down to at most %d", len(bs.m), minBreakerSweep)
+	}
+	if bs.For("failing") != failing {
+		t.Error("the breaker of a failing device was evicted")
+	}
+}
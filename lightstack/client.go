@@ -0,0 +1,496 @@
+// Package lightstack relays light commands received over a WebSocket
+// connection, or any other CommandSource, to the local device API.
+package lightstack
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const closeGracePeriod = time.Second
+
+// HTTPDoer is the subset of *http.Client used to call the device API.
+type HTTPDoer interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// Dialer opens WebSocket connections. *websocket.Dialer implements it.
+type Dialer interface {
+	DialContext(ctx context.Context, urlStr string, requestHeader http.Header) (*websocket.Conn, *http.Response, error)
+}
+
+// Client receives commands from a CommandSource, by default a WebSocket
+// connection to the command server, and dispatches each one to the device
+// API.
+type Client struct {
+	cfg        Config
+	log        *slog.Logger
+	httpClient HTTPDoer
+	httpSlots  chan struct{}
+	dialer     Dialer
+	source     CommandSource
+	policy     retryPolicy
+	breakers   *breakers
+	live       atomic.Pointer[liveSettings]
+	reloadMu   sync.Mutex
+	apiPath    *template.Template
+	groups     map[string][]string
+	dedup      *deduper
+	settle     *settler
+	coalesce   *coalescer
+	replay     *replayer
+	shadow     *shadow
+	webhook    *webhook
+	recorder   *recorder
+	sink       Sink
+	closeSink  func()
+	tracer     trace.Tracer
+	header     http.Header
+	events     chan StateEvent
+	inbox      chan Command
+	running    atomic.Bool
+	seq        atomic.Uint64
+	acked      *ackTracker
+	clock      reconnectClock
+	drain      *drainState
+	stats      *clientStats
+}
+
+// New validates cfg and returns a Client ready to Run.
+func New(cfg Config) (*Client, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	if cfg.UserAgent == "" {
+		cfg.UserAgent = DefaultUserAgent()
+	}
+
+	c := &Client{
+		cfg:        cfg,
+		log:        cfg.Logger,
+		httpClient: cfg.HTTPDoer,
+		dialer:     cfg.Dialer,
+		source:     cfg.Source,
+		policy:     newRetryPolicy(cfg),
+		dedup:      newDeduper(cfg.DedupWindow),
+		settle:     newSettler(cfg.ModeSettleTimes),
+		header:     wsHeader(cfg),
+		events:     make(chan StateEvent, eventBufferSize),
+		inbox:      make(chan Command),
+		acked:      newAckTracker(),
+		drain:      newDrainState(),
+		stats:      newClientStats(),
+		clock:      realClock,
+	}
+	if c.log == nil {
+		c.log = slog.Default()
+	}
+	// Numbering commands from the start time keeps Seq increasing across
+	// restarts.
+	c.seq.Store(uint64(time.Now().UnixMicro()))
+	if cfg.TracerProvider != nil {
+		c.tracer = cfg.TracerProvider.Tracer(tracerName, trace.WithInstrumentationVersion(Version))
+	}
+	if cfg.CoalesceInFlight {
+		c.coalesce = newCoalescer()
+	}
+	if cfg.ShadowAPIBaseURL != "" && !cfg.DryRun {
+		c.shadow = newShadow(c, cfg.ShadowAPIBaseURL, cfg.Workers)
+	}
+	c.breakers = newBreakers(cfg.BreakerThreshold, cfg.BreakerCooldown, c.log, c.labelledInMetrics)
+	if cfg.HTTPMaxInFlight > 0 {
+		c.httpSlots = make(chan struct{}, cfg.HTTPMaxInFlight)
+	}
+	if c.httpClient == nil {
+		hc, err := newHTTPClient(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to configure device API TLS: %w", err)
+		}
+		c.httpClient = hc
+	}
+	if c.dialer == nil {
+		d, err := newWSDialer(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to configure WebSocket TLS: %w", err)
+		}
+		if cfg.WSInsecureSkipVerify {
+			c.log.Warn("TLS certificate verification for the WebSocket server is DISABLED; never use this in production", "event", "ws_tls_insecure")
+		}
+		c.log.Info("WebSocket dial timeouts", "event", "ws_dial_config", "connect_timeout", cfg.WSConnectTimeout, "handshake_timeout", d.HandshakeTimeout, "read_buffer_size", d.ReadBufferSize, "write_buffer_size", d.WriteBufferSize)
+		c.dialer = d
+	}
+	logProxy(cfg, c.log)
+	if c.source == nil && cfg.ReplayPath != "" {
+		c.source = newFileSource(c, cfg.ReplayPath, cfg.ReplayTiming)
+	}
+	subs := cfg.Subscriptions
+	if c.source == nil && subs == nil && cfg.SubscriptionsPath != "" {
+		var err error
+		if subs, err = LoadSubscriptions(cfg.SubscriptionsPath); err != nil {
+			return nil, fmt.Errorf("failed to load subscriptions: %w", err)
+		}
+	}
+	if c.source == nil && len(subs) > 0 {
+		c.source = newMultiSource(c, subs)
+	}
+	if c.source == nil {
+		c.source = newWSSource(c)
+	}
+
+	live, err := newLiveSettings(cfg)
+	if err != nil {
+		return nil, err
+	}
+	c.live.Store(live)
+
+	c.groups = cfg.DeviceGroups
+	if c.groups == nil && cfg.DeviceGroupsPath != "" {
+		if c.groups, err = LoadDeviceGroups(cfg.DeviceGroupsPath); err != nil {
+			return nil, fmt.Errorf("failed to load device groups: %w", err)
+		}
+	}
+
+	apiPath := cfg.APIPath
+	if apiPath == "" {
+		apiPath = DefaultAPIPath
+	}
+	if c.apiPath, err = parseAPIPath(apiPath); err != nil {
+		return nil, err
+	}
+
+	if cfg.RecordPath != "" {
+		r, err := openRecorder(cfg.RecordPath, int64(cfg.RecordMaxSize), c.log)
+		if err != nil {
+			return nil, err
+		}
+		c.recorder = r
+	}
+
+	if cfg.WebhookURL != "" {
+		c.webhook = newWebhook(cfg.WebhookURL, cfg.WebhookTimeout, c.log)
+	}
+
+	queue := cfg.Queue
+	if queue == nil && cfg.QueuePath != "" {
+		fq, err := openFileQueue(cfg.QueuePath, cfg.QueueMaxSize, c.log)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open command queue: %w", err)
+		}
+		queue = fq
+	}
+	if queue != nil {
+		c.replay = newReplayer(c, queue, cfg.QueueReplay)
+	}
+
+	// The NATS connection is opened last so that nothing above can fail
+	// and leak it.
+	switch {
+	case cfg.Sink != nil:
+		c.sink = cfg.Sink
+	case cfg.Executor != nil:
+		c.sink = executorSink{exec: cfg.Executor}
+	case cfg.ExecCommand != "":
+		c.sink = executorSink{exec: &ExecExecutor{Path: cfg.ExecCommand, Timeout: cfg.HTTPTimeout, DryRun: cfg.DryRun, Logger: c.log}}
+	case cfg.NATSURL != "":
+		ns, err := newNATSSink(cfg, c.log)
+		if err != nil {
+			return nil, err
+		}
+		c.sink, c.closeSink = ns, ns.Close
+	default:
+		c.sink = httpSink{client: c}
+	}
+	return c, nil
+}
+
+// Connected reports whether the command source is currently connected. For
+// sources that do not report this, it is true while Run is active.
+func (c *Client) Connected() bool {
+	if s, ok := c.source.(interface{ Connected() bool }); ok {
+		return s.Connected()
+	}
+	return c.running.Load()
+}
+
+// Run receives commands from the source and processes them until ctx is
+// cancelled or Drain is called. The default WebSocket source reconnects with
+// backoff whenever the connection fails. Run returns once the source and
+// in-flight commands have finished, or with the source's error if it fails.
+func (c *Client) Run(ctx context.Context) error {
+	if err := c.preflight(ctx); err != nil {
+		return err
+	}
+
+	c.running.Store(true)
+	defer c.running.Store(false)
+	if c.closeSink != nil {
+		defer c.closeSink()
+	}
+
+	go c.replay.Run(ctx)
+	// Every return below has closed the pool first, so no outcomes are
+	// left to notify by the time the webhook is closed.
+	webhookDone := make(chan struct{})
+	go func() {
+		defer close(webhookDone)
+		c.webhook.Run(ctx)
+	}()
+	defer func() {
+		c.webhook.Close()
+		<-webhookDone
+	}()
+
+	// In-flight commands and the source get separate contexts so that a
+	// drain can stop the source, which also carries the acks, only after
+	// the workers have finished. With
+	// a shutdown flush, the workers also outlive ctx until the flush ends.
+	workParent := ctx
+	if c.replay != nil && c.cfg.QueueFlushTimeout > 0 {
+		workParent = context.WithoutCancel(ctx)
+	}
+	workCtx, cancelWork := context.WithCancel(workParent)
+	defer cancelWork()
+	srcCtx, stopSource := context.WithCancel(ctx)
+	defer stopSource()
+
+	pool := c.newDispatcher(workCtx)
+
+	errc := make(chan error, 1)
+	go func() { errc <- c.source.Run(srcCtx, c.inbox) }()
+
+	for {
+		select {
+		case cmd := <-c.inbox:
+			c.dispatch(workCtx, pool, cmd)
+		case <-c.drain.requested:
+			return c.runDrain(pool, cancelWork, stopSource, errc)
+		case err := <-errc:
+			if ctx.Err() != nil && workParent != ctx {
+				c.flushOnShutdown(workCtx, pool, cancelWork)
+			} else {
+				pool.Close()
+			}
+			return err
+		}
+	}
+}
+
+// Submit feeds cmd into the same pipeline as commands from the source,
+// including validation, dedup, retries and acks. It blocks until Run accepts
+// the command or ctx is done.
+func (c *Client) Submit(ctx context.Context, cmd Command) error {
+	select {
+	case c.inbox <- cmd:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// dispatch validates and deduplicates cmd, then hands it to pool.
+func (c *Client) dispatch(ctx context.Context, pool dispatcher, cmd Command) {
+	if isGroupTarget(cmd.DeviceID) {
+		c.dispatchGroup(ctx, pool, cmd)
+		return
+	}
+	commandsReceived.Inc()
+	c.stats.received.Add(1)
+	received := time.Now()
+	if cmd.RequestID == "" {
+		cmd.RequestID = newRequestID()
+	}
+	// The record keeps the request ID for matching entries to logs and acks,
+	// but not a generated idempotency key: a replay of the file must not be
+	// mistaken by the device API for a repeat of the original command.
+	c.recorder.Record(cmd, received)
+	if cmd.IdempotencyKey == "" {
+		cmd.IdempotencyKey = newRequestID()
+	}
+	cmd = c.startCommandSpan(ctx, cmd)
+	logger := c.log.With(commandAttrs(cmd)...)
+	logger.Info("Received command", "event", "command_received")
+
+	if len(c.cfg.Transforms) > 0 {
+		var err error
+		if cmd, err = applyTransforms(c.cfg.Transforms, cmd); err != nil {
+			logger.Warn("Skipping command rejected by a transform", "event", "command_rejected", "error", err)
+			c.stats.skipped.Add(1)
+			endCommandSpan(cmd, "rejected", err)
+			return
+		}
+		logger = c.log.With(commandAttrs(cmd)...)
+	}
+	if err := cmd.Validate(c.cfg.AllowedModes); err != nil {
+		logger.Warn("Skipping invalid command", "event", "command_invalid", "error", err)
+		c.stats.skipped.Add(1)
+		endCommandSpan(cmd, "invalid", err)
+		return
+	}
+	if !c.live.Load().filter.Permits(cmd.DeviceID) || !cmd.origin.Permits(cmd.DeviceID) {
+		commandsFiltered.Inc()
+		logger.Debug("Ignoring command for filtered device", "event", "command_filtered")
+		c.stats.skipped.Add(1)
+		endCommandSpan(cmd, "filtered", nil)
+		return
+	}
+	cmd = cmd.forModes(c.cfg.ExtendedModes)
+	cmd = cmd.withModePriority(c.cfg.ModePriorities)
+
+	if c.dedup.Duplicate(cmd) {
+		commandsDeduplicated.Inc()
+		logger.Info("Dropping duplicate command", "event", "command_duplicate", "window", c.cfg.DedupWindow)
+		c.stats.skipped.Add(1)
+		endCommandSpan(cmd, "duplicate", nil)
+		return
+	}
+
+	cmd.receivedAt = received
+	cmd.seq = c.seq.Add(1)
+	commandsQueued.Inc()
+	c.stats.queued.Add(1)
+	if err := pool.Submit(ctx, cmd); err != nil {
+		commandsQueued.Dec()
+		c.stats.queued.Add(-1)
+		c.stats.skipped.Add(1)
+		logger.Warn("Dropping command, client is shutting down", "event", "command_dropped", "error", err)
+		endCommandSpan(cmd, "dropped", err)
+	}
+}
+
+func (c *Client) newDispatcher(ctx context.Context) dispatcher {
+	if c.cfg.BatchWindow > 0 {
+		return newBatcher(c.cfg.BatchWindow, c.cfg.BatchMaxSize, c.cfg.WorkerQueueSize, func(cmds []Command) {
+			c.processBatch(ctx, cmds)
+		})
+	}
+	var wait func(string) time.Duration
+	if c.settle != nil {
+		// Once ctx is cancelled, waiting commands are let through to fail
+		// rather than held back.
+		wait = func(deviceID string) time.Duration {
+			if ctx.Err() != nil {
+				return 0
+			}
+			return c.settle.Wait(deviceID, time.Now())
+		}
+	}
+	pool := newWorkerPool(c.cfg.Workers, c.cfg.WorkerQueueSize, wait, func(cmd Command) {
+		c.processCommand(ctx, cmd)
+	})
+	if wait != nil {
+		context.AfterFunc(ctx, pool.Wake)
+	}
+	return pool
+}
+
+func (c *Client) processCommand(ctx context.Context, cmd Command) {
+	logger := c.log.With(commandAttrs(cmd)...)
+	c.startProcessing(1)
+
+	res, err := c.sendHTTPRequestWithRetry(commandContext(ctx, cmd), cmd, c.policy)
+	c.shadow.Mirror(ctx, cmd, res, err)
+	if err != nil {
+		logger.Error("Failed to process command", "event", "command_failed", "error", err)
+		c.replay.Persist(cmd, err)
+	} else {
+		c.settle.Succeeded(cmd, time.Now())
+		c.replay.Succeeded(cmd)
+	}
+
+	c.complete(cmd, res, err)
+}
+
+// complete reports the outcome of cmd back to the source and the webhook.
+func (c *Client) complete(cmd Command, res Result, err error) {
+	ack := newAck(cmd, res, err)
+	ack.Attempts = res.Attempts
+	if c.cfg.AckState {
+		ack.State = res.State
+	}
+	c.sendAck(cmd, ack)
+	c.webhook.Notify(cmd, ack)
+	c.drain.Record(err)
+	commandsInFlight.Dec()
+	c.stats.inFlight.Add(-1)
+	if err != nil {
+		c.stats.failed.Add(1)
+	} else {
+		c.stats.succeeded.Add(1)
+	}
+	if !cmd.receivedAt.IsZero() {
+		commandLatency.Observe(time.Since(cmd.receivedAt).Seconds())
+	}
+	endCommandSpan(cmd, ack.Outcome, err)
+}
+
+// sendAck numbers ack with cmd's sequence number and writes it to the
+// source cmd came from, unless acks are turned off or a newer command for
+// the device has been acked already.
+func (c *Client) sendAck(cmd Command, ack Ack) {
+	ack.Seq = cmd.seq
+	if ack.Seq == 0 {
+		ack.Seq = c.seq.Add(1)
+	}
+	var src CommandSource = c.source
+	if cmd.origin != nil {
+		src = cmd.origin
+	}
+	if !c.acked.Advance(cmd.DeviceID, ack.Seq) {
+		c.log.Info("Not acking command completed after a newer one", append(commandAttrs(cmd), "event", "ack_stale", "outcome", ack.Outcome, "seq", ack.Seq)...)
+	} else if !c.cfg.SendAcks {
+		c.log.Debug("Not acking command", append(commandAttrs(cmd), "event", "ack_disabled", "outcome", ack.Outcome)...)
+	} else if err := src.Ack(ack); err != nil {
+		c.log.Warn("Failed to write ack", append(commandAttrs(cmd), "event", "ack_failed", "error", err)...)
+	}
+}
+
+func sleepContext(ctx context.Context, d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+	case <-t.C:
+	}
+}
+
+// wsHeader builds the handshake headers for the WebSocket dial.
+func wsHeader(cfg Config) http.Header {
+	h := cfg.WSHeaders.Clone()
+	if h == nil {
+		h = http.Header{}
+	}
+	if cfg.WSToken != "" {
+		h.Set("Authorization", "Bearer "+cfg.WSToken)
+	}
+	if h.Get("User-Agent") == "" && cfg.UserAgent != "" {
+		h.Set("User-Agent", cfg.UserAgent)
+	}
+	return h
+}
+
+// redactURL hides credentials embedded in a URL so it can be logged.
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "<invalid url>"
+	}
+	if u.RawQuery != "" {
+		q := u.Query()
+		for k := range q {
+			q.Set(k, "xxxxx")
+		}
+		u.RawQuery = q.Encode()
+	}
+	return u.Redacted()
+}
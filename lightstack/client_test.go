@@ -0,0 +1,2054 @@
+package lightstack
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+type wsFrame struct {
+	messageType int
+	data        []byte
+}
+
+// fakeWSServer plays one script of frames per accepted connection, in order,
+// and records everything the client writes back.
+type fakeWSServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	scripts  [][]wsFrame
+	compress bool
+	down     bool
+	// retryAfter is sent as the Retry-After header while down.
+	retryAfter string
+	conns      int
+	received   []string
+}
+
+// newFakeWSServer plays each script as text frames.
+func newFakeWSServer(t *testing.T, scripts ...[]string) *fakeWSServer {
+	t.Helper()
+
+	frames := make([][]wsFrame, len(scripts))
+	for i, script := range scripts {
+		for _, msg := range script {
+			frames[i] = append(frames[i], wsFrame{websocket.TextMessage, []byte(msg)})
+		}
+	}
+	return newFakeWSServerFrames(t, frames...)
+}
+
+func newFakeWSServerFrames(t *testing.T, scripts ...[]wsFrame) *fakeWSServer {
+	t.Helper()
+
+	s := &fakeWSServer{scripts: scripts}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		upgrader := websocket.Upgrader{EnableCompression: s.compress}
+		down, retryAfter := s.down, s.retryAfter
+		s.mu.Unlock()
+		if down {
+			if retryAfter != "" {
+				w.Header().Set("Retry-After", retryAfter)
+			}
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		s.mu.Lock()
+		var script []wsFrame
+		if s.conns < len(s.scripts) {
+			script = s.scripts[s.conns]
+		}
+		s.conns++
+		s.mu.Unlock()
+
+		for _, frame := range script {
+			if err := conn.WriteMessage(frame.messageType, frame.data); err != nil {
+				return
+			}
+		}
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.received = append(s.received, string(data))
+			s.mu.Unlock()
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *fakeWSServer) wsURL() string {
+	return "ws" + strings.TrimPrefix(s.URL, "http")
+}
+
+func (s *fakeWSServer) Received() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.received...)
+}
+
+// EnableCompression makes the server accept permessage-deflate on later
+// connections.
+func (s *fakeWSServer) EnableCompression() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.compress = true
+}
+
+// SetDown makes the server refuse handshakes with 503 while down is true.
+func (s *fakeWSServer) SetDown(down bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.down = down
+}
+
+func (s *fakeWSServer) Connections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conns
+}
+
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func testConfig(ws *fakeWSServer, api *fakeDeviceAPI) Config {
+	cfg := DefaultConfig()
+	cfg.WSURL = ws.wsURL()
+	cfg.APIBaseURL = api.URL
+	cfg.BackoffBase = time.Millisecond
+	cfg.BackoffMax = 10 * time.Millisecond
+	return cfg
+}
+
+// runClient starts c in the background and returns a function that stops it
+// and waits for Run to return.
+func runClient(t *testing.T, c *Client) (stop func()) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() { errc <- c.Run(ctx) }()
+
+	return func() {
+		cancel()
+		select {
+		case err := <-errc:
+			if err != nil {
+				t.Errorf("Run: %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Run did not return after cancel")
+		}
+	}
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestClientDispatchesCommands(t *testing.T) {
+	ws := newFakeWSServer(t, []string{
+		`{"device_id":"stack-1","mode":"red","turnOn":true}`,
+		`{"device_id":"stack-2","mode":"green","turnOn":false}`,
+		`{"device_id":"stack-1","mode":"red","turnOn":false}`,
+	})
+	api := newFakeDeviceAPI(t, http.StatusOK)
+
+	cfg := testConfig(ws, api)
+	cfg.Logger = slog.New(slog.DiscardHandler)
+	c, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	stop := runClient(t, c)
+	waitFor(t, "3 device API requests", func() bool { return len(api.Requests()) == 3 })
+	waitFor(t, "3 acks", func() bool { return len(ws.Received()) == 3 })
+	stop()
+
+	for _, ack := range ws.Received() {
+		if !strings.Contains(ack, `"outcome":"success"`) {
+			t.Errorf("ack = %s, want a success outcome", ack)
+		}
+	}
+
+	want := map[string]int{
+		"/api/device/gpo/light/stack-1?mode=red&turnOn=true":    1,
+		"/api/device/gpo/light/stack-2?mode=green&turnOn=false": 1,
+		"/api/device/gpo/light/stack-1?mode=red&turnOn=false":   1,
+	}
+	var stack1 []string
+	for _, req := range api.Requests() {
+		if req.Method != http.MethodPost {
+			t.Errorf("method = %s, want POST", req.Method)
+		}
+		got := req.Path + "?" + req.Query.Encode()
+		want[got]--
+		if strings.HasSuffix(req.Path, "/stack-1") {
+			stack1 = append(stack1, req.Query.Get("turnOn"))
+		}
+	}
+	for path, n := range want {
+		if n != 0 {
+			t.Errorf("request %s: count off by %d", path, -n)
+		}
+	}
+	if strings.Join(stack1, ",") != "true,false" {
+		t.Errorf("stack-1 commands arrived as %v, want [true false]", stack1)
+	}
+}
+
+func TestClientBatchesCommands(t *testing.T) {
+	ws := newFakeWSServer(t, []string{
+		`{"device_id":"stack-1","mode":"red","turnOn":true}`,
+		`{"device_id":"stack-2","mode":"green","turnOn":false}`,
+		`{"device_id":"stack-3","mode":"red","turnOn":true}`,
+	})
+	api := newFakeDeviceAPI(t, http.StatusOK)
+
+	cfg := testConfig(ws, api)
+	cfg.Logger = slog.New(slog.DiscardHandler)
+	cfg.BatchWindow = time.Second
+	cfg.BatchMaxSize = 3
+	c, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	stop := runClient(t, c)
+	waitFor(t, "3 acks", func() bool { return len(ws.Received()) == 3 })
+	stop()
+
+	reqs := api.Requests()
+	if len(reqs) != 1 {
+		t.Fatalf("got %d requests, want a single batch", len(reqs))
+	}
+	if reqs[0].Path != "/api/device/gpo/light/batch" {
+		t.Errorf("path = %s, want the batch endpoint", reqs[0].Path)
+	}
+	var got []Command
+	if err := json.Unmarshal(reqs[0].Body, &got); err != nil {
+		t.Fatalf("batch body %q: %v", reqs[0].Body, err)
+	}
+	var ids []string
+	for _, cmd := range got {
+		ids = append(ids, cmd.DeviceID)
+	}
+	if strings.Join(ids, ",") != "stack-1,stack-2,stack-3" {
+		t.Errorf("batch devices = %v, want stack-1, stack-2, stack-3 in order", ids)
+	}
+}
+
+func TestClientBatchPathAndAcks(t *testing.T) {
+	var mu sync.Mutex
+	var paths []string
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		paths = append(paths, r.URL.Path)
+		if len(paths) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	t.Cleanup(api.Close)
+	src := &chanSource{cmds: []Command{
+		{DeviceID: "stack-1", Mode: "red", TurnOn: true},
+		{DeviceID: "stack-2", Mode: "green", TurnOn: false},
+	}}
+
+	cfg := DefaultConfig()
+	cfg.APIBaseURL = api.URL
+	cfg.Source = src
+	cfg.APIPath = "/v2/lights/{{.DeviceID}}"
+	cfg.BatchPath = "/v2/lights/batch"
+	cfg.BatchWindow = time.Second
+	cfg.BatchMaxSize = 2
+	cfg.HTTPRetryBase = time.Millisecond
+	c := newTestClient(t, cfg)
+
+	stop := runClient(t, c)
+	waitFor(t, "2 acks", func() bool { return len(src.Acks()) == 2 })
+	stop()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if !slices.Equal(paths, []string{"/v2/lights/batch", "/v2/lights/batch"}) {
+		t.Errorf("paths = %v, want the batch path twice", paths)
+	}
+	for _, ack := range src.Acks() {
+		if ack.Outcome != ackOutcomeSuccess || ack.StatusCode != http.StatusAccepted || ack.Attempts != 2 {
+			t.Errorf("ack = %+v, want success with status 202 after 2 attempts", ack)
+		}
+	}
+
+	cfg.BatchPath = "batch"
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "batch-path") {
+		t.Errorf("Validate with a relative batch path: error = %v", err)
+	}
+}
+
+func TestClientSendsHelloMessage(t *testing.T) {
+	hello := `{"type":"hello","groups":["dock"]}`
+	ws := newFakeWSServer(t, []string{`{"device_id":"stack-1","mode":"red","turnOn":true}`})
+	api := newFakeDeviceAPI(t, http.StatusOK)
+
+	cfg := testConfig(ws, api)
+	cfg.HelloMessage = hello
+	c := newTestClient(t, cfg)
+
+	stop := runClient(t, c)
+	waitFor(t, "the hello and the ack", func() bool { return len(ws.Received()) == 2 })
+	stop()
+
+	if got, want := ws.Received()[0], `{"type":"hello","groups":["dock"],"schema_versions":[1]}`; got != want {
+		t.Errorf("first message = %s, want the hello message with the schema versions, %s", got, want)
+	}
+
+	cfg.HelloMessage = "hello"
+	if _, err := New(cfg); err == nil {
+		t.Error("New accepted a hello message that is not JSON")
+	}
+}
+
+func TestClientWithoutAcks(t *testing.T) {
+	hello := `{"type":"hello"}`
+	ws := newFakeWSServer(t, []string{`{"device_id":"stack-1","mode":"red","turnOn":true}`})
+	api := newFakeDeviceAPI(t, http.StatusOK)
+
+	cfg := testConfig(ws, api)
+	cfg.HelloMessage = hello
+	cfg.AdvertiseVersions = false
+	cfg.SendAcks = false
+	c := newTestClient(t, cfg)
+
+	stop := runClient(t, c)
+	waitFor(t, "the device API request", func() bool { return len(api.Requests()) == 1 })
+	waitFor(t, "the command to complete", func() bool { return c.Stats().CommandsSucceeded == 1 })
+	stop()
+
+	if got := ws.Received(); len(got) != 1 || got[0] != hello {
+		t.Errorf("server received %q, want only the hello message as configured", got)
+	}
+
+	cfg.AckState = true
+	if _, err := New(cfg); err == nil {
+		t.Error("New accepted ack-state with acks off")
+	}
+}
+
+func TestClientSendsWSToken(t *testing.T) {
+	const token = "s3cret-token"
+	var mu sync.Mutex
+	var auth []string
+	ws := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		auth = append(auth, r.Header.Get("Authorization"))
+		first := len(auth) == 1
+		mu.Unlock()
+		// Reject the first dial so the failure is logged too.
+		if first {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.WriteMessage(websocket.TextMessage, []byte(`{"device_id":"stack-1","mode":"red","turnOn":true}`))
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(ws.Close)
+	api := newFakeDeviceAPI(t, http.StatusOK)
+
+	var logs syncBuffer
+	cfg := DefaultConfig()
+	cfg.WSURL = "ws" + strings.TrimPrefix(ws.URL, "http")
+	cfg.APIBaseURL = api.URL
+	cfg.BackoffBase = time.Millisecond
+	cfg.BackoffMax = 10 * time.Millisecond
+	cfg.WSToken = token
+	cfg.Logger = slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	c, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	stop := runClient(t, c)
+	waitFor(t, "the command", func() bool { return len(api.Requests()) == 1 })
+	stop()
+
+	mu.Lock()
+	defer mu.Unlock()
+	for i, got := range auth {
+		if got != "Bearer "+token {
+			t.Errorf("dial %d Authorization = %q, want the bearer token", i+1, got)
+		}
+	}
+	if out := logs.String(); !strings.Contains(out, "event=ws_connect_failed") || strings.Contains(out, token) {
+		t.Errorf("logs should record the failed dial without the token:\n%s", out)
+	}
+}
+
+func TestClientCompression(t *testing.T) {
+	for _, serverSupport := range []bool{true, false} {
+		t.Run("server support "+strconv.FormatBool(serverSupport), func(t *testing.T) {
+			hello := `{"type":"hello","padding":"` + strings.Repeat("a", 512) + `"}`
+			ws := newFakeWSServer(t, []string{`{"device_id":"stack-1","mode":"red","turnOn":true}`})
+			if serverSupport {
+				ws.EnableCompression()
+			}
+			api := newFakeDeviceAPI(t, http.StatusOK)
+
+			var logs syncBuffer
+			cfg := testConfig(ws, api)
+			cfg.Logger = slog.New(slog.NewTextHandler(&logs, nil))
+			cfg.HelloMessage = hello
+			cfg.WSCompression = true
+			cfg.WSCompressionLevel = 9
+			c, err := New(cfg)
+			if err != nil {
+				t.Fatalf("New: %v", err)
+			}
+
+			stop := runClient(t, c)
+			waitFor(t, "the hello and the ack", func() bool { return len(ws.Received()) == 2 })
+			stop()
+
+			if got := ws.Received(); got[0] != helloWithSchemaVersions(hello) || !strings.Contains(got[1], `"outcome":"success"`) {
+				t.Errorf("server received %v, want the hello and a success ack", got)
+			}
+			want := "negotiated=" + strconv.FormatBool(serverSupport)
+			if !strings.Contains(logs.String(), "event=ws_compression "+want) {
+				t.Errorf("logs do not report %s:\n%s", want, logs.String())
+			}
+		})
+	}
+
+	cfg := DefaultConfig()
+	cfg.WSCompressionLevel = 10
+	if _, err := New(cfg); err == nil || !strings.Contains(err.Error(), "ws-compression-level") {
+		t.Errorf("New with compression level 10: error = %v", err)
+	}
+}
+
+func TestClientSkipsMalformedMessages(t *testing.T) {
+	ws := newFakeWSServer(t, []string{
+		`{"device_id":`,
+		"garbage " + strings.Repeat("x", 2*maxLoggedPayload),
+		`{"device_id":"stack-1","mode":"red","turnOn":true}`,
+	})
+	api := newFakeDeviceAPI(t, http.StatusOK)
+
+	var logs syncBuffer
+	cfg := testConfig(ws, api)
+	cfg.Logger = slog.New(slog.NewTextHandler(&logs, nil))
+	c, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	stop := runClient(t, c)
+	waitFor(t, "a device API request", func() bool { return len(api.Requests()) == 1 })
+	stop()
+
+	if got := ws.Connections(); got != 1 {
+		t.Errorf("client connected %d times, want the malformed message skipped without reconnecting", got)
+	}
+	out := logs.String()
+	if strings.Count(out, "event=command_malformed") != 2 {
+		t.Errorf("malformed messages were not both logged; logs:\n%s", out)
+	}
+	if !strings.Contains(out, `payload="{\"device_id\":"`) {
+		t.Errorf("malformed payload not logged; logs:\n%s", out)
+	}
+	if strings.Contains(out, strings.Repeat("x", maxLoggedPayload)) || !strings.Contains(out, "...(truncated)") {
+		t.Errorf("long payload not truncated in the logs:\n%s", out)
+	}
+}
+
+func TestClientDecodesBinaryFrames(t *testing.T) {
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte(`{"device_id":"stack-2","mode":"green","turnOn":true}`))
+	zw.Close()
+
+	ws := newFakeWSServerFrames(t, []wsFrame{
+		{websocket.BinaryMessage, []byte(`{"device_id":"stack-1","mode":"red","turnOn":true}`)},
+		{websocket.BinaryMessage, gz.Bytes()},
+	})
+	api := newFakeDeviceAPI(t, http.StatusOK)
+
+	cfg := testConfig(ws, api)
+	cfg.Logger = slog.New(slog.DiscardHandler)
+	c, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	stop := runClient(t, c)
+	waitFor(t, "2 device API requests", func() bool { return len(api.Requests()) == 2 })
+	stop()
+
+	paths := map[string]bool{}
+	for _, req := range api.Requests() {
+		paths[req.Path] = true
+	}
+	for _, want := range []string{"/api/device/gpo/light/stack-1", "/api/device/gpo/light/stack-2"} {
+		if !paths[want] {
+			t.Errorf("no request to %s; got %v", want, paths)
+		}
+	}
+}
+
+func TestDecodeCommands(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		devices []string
+		wantErr bool
+	}{
+		{"object", `{"device_id":"stack-1","mode":"red"}`, []string{"stack-1"}, false},
+		{"array", ` [{"device_id":"stack-1","mode":"red"},{"device_id":"stack-2","mode":"green"}]`, []string{"stack-1", "stack-2"}, false},
+		{"empty array", `[]`, nil, false},
+		{"invalid element", `[{"device_id":"stack-1","mode":"red"},"off",{"device_id":"stack-3","turnOn":"yes"},{"device_id":"stack-4","mode":"red"}]`, []string{"stack-1", "stack-4"}, true},
+		{"truncated array", `[{"device_id":"stack-1","mode":"red"}`, nil, true},
+		{"truncated object", `{"device_id":`, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmds, err := decodeCommands(websocket.TextMessage, []byte(tt.data), defaultMaxMessageSize)
+			var devices []string
+			for _, cmd := range cmds {
+				devices = append(devices, cmd.DeviceID)
+			}
+			if !slices.Equal(devices, tt.devices) || (err != nil) != tt.wantErr {
+				t.Errorf("decodeCommands = %v, %v; want %v, error %t", devices, err, tt.devices, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestClientDispatchesCommandArrays(t *testing.T) {
+	ws := newFakeWSServer(t, []string{
+		`[{"device_id":"stack-1","mode":"red","turnOn":true},{"device_id":"stack-1","mode":"green","turnOn":true},{"mode":1},{"device_id":"stack-1","mode":"red","turnOn":false}]`,
+		`{"device_id":"stack-2","mode":"red","turnOn":true}`,
+	})
+	api := newFakeDeviceAPI(t, http.StatusOK)
+
+	var logs syncBuffer
+	cfg := testConfig(ws, api)
+	cfg.Logger = slog.New(slog.NewTextHandler(&logs, nil))
+	cfg.Workers = 1
+	c, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	stop := runClient(t, c)
+	waitFor(t, "4 device API requests", func() bool { return len(api.Requests()) == 4 })
+	stop()
+
+	var got []string
+	for _, req := range api.Requests() {
+		got = append(got, req.Path+"?"+req.Query.Encode())
+	}
+	want := []string{
+		"/api/device/gpo/light/stack-1?mode=red&turnOn=true",
+		"/api/device/gpo/light/stack-1?mode=green&turnOn=true",
+		"/api/device/gpo/light/stack-1?mode=red&turnOn=false",
+		"/api/device/gpo/light/stack-2?mode=red&turnOn=true",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("requests =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if out := logs.String(); !strings.Contains(out, "event=command_malformed") || !strings.Contains(out, "index 2") {
+		t.Errorf("invalid array element not logged; logs:\n%s", out)
+	}
+}
+
+// chanSource delivers a fixed list of commands and records the acks.
+type chanSource struct {
+	cmds []Command
+
+	mu   sync.Mutex
+	acks []Ack
+}
+
+func (s *chanSource) Run(ctx context.Context, out chan<- Command) error {
+	for _, cmd := range s.cmds {
+		select {
+		case out <- cmd:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+	<-ctx.Done()
+	return nil
+}
+
+func (s *chanSource) Ack(ack Ack) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.acks = append(s.acks, ack)
+	return nil
+}
+
+func (s *chanSource) Acks() []Ack {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Ack(nil), s.acks...)
+}
+
+func TestClientCustomSource(t *testing.T) {
+	src := &chanSource{cmds: []Command{
+		{DeviceID: "stack-1", Mode: "red", TurnOn: true},
+		{DeviceID: "stack-2"},
+	}}
+	api := newFakeDeviceAPI(t, http.StatusOK)
+
+	cfg := DefaultConfig()
+	cfg.WSURL = ""
+	cfg.APIBaseURL = api.URL
+	cfg.Source = src
+	c := newTestClient(t, cfg)
+
+	stop := runClient(t, c)
+	waitFor(t, "an ack", func() bool { return len(src.Acks()) == 1 })
+	if !c.Connected() {
+		t.Error("Connected() = false while running a source that does not report connectivity")
+	}
+	stop()
+
+	if reqs := api.Requests(); len(reqs) != 1 || reqs[0].Path != "/api/device/gpo/light/stack-1" {
+		t.Errorf("requests = %+v, want one for stack-1; the invalid command should be skipped", reqs)
+	}
+	if ack := src.Acks()[0]; ack.DeviceID != "stack-1" || ack.Outcome != ackOutcomeSuccess {
+		t.Errorf("ack = %+v, want success for stack-1", ack)
+	}
+	ack := src.Acks()[0]
+	if ack.RequestID == "" || api.Requests()[0].Header.Get("X-Request-ID") != ack.RequestID {
+		t.Errorf("ack request ID %q does not match the X-Request-ID sent to the device API", ack.RequestID)
+	}
+}
+
+func TestClientReusesIdempotencyKeyAcrossRetries(t *testing.T) {
+	var attempts atomic.Int32
+	var mu sync.Mutex
+	keys := map[string][]string{}
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		keys[r.URL.Path] = append(keys[r.URL.Path], r.Header.Get("Idempotency-Key"))
+		mu.Unlock()
+		if attempts.Add(1)%2 == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	t.Cleanup(api.Close)
+
+	src := &chanSource{cmds: []Command{
+		{DeviceID: "stack-1", Mode: "red", TurnOn: true},
+		{DeviceID: "stack-2", Mode: "red", TurnOn: true, IdempotencyKey: "key-2"},
+	}}
+	cfg := DefaultConfig()
+	cfg.WSURL = ""
+	cfg.APIBaseURL = api.URL
+	cfg.Source = src
+	cfg.Workers = 1
+	cfg.HTTPMaxAttempts = 2
+	cfg.HTTPRetryBase = time.Millisecond
+	c := newTestClient(t, cfg)
+
+	stop := runClient(t, c)
+	waitFor(t, "two acks", func() bool { return len(src.Acks()) == 2 })
+	stop()
+
+	mu.Lock()
+	defer mu.Unlock()
+	k1 := keys["/api/device/gpo/light/stack-1"]
+	if len(k1) != 2 || k1[0] == "" || k1[0] != k1[1] {
+		t.Errorf("stack-1 Idempotency-Key = %q, want the same generated key on both attempts", k1)
+	}
+	if k2 := keys["/api/device/gpo/light/stack-2"]; len(k2) != 2 || k2[0] != "key-2" || k2[1] != "key-2" {
+		t.Errorf("stack-2 Idempotency-Key = %q, want the command's own key on both attempts", k2)
+	}
+}
+
+func TestClientAcksTerminalOutcomeOnce(t *testing.T) {
+	var requests atomic.Int32
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	t.Cleanup(api.Close)
+
+	src := &chanSource{cmds: []Command{
+		{DeviceID: "stack-1", Mode: "red", TurnOn: true},
+		{DeviceID: "stack-1", Mode: "green", TurnOn: true},
+	}}
+	cfg := DefaultConfig()
+	cfg.WSURL = ""
+	cfg.APIBaseURL = api.URL
+	cfg.Source = src
+	cfg.Workers = 1
+	cfg.HTTPRetryBase = time.Millisecond
+	c := newTestClient(t, cfg)
+
+	stop := runClient(t, c)
+	waitFor(t, "two acks", func() bool { return len(src.Acks()) == 2 })
+	stop()
+
+	acks := src.Acks()
+	if len(acks) != 2 {
+		t.Fatalf("got %d acks, want one per command", len(acks))
+	}
+	if acks[0].Outcome != ackOutcomeSuccess || acks[0].Attempts != 2 || acks[1].Attempts != 1 {
+		t.Errorf("acks = %+v, want a single success ack for the retried command, reporting 2 attempts", acks)
+	}
+	if acks[0].Seq == 0 || acks[1].Seq <= acks[0].Seq {
+		t.Errorf("ack seqs = %d, %d, want them increasing", acks[0].Seq, acks[1].Seq)
+	}
+}
+
+func TestClientDoesNotAckStaleCompletions(t *testing.T) {
+	api := newFakeDeviceAPI(t, http.StatusOK)
+	api.SetDelay(50 * time.Millisecond)
+
+	// The higher-priority green overtakes the older red for stack-1 while
+	// the only worker is busy, so red completes last.
+	src := &chanSource{cmds: []Command{
+		{DeviceID: "stack-2", Mode: "red", TurnOn: true},
+		{DeviceID: "stack-1", Mode: "red", TurnOn: true},
+		{DeviceID: "stack-1", Mode: "green", TurnOn: true, Priority: 5},
+	}}
+	var logs syncBuffer
+	cfg := DefaultConfig()
+	cfg.WSURL = ""
+	cfg.APIBaseURL = api.URL
+	cfg.Source = src
+	cfg.Workers = 1
+	cfg.Logger = slog.New(slog.NewTextHandler(&logs, nil))
+	c, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stop := runClient(t, c)
+	waitFor(t, "the stale completion", func() bool { return strings.Contains(logs.String(), "event=ack_stale") })
+	stop()
+
+	if reqs := api.Requests(); len(reqs) != 3 || reqs[2].Query.Get("mode") != "red" || reqs[2].Path != "/api/device/gpo/light/stack-1" {
+		t.Fatalf("requests = %+v, want the stack-1 red command sent last", reqs)
+	}
+	if acks := src.Acks(); len(acks) != 2 || acks[0].DeviceID == acks[1].DeviceID {
+		t.Errorf("acks = %+v, want one per device and none for the stale stack-1 red command", acks)
+	}
+}
+
+func TestClientWaitsForModeSettleTime(t *testing.T) {
+	var mu sync.Mutex
+	sent := map[string]time.Time{}
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		sent[r.URL.Path+"?"+r.URL.Query().Get("mode")] = time.Now()
+		mu.Unlock()
+	}))
+	t.Cleanup(api.Close)
+
+	const settle = 150 * time.Millisecond
+	src := &chanSource{cmds: []Command{
+		{DeviceID: "stack-1", Mode: "lift", TurnOn: true},
+		{DeviceID: "stack-1", Mode: "red", TurnOn: true},
+		{DeviceID: "stack-1", Mode: "green", TurnOn: true},
+		{DeviceID: "stack-2", Mode: "red", TurnOn: true},
+	}}
+	cfg := DefaultConfig()
+	cfg.WSURL = ""
+	cfg.APIBaseURL = api.URL
+	cfg.Source = src
+	cfg.Workers = 1
+	cfg.ModeSettleTimes = map[string]time.Duration{"lift": settle}
+	c := newTestClient(t, cfg)
+
+	stop := runClient(t, c)
+	waitFor(t, "four acks", func() bool { return len(src.Acks()) == 4 })
+	stop()
+
+	mu.Lock()
+	defer mu.Unlock()
+	lift, red, green := sent["/api/device/gpo/light/stack-1?lift"], sent["/api/device/gpo/light/stack-1?red"], sent["/api/device/gpo/light/stack-1?green"]
+	if gap := red.Sub(lift); gap < settle {
+		t.Errorf("red sent %s after lift, want at least the %s settle time", gap, settle)
+	}
+	// stack-2 shares the only worker but not the settle time.
+	if other := sent["/api/device/gpo/light/stack-2?red"]; !other.Before(red) || other.Sub(lift) >= settle {
+		t.Errorf("stack-2 sent %s after lift, want it sent while stack-1 settles", other.Sub(lift))
+	}
+	if gap := green.Sub(red); gap >= settle {
+		t.Errorf("green sent %s after red, want no wait after a mode without a settle time", gap)
+	}
+}
+
+func TestClientAppliesTransforms(t *testing.T) {
+	src := &chanSource{cmds: []Command{
+		{DeviceID: "legacy-1", Mode: "rot", TurnOn: true},
+		{DeviceID: "blocked", Mode: "red", TurnOn: true},
+		{DeviceID: "stack-2", Mode: "red", TurnOn: true},
+	}}
+	api := newFakeDeviceAPI(t, http.StatusOK)
+
+	cfg := DefaultConfig()
+	cfg.APIBaseURL = api.URL
+	cfg.Source = src
+	cfg.Workers = 1
+	cfg.AllowedModes = []string{"red"}
+	cfg.Transforms = []Transform{
+		func(cmd Command) (Command, error) {
+			if cmd.DeviceID == "blocked" {
+				return cmd, errors.New("blocked device")
+			}
+			cmd.DeviceID = strings.Replace(cmd.DeviceID, "legacy-", "stack-", 1)
+			return cmd, nil
+		},
+		func(cmd Command) (Command, error) {
+			// Clearing the request ID must not lose it.
+			out := Command{DeviceID: cmd.DeviceID, Mode: cmd.Mode, TurnOn: cmd.TurnOn}
+			if out.Mode == "rot" {
+				out.Mode = "red"
+			}
+			return out, nil
+		},
+	}
+	c := newTestClient(t, cfg)
+
+	stop := runClient(t, c)
+	waitFor(t, "two acks", func() bool { return len(src.Acks()) == 2 })
+	stop()
+
+	reqs := api.Requests()
+	if len(reqs) != 2 || reqs[0].Path != "/api/device/gpo/light/stack-1" || reqs[0].Query.Get("mode") != "red" || reqs[1].Path != "/api/device/gpo/light/stack-2" {
+		t.Fatalf("requests = %+v, want stack-1 with the mapped mode, then stack-2", reqs)
+	}
+	if id := reqs[0].Header.Get("X-Request-ID"); id == "" || id != src.Acks()[0].RequestID {
+		t.Errorf("X-Request-ID = %q, ack request ID = %q; want the original ID kept", id, src.Acks()[0].RequestID)
+	}
+}
+
+func TestClientEmitsStateEvents(t *testing.T) {
+	ws := newFakeWSServer(t)
+	api := newFakeDeviceAPI(t, http.StatusOK)
+
+	cfg := testConfig(ws, api)
+	cfg.Logger = slog.New(slog.DiscardHandler)
+	c, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	stop := runClient(t, c)
+	waitFor(t, "a connection", c.Connected)
+	stop()
+
+	var got []State
+	for len(c.Events()) > 0 {
+		ev := <-c.Events()
+		if ev.Time.IsZero() {
+			t.Errorf("%s event has no timestamp", ev.State)
+		}
+		got = append(got, ev.State)
+	}
+	want := []State{StateConnecting, StateConnected, StateDisconnected}
+	if len(got) < len(want) {
+		t.Fatalf("events = %v, want at least %v", got, want)
+	}
+	for i, state := range want {
+		if got[i] != state {
+			t.Fatalf("events = %v, want them to start with %v", got, want)
+		}
+	}
+	if last := got[len(got)-1]; last != StateDisconnected {
+		t.Errorf("last event = %s, want disconnected after shutdown", last)
+	}
+}
+
+func TestClientEmitsReconnectingOnDialFailure(t *testing.T) {
+	ws := newFakeWSServer(t)
+	ws.Close()
+	api := newFakeDeviceAPI(t, http.StatusOK)
+
+	cfg := testConfig(ws, api)
+	cfg.Logger = slog.New(slog.DiscardHandler)
+	c, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	stop := runClient(t, c)
+	defer stop()
+
+	for _, want := range []State{StateConnecting, StateReconnecting} {
+		select {
+		case ev := <-c.Events():
+			if ev.State != want {
+				t.Fatalf("event = %s, want %s", ev.State, want)
+			}
+			if want == StateReconnecting && (!errors.Is(ev.Err, ErrDial) || ev.RetryIn <= 0) {
+				t.Errorf("reconnecting event = %+v, want ErrDial and a retry delay", ev)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %s", want)
+		}
+	}
+}
+
+func TestClientHonorsRetryAfterOnDial(t *testing.T) {
+	ws := newFakeWSServer(t)
+	ws.SetDown(true)
+	ws.retryAfter = "7"
+	api := newFakeDeviceAPI(t, http.StatusOK)
+
+	var logs syncBuffer
+	cfg := testConfig(ws, api)
+	cfg.Logger = slog.New(slog.NewTextHandler(&logs, nil))
+	c, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	stop := runClient(t, c)
+	defer stop()
+
+	for {
+		select {
+		case ev := <-c.Events():
+			if ev.State != StateReconnecting {
+				continue
+			}
+			if ev.RetryIn != 7*time.Second {
+				t.Errorf("retry delay = %s, want the server's 7s", ev.RetryIn)
+			}
+			if out := logs.String(); !strings.Contains(out, "event=ws_retry_after status=503 retry_after=7 retry_in=7s") {
+				t.Errorf("logs do not contain the suggested delay:\n%s", out)
+			}
+			return
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for a reconnecting event")
+		}
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		status int
+		header string
+		want   time.Duration
+		ok     bool
+	}{
+		{"seconds", http.StatusServiceUnavailable, "30", 30 * time.Second, true},
+		{"http date", http.StatusTooManyRequests, now.Add(90 * time.Second).Format(http.TimeFormat), 90 * time.Second, true},
+		{"date in the past", http.StatusTooManyRequests, now.Add(-time.Minute).Format(http.TimeFormat), 0, true},
+		{"missing", http.StatusServiceUnavailable, "", 0, false},
+		{"negative", http.StatusServiceUnavailable, "-5", 0, false},
+		{"garbage", http.StatusServiceUnavailable, "soon", 0, false},
+		{"other status", http.StatusForbidden, "30", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{StatusCode: tt.status, Header: http.Header{}}
+			if tt.header != "" {
+				resp.Header.Set("Retry-After", tt.header)
+			}
+			got, ok := retryAfter(resp, now)
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("retryAfter = %s, %t, want %s, %t", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestDialErrorCategory(t *testing.T) {
+	dial := func(err error) error {
+		return fmt.Errorf("%w: %w", ErrDial, &net.OpError{Op: "dial", Net: "tcp", Err: err})
+	}
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{dial(&net.DNSError{Err: "server misbehaving", Name: "example.com", IsTemporary: true}), dialErrDNS},
+		{dial(&net.DNSError{Err: "no such host", Name: "example.com", IsNotFound: true}), dialErrDNS},
+		{dial(os.NewSyscallError("connect", syscall.ECONNREFUSED)), dialErrRefused},
+		{dial(os.NewSyscallError("connect", syscall.ENETUNREACH)), dialErrNetwork},
+		{dial(os.ErrDeadlineExceeded), dialErrTimeout},
+		{fmt.Errorf("%w: %w", ErrDial, context.DeadlineExceeded), dialErrTimeout},
+		{fmt.Errorf("%w: %w", ErrDial, websocket.ErrBadHandshake), dialErrHandshake},
+		{fmt.Errorf("%w: %w", ErrDial, x509.UnknownAuthorityError{}), dialErrTLS},
+		{fmt.Errorf("%w: %w", ErrDial, errors.New("boom")), dialErrOther},
+	}
+	for _, tt := range tests {
+		if got := dialErrorCategory(tt.err); got != tt.want {
+			t.Errorf("dialErrorCategory(%v) = %s, want %s", tt.err, got, tt.want)
+		}
+	}
+}
+
+// flakyDNSDialer fails the first failures dials with a DNS error.
+type flakyDNSDialer struct {
+	Dialer
+	failures atomic.Int32
+}
+
+func (d *flakyDNSDialer) DialContext(ctx context.Context, urlStr string, header http.Header) (*websocket.Conn, *http.Response, error) {
+	if d.failures.Add(-1) >= 0 {
+		return nil, nil, &net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "server misbehaving", Name: "ws.example.com", IsTemporary: true}}
+	}
+	return d.Dialer.DialContext(ctx, urlStr, header)
+}
+
+func TestClientRetriesDNSFailuresQuickly(t *testing.T) {
+	ws := newFakeWSServer(t)
+	api := newFakeDeviceAPI(t, http.StatusOK)
+
+	var logs syncBuffer
+	cfg := testConfig(ws, api)
+	// A regular backoff this long would fail the test; DNS failures must
+	// use the DNS backoff instead.
+	cfg.BackoffBase = time.Minute
+	cfg.BackoffMax = time.Minute
+	cfg.DNSBackoffBase = time.Millisecond
+	cfg.DNSBackoffMax = 5 * time.Millisecond
+	cfg.Logger = slog.New(slog.NewTextHandler(&logs, nil))
+	d := &flakyDNSDialer{Dialer: websocket.DefaultDialer}
+	d.failures.Store(5)
+	cfg.Dialer = d
+	c, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	stop := runClient(t, c)
+	defer stop()
+	waitFor(t, "a connection after the DNS failures", c.Connected)
+
+	if out := logs.String(); !strings.Contains(out, "event=ws_connect_failed category=dns") {
+		t.Errorf("DNS failure category not logged; logs:\n%s", out)
+	}
+}
+
+func TestConnectFailureLog(t *testing.T) {
+	start := time.Now()
+	refused := errors.New("connection refused")
+	l := connectFailureLog{interval: time.Minute}
+
+	steps := []struct {
+		err  error
+		at   time.Duration
+		want connectLogAction
+	}{
+		{refused, 0, connectLogFull},
+		{refused, 2 * time.Second, connectLogQuiet},
+		{refused, 59 * time.Second, connectLogQuiet},
+		{refused, 61 * time.Second, connectLogSummary},
+		{refused, 90 * time.Second, connectLogQuiet},
+		{ErrIdleTimeout, 95 * time.Second, connectLogFull},
+		{ErrIdleTimeout, 100 * time.Second, connectLogQuiet},
+	}
+	for i, step := range steps {
+		if got := l.Failed(step.err, start.Add(step.at)); got != step.want {
+			t.Errorf("step %d: Failed = %d, want %d", i, got, step.want)
+		}
+	}
+	if !l.Failing() {
+		t.Error("Failing() = false during an outage")
+	}
+
+	attempts, outage := l.Recovered(start.Add(110 * time.Second))
+	if attempts != len(steps) || outage != 110*time.Second {
+		t.Errorf("Recovered = %d, %s; want %d, 1m50s", attempts, outage, len(steps))
+	}
+	if l.Failing() || l.Failed(refused, start.Add(2*time.Minute)) != connectLogFull {
+		t.Error("the first failure after recovering should be logged in full")
+	}
+
+	every := connectFailureLog{}
+	for i := range 3 {
+		if got := every.Failed(refused, start); got != connectLogFull {
+			t.Errorf("interval 0, attempt %d: Failed = %d, want every failure in full", i, got)
+		}
+	}
+}
+
+func TestWSDialerHandshakeTimeout(t *testing.T) {
+	// A listener that accepts connections but never answers the upgrade.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+		}
+	}()
+
+	cfg := DefaultConfig()
+	cfg.WSConnectTimeout = 50 * time.Millisecond
+	cfg.WSHandshakeTimeout = 100 * time.Millisecond
+	d, err := newWSDialer(cfg)
+	if err != nil {
+		t.Fatalf("newWSDialer: %v", err)
+	}
+
+	start := time.Now()
+	_, _, err = d.DialContext(context.Background(), "ws://"+ln.Addr().String()+"/light-stack", nil)
+	if err == nil {
+		t.Fatal("dial succeeded against a server that never answers")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("dial took %s, want it to give up after the 100ms handshake timeout", elapsed)
+	}
+
+	cfg.WSHandshakeTimeout = 10 * time.Millisecond
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "ws-handshake-timeout") {
+		t.Errorf("Validate with handshake timeout below connect timeout: error = %v", err)
+	}
+}
+
+func TestWSBufferSizes(t *testing.T) {
+	ws := newFakeWSServer(t, []string{
+		`{"device_id":"stack-1","mode":"red","turnOn":true,"request_id":"` + strings.Repeat("r", 200) + `"}`,
+	})
+	api := newFakeDeviceAPI(t, http.StatusOK)
+
+	cfg := testConfig(ws, api)
+	cfg.WSReadBufferSize = 16
+	cfg.WSWriteBufferSize = 16
+	d, err := newWSDialer(cfg)
+	if err != nil {
+		t.Fatalf("newWSDialer: %v", err)
+	}
+	if d.ReadBufferSize != 16 || d.WriteBufferSize != 16 {
+		t.Errorf("dialer buffer sizes = %d, %d; want 16, 16", d.ReadBufferSize, d.WriteBufferSize)
+	}
+	c := newTestClient(t, cfg)
+
+	stop := runClient(t, c)
+	waitFor(t, "the ack", func() bool { return len(ws.Received()) == 1 })
+	stop()
+	if got := ws.Received()[0]; !strings.Contains(got, strings.Repeat("r", 200)) {
+		t.Errorf("ack = %s, want the long request ID written through the small buffer", got)
+	}
+
+	invalid := cfg
+	invalid.WSReadBufferSize = 0
+	if err := invalid.Validate(); err == nil || !strings.Contains(err.Error(), "ws-read-buffer-size") {
+		t.Errorf("Validate with a zero read buffer: error = %v", err)
+	}
+	invalid = cfg
+	invalid.WSWriteBufferSize = -1
+	if err := invalid.Validate(); err == nil || !strings.Contains(err.Error(), "ws-write-buffer-size") {
+		t.Errorf("Validate with a negative write buffer: error = %v", err)
+	}
+}
+
+func TestClientGivesUpAfterMaxConnectFailures(t *testing.T) {
+	ws := newFakeWSServer(t)
+	ws.Close()
+	api := newFakeDeviceAPI(t, http.StatusOK)
+
+	cfg := testConfig(ws, api)
+	cfg.MaxConnectFailures = 3
+	c := newTestClient(t, cfg)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := c.Run(ctx)
+	if !errors.Is(err, ErrConnectGaveUp) || !errors.Is(err, ErrDial) {
+		t.Fatalf("Run error = %v, want ErrConnectGaveUp wrapping the dial error", err)
+	}
+	if ctx.Err() != nil {
+		t.Fatal("Run kept retrying until the test timeout")
+	}
+}
+
+// flakyDialer fails every dial except each third one.
+type flakyDialer struct {
+	mu    sync.Mutex
+	dials int
+}
+
+func (d *flakyDialer) DialContext(ctx context.Context, url string, h http.Header) (*websocket.Conn, *http.Response, error) {
+	d.mu.Lock()
+	d.dials++
+	n := d.dials
+	d.mu.Unlock()
+	if n%3 != 0 {
+		return nil, nil, errors.New("connection refused")
+	}
+	return websocket.DefaultDialer.DialContext(ctx, url, h)
+}
+
+func (d *flakyDialer) Dials() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.dials
+}
+
+func TestClientConnectFailuresResetOnConnect(t *testing.T) {
+	closeFrame := []wsFrame{{websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "restarting")}}
+	ws := newFakeWSServerFrames(t, closeFrame, closeFrame, closeFrame, closeFrame)
+	api := newFakeDeviceAPI(t, http.StatusOK)
+
+	dialer := &flakyDialer{}
+	cfg := testConfig(ws, api)
+	cfg.Dialer = dialer
+	cfg.MaxConnectFailures = 3
+	c := newTestClient(t, cfg)
+
+	stop := runClient(t, c)
+	// Two failures, then a connection, over and over: the limit of three
+	// is never reached.
+	waitFor(t, "three successful connections", func() bool { return ws.Connections() >= 3 })
+	stop()
+	if n := dialer.Dials(); n < 9 {
+		t.Errorf("got %d dials, want at least 9", n)
+	}
+}
+
+func TestClientFailsOverAndBack(t *testing.T) {
+	primary := newFakeWSServer(t, []string{`{"device_id":"stack-1","mode":"red","turnOn":true}`})
+	primary.SetDown(true)
+	secondary := newFakeWSServer(t, []string{`{"device_id":"stack-2","mode":"red","turnOn":true}`})
+	api := newFakeDeviceAPI(t, http.StatusOK)
+
+	var logs syncBuffer
+	cfg := testConfig(primary, api)
+	cfg.Logger = slog.New(slog.NewTextHandler(&logs, nil))
+	cfg.WSFailoverURLs = []string{secondary.wsURL()}
+	cfg.WSFailoverAfter = 2
+	cfg.WSFailbackInterval = 50 * time.Millisecond
+	c, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	stop := runClient(t, c)
+	waitFor(t, "an ack on the secondary", func() bool { return len(secondary.Received()) == 1 })
+	primary.SetDown(false)
+	waitFor(t, "an ack on the primary", func() bool { return len(primary.Received()) == 1 })
+	stop()
+
+	if got := secondary.Connections(); got != 1 {
+		t.Errorf("secondary got %d connections, want 1", got)
+	}
+	out := logs.String()
+	for _, want := range []string{"event=ws_failover", "event=ws_failback", "event=ws_connected url=" + secondary.wsURL() + " endpoint=failover-1"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("logs do not contain %q:\n%s", want, out)
+		}
+	}
+
+	cfg.WSFailoverURLs = []string{"http://backup"}
+	if _, err := New(cfg); err == nil || !strings.Contains(err.Error(), "ws-failover-url") {
+		t.Errorf("New with an http failover URL: error = %v", err)
+	}
+}
+
+func TestClientNotifiesWebhook(t *testing.T) {
+	src := &chanSource{cmds: []Command{
+		{DeviceID: "stack-1", Mode: "red", TurnOn: true},
+	}}
+	api := newFakeDeviceAPI(t, http.StatusBadRequest)
+	hook := newFakeDeviceAPI(t, http.StatusNoContent)
+
+	cfg := DefaultConfig()
+	cfg.APIBaseURL = api.URL
+	cfg.Source = src
+	cfg.WebhookURL = hook.URL
+	c := newTestClient(t, cfg)
+
+	stop := runClient(t, c)
+	waitFor(t, "a webhook notification", func() bool { return len(hook.Requests()) == 1 })
+	stop()
+
+	var ev webhookEvent
+	if err := json.Unmarshal(hook.Requests()[0].Body, &ev); err != nil {
+		t.Fatalf("webhook body: %v", err)
+	}
+	if ev.DeviceID != "stack-1" || ev.Mode != "red" || !ev.TurnOn || ev.Success || ev.StatusCode != http.StatusBadRequest || ev.Timestamp.IsZero() {
+		t.Errorf("webhook event = %+v, want a failed stack-1 command with status 400", ev)
+	}
+}
+
+func TestClientNotifiesWebhookWhileShuttingDown(t *testing.T) {
+	src := &chanSource{cmds: []Command{{DeviceID: "stack-1", Mode: "red", TurnOn: true}}}
+	api := newFakeDeviceAPI(t, http.StatusOK)
+	api.SetDelay(300 * time.Millisecond)
+	hook := newFakeDeviceAPI(t, http.StatusNoContent)
+
+	// The queue flush lets the in-flight command finish after ctx is
+	// cancelled; its outcome must still reach the webhook.
+	cfg := DefaultConfig()
+	cfg.APIBaseURL = api.URL
+	cfg.Source = src
+	cfg.WebhookURL = hook.URL
+	cfg.QueuePath = filepath.Join(t.TempDir(), "queue.jsonl")
+	cfg.QueueFlushTimeout = 5 * time.Second
+	c := newTestClient(t, cfg)
+
+	stop := runClient(t, c)
+	waitFor(t, "the device API request", func() bool { return len(api.Requests()) == 1 })
+	stop()
+
+	if reqs := hook.Requests(); len(reqs) != 1 {
+		t.Fatalf("got %d webhook notifications by the time Run returned, want 1", len(reqs))
+	}
+	var ev webhookEvent
+	if err := json.Unmarshal(hook.Requests()[0].Body, &ev); err != nil {
+		t.Fatalf("webhook body: %v", err)
+	}
+	if !ev.Success {
+		t.Errorf("webhook event = %+v, want the in-flight command's success", ev)
+	}
+}
+
+func TestClientReportsSuccessStatus(t *testing.T) {
+	for _, status := range []int{http.StatusAccepted, http.StatusNoContent} {
+		t.Run(strconv.Itoa(status), func(t *testing.T) {
+			src := &chanSource{cmds: []Command{
+				{DeviceID: "stack-1", Mode: "red", TurnOn: true},
+			}}
+			api := newFakeDeviceAPI(t, status)
+			hook := newFakeDeviceAPI(t, http.StatusNoContent)
+
+			cfg := DefaultConfig()
+			cfg.APIBaseURL = api.URL
+			cfg.Source = src
+			cfg.WebhookURL = hook.URL
+			c := newTestClient(t, cfg)
+
+			stop := runClient(t, c)
+			waitFor(t, "an ack and a webhook notification", func() bool { return len(src.Acks()) == 1 && len(hook.Requests()) == 1 })
+			stop()
+
+			if ack := src.Acks()[0]; ack.Outcome != ackOutcomeSuccess || ack.StatusCode != status {
+				t.Errorf("ack = %+v, want success with status %d", ack, status)
+			}
+			var ev webhookEvent
+			if err := json.Unmarshal(hook.Requests()[0].Body, &ev); err != nil {
+				t.Fatalf("webhook body: %v", err)
+			}
+			if !ev.Success || ev.StatusCode != status {
+				t.Errorf("webhook event = %+v, want success with status %d", ev, status)
+			}
+		})
+	}
+}
+
+func TestClientSubmit(t *testing.T) {
+	src := &chanSource{}
+	api := newFakeDeviceAPI(t, http.StatusOK)
+
+	cfg := DefaultConfig()
+	cfg.APIBaseURL = api.URL
+	cfg.Source = src
+	c := newTestClient(t, cfg)
+
+	stop := runClient(t, c)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.Submit(ctx, Command{DeviceID: "stack-1", Mode: "red", TurnOn: true}); err != nil {
+		t.Fatalf("Submit: %v", err)
+	}
+	waitFor(t, "an ack", func() bool { return len(src.Acks()) == 1 })
+	stop()
+
+	if got := len(api.Requests()); got != 1 {
+		t.Errorf("device API received %d requests, want 1", got)
+	}
+}
+
+func TestClientAckState(t *testing.T) {
+	for _, ackState := range []bool{false, true} {
+		t.Run(strconv.FormatBool(ackState), func(t *testing.T) {
+			src := &chanSource{cmds: []Command{{DeviceID: "stack-1", Mode: "red", TurnOn: true}}}
+			api := newFakeDeviceAPI(t, http.StatusOK)
+			api.SetBody(`{"mode":"red","turnOn":true}`)
+
+			cfg := DefaultConfig()
+			cfg.APIBaseURL = api.URL
+			cfg.Source = src
+			cfg.AckState = ackState
+			c := newTestClient(t, cfg)
+
+			stop := runClient(t, c)
+			waitFor(t, "an ack", func() bool { return len(src.Acks()) == 1 })
+			stop()
+
+			want := ""
+			if ackState {
+				want = `{"mode":"red","turnOn":true}`
+			}
+			if got := string(src.Acks()[0].State); got != want {
+				t.Errorf("ack state = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestClientProcessingMetrics(t *testing.T) {
+	src := &chanSource{}
+	api := newFakeDeviceAPI(t, http.StatusOK)
+	api.SetDelay(200 * time.Millisecond)
+
+	cfg := DefaultConfig()
+	cfg.APIBaseURL = api.URL
+	cfg.Source = src
+	cfg.Workers = 1
+	c := newTestClient(t, cfg)
+
+	latency := func() uint64 {
+		var m dto.Metric
+		if err := commandLatency.Write(&m); err != nil {
+			t.Fatal(err)
+		}
+		return m.GetHistogram().GetSampleCount()
+	}
+	queued, inFlight, observed := testutil.ToFloat64(commandsQueued), testutil.ToFloat64(commandsInFlight), latency()
+
+	stop := runClient(t, c)
+	for _, id := range []string{"stack-1", "stack-2"} {
+		if err := c.Submit(context.Background(), Command{DeviceID: id, Mode: "red", TurnOn: true}); err != nil {
+			t.Fatalf("Submit: %v", err)
+		}
+	}
+	// With one worker and a slow device API, one command is sent while
+	// the other waits.
+	waitFor(t, "the first request", func() bool { return len(api.Requests()) == 1 })
+	if got := testutil.ToFloat64(commandsInFlight) - inFlight; got != 1 {
+		t.Errorf("in-flight commands = %g, want 1", got)
+	}
+	if got := testutil.ToFloat64(commandsQueued) - queued; got != 1 {
+		t.Errorf("queued commands = %g, want 1", got)
+	}
+	waitFor(t, "two acks", func() bool { return len(src.Acks()) == 2 })
+	stop()
+
+	if got := testutil.ToFloat64(commandsInFlight) - inFlight; got != 0 {
+		t.Errorf("in-flight commands after completion = %g, want 0", got)
+	}
+	if got := testutil.ToFloat64(commandsQueued) - queued; got != 0 {
+		t.Errorf("queued commands after completion = %g, want 0", got)
+	}
+	if got := latency() - observed; got != 2 {
+		t.Errorf("latency histogram got %d observations, want 2", got)
+	}
+}
+
+func TestClientStats(t *testing.T) {
+	ws := newFakeWSServer(t, []string{
+		`{"device_id":`,
+		`{"device_id":"stack-1"}`,
+		`{"device_id":"stack-1","mode":"red","turnOn":true}`,
+	})
+	api := newFakeDeviceAPI(t, http.StatusOK)
+
+	cfg := testConfig(ws, api)
+	cfg.Logger = slog.New(slog.DiscardHandler)
+	c, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if st := c.Stats(); st.State != StateDisconnected || st.Connected || !st.LastConnected.IsZero() {
+		t.Errorf("Stats before Run = %+v, want disconnected and never connected", st)
+	}
+
+	stop := runClient(t, c)
+	waitFor(t, "an ack", func() bool { return len(ws.Received()) == 1 })
+	st := c.Stats()
+	if st.State != StateConnected || !st.Connected || st.LastConnected.IsZero() {
+		t.Errorf("Stats while connected = %+v, want connected", st)
+	}
+	stop()
+
+	st = c.Stats()
+	if st.State != StateDisconnected || st.LastDisconnected.Before(st.LastConnected) {
+		t.Errorf("Stats after shutdown = %+v, want disconnected after the last connect", st)
+	}
+	if st.CommandsReceived != 2 || st.CommandsMalformed != 1 || st.CommandsSkipped != 1 || st.CommandsSucceeded != 1 || st.CommandsFailed != 0 {
+		t.Errorf("command counts = %+v, want 2 received, 1 malformed, 1 skipped and 1 succeeded", st)
+	}
+	if st.CommandsQueued != 0 || st.CommandsInFlight != 0 {
+		t.Errorf("queued = %d, in flight = %d after shutdown, want 0", st.CommandsQueued, st.CommandsInFlight)
+	}
+}
+
+func TestClientSlowDeviceAPIKeepsConnection(t *testing.T) {
+	ws := newFakeWSServer(t, []string{
+		`{"device_id":"stack-1","mode":"red","turnOn":true}`,
+		`{"device_id":"stack-1","mode":"red","turnOn":false}`,
+		`{"device_id":"stack-1","mode":"green","turnOn":true}`,
+	})
+	api := newFakeDeviceAPI(t, http.StatusOK)
+	api.SetDelay(300 * time.Millisecond)
+
+	cfg := testConfig(ws, api)
+	cfg.Logger = slog.New(slog.DiscardHandler)
+	cfg.KeepAliveInterval = 30 * time.Millisecond
+	cfg.ReadTimeout = 100 * time.Millisecond
+	cfg.Workers = 1
+	cfg.WorkerQueueSize = 0
+	c, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	stop := runClient(t, c)
+	waitFor(t, "3 acks", func() bool { return len(ws.Received()) == 3 })
+	stop()
+
+	if got := ws.Connections(); got != 1 {
+		t.Errorf("client connected %d times, want slow processing not to trip the read deadline", got)
+	}
+}
+
+func TestClientClassifiesServerClose(t *testing.T) {
+	ws := newFakeWSServerFrames(t, []wsFrame{
+		{websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "restarting")},
+	})
+	api := newFakeDeviceAPI(t, http.StatusOK)
+
+	var logs syncBuffer
+	cfg := testConfig(ws, api)
+	cfg.Logger = slog.New(slog.NewTextHandler(&logs, nil))
+	c, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	stop := runClient(t, c)
+	waitFor(t, "a reconnect", func() bool { return ws.Connections() == 2 })
+	stop()
+
+	var closeErr error
+	for len(c.Events()) > 0 {
+		if ev := <-c.Events(); ev.State == StateDisconnected && ev.Err != nil {
+			closeErr = ev.Err
+			break
+		}
+	}
+	var ce *websocket.CloseError
+	if !errors.Is(closeErr, ErrRead) || !errors.As(closeErr, &ce) || ce.Code != websocket.CloseGoingAway {
+		t.Errorf("disconnected event error = %v, want ErrRead wrapping a going-away close", closeErr)
+	}
+
+	out := logs.String()
+	if !strings.Contains(out, `level=INFO msg="Server closed the connection" event=ws_closed`) {
+		t.Errorf("going-away close not logged as a normal closure; logs:\n%s", out)
+	}
+	if strings.Contains(out, "event=ws_connection_lost") {
+		t.Errorf("going-away close logged as a lost connection; logs:\n%s", out)
+	}
+}
+
+func TestClientIdleWatchdog(t *testing.T) {
+	for _, idle := range []time.Duration{0, 150 * time.Millisecond} {
+		t.Run(idle.String(), func(t *testing.T) {
+			// The server answers pings but sends nothing after the first
+			// command.
+			ws := newFakeWSServer(t, []string{`{"device_id":"stack-1","mode":"red","turnOn":true}`})
+			api := newFakeDeviceAPI(t, http.StatusOK)
+
+			var logs syncBuffer
+			cfg := testConfig(ws, api)
+			cfg.KeepAliveInterval = 20 * time.Millisecond
+			cfg.ReadTimeout = time.Second
+			cfg.IdleTimeout = idle
+			cfg.Logger = slog.New(slog.NewTextHandler(&logs, nil))
+			c, err := New(cfg)
+			if err != nil {
+				t.Fatalf("New: %v", err)
+			}
+
+			stop := runClient(t, c)
+			waitFor(t, "the command", func() bool { return len(api.Requests()) == 1 })
+			if idle == 0 {
+				time.Sleep(300 * time.Millisecond)
+				stop()
+				if n := ws.Connections(); n != 1 {
+					t.Errorf("got %d connections with the watchdog disabled, want 1", n)
+				}
+				return
+			}
+			waitFor(t, "a reconnect", func() bool { return ws.Connections() == 2 })
+			stop()
+
+			if out := logs.String(); !strings.Contains(out, "event=ws_idle_timeout") {
+				t.Errorf("idle reconnect not logged; logs:\n%s", out)
+			}
+		})
+	}
+}
+
+func TestClientReadDeadlineExtendedByMessages(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		t.Run(fmt.Sprintf("strict=%t", strict), func(t *testing.T) {
+			// The server sends a command every 20ms but never answers pings.
+			var conns atomic.Int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var upgrader websocket.Upgrader
+				conn, err := upgrader.Upgrade(w, r, nil)
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				conns.Add(1)
+				conn.SetPingHandler(func(string) error { return nil })
+				go func() {
+					for {
+						if _, _, err := conn.ReadMessage(); err != nil {
+							return
+						}
+					}
+				}()
+				for {
+					if err := conn.WriteMessage(websocket.TextMessage, []byte(`{"device_id":"stack-1","mode":"red","turnOn":true}`)); err != nil {
+						return
+					}
+					time.Sleep(20 * time.Millisecond)
+				}
+			}))
+			t.Cleanup(srv.Close)
+			api := newFakeDeviceAPI(t, http.StatusOK)
+
+			cfg := DefaultConfig()
+			cfg.WSURL = "ws" + strings.TrimPrefix(srv.URL, "http")
+			cfg.APIBaseURL = api.URL
+			cfg.BackoffBase = time.Millisecond
+			cfg.BackoffMax = 10 * time.Millisecond
+			cfg.Logger = slog.New(slog.DiscardHandler)
+			cfg.KeepAliveInterval = 30 * time.Millisecond
+			cfg.ReadTimeout = 100 * time.Millisecond
+			cfg.StrictPing = strict
+			c, err := New(cfg)
+			if err != nil {
+				t.Fatalf("New: %v", err)
+			}
+
+			stop := runClient(t, c)
+			if strict {
+				waitFor(t, "a reconnect", func() bool { return conns.Load() >= 2 })
+				stop()
+				return
+			}
+			time.Sleep(400 * time.Millisecond)
+			stop()
+			if n := conns.Load(); n != 1 {
+				t.Errorf("got %d connections, want commands to keep the read deadline alive without pongs", n)
+			}
+		})
+	}
+}
+
+func TestClientReconnectsAfterPingWriteFailure(t *testing.T) {
+	// The server never reads, so it does not notice the client's write
+	// side going away; only the failed ping can trigger the reconnect.
+	var mu sync.Mutex
+	conns := 0
+	ws := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		mu.Lock()
+		conns++
+		mu.Unlock()
+		<-r.Context().Done()
+	}))
+	t.Cleanup(ws.Close)
+	connections := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return conns
+	}
+
+	var logs syncBuffer
+	cfg := DefaultConfig()
+	cfg.WSURL = "ws" + strings.TrimPrefix(ws.URL, "http")
+	cfg.KeepAliveInterval = 20 * time.Millisecond
+	cfg.ReadTimeout = 30 * time.Second
+	cfg.BackoffBase = time.Millisecond
+	cfg.BackoffMax = 10 * time.Millisecond
+	cfg.Logger = slog.New(slog.NewTextHandler(&logs, nil))
+	c, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	stop := runClient(t, c)
+	defer stop()
+	waitFor(t, "a connection", c.Connected)
+	src := c.source.(*wsSource)
+	if err := src.conn.Load().UnderlyingConn().(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatalf("CloseWrite: %v", err)
+	}
+	waitFor(t, "a reconnect", func() bool { return connections() == 2 })
+
+	if out := logs.String(); !strings.Contains(out, "event=ping_failed") || !strings.Contains(out, "event=ws_write_failed") {
+		t.Errorf("write failure not logged; logs:\n%s", out)
+	}
+}
+
+// stallingConn simulates a socket whose send buffer is full: once stalled,
+// writes block until the write deadline passes, or forever without one.
+type stallingConn struct {
+	net.Conn
+	stalled  atomic.Bool
+	mu       sync.Mutex
+	deadline time.Time
+}
+
+func (c *stallingConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+	return c.Conn.SetWriteDeadline(t)
+}
+
+func (c *stallingConn) Write(b []byte) (int, error) {
+	if !c.stalled.Load() {
+		return c.Conn.Write(b)
+	}
+	c.mu.Lock()
+	deadline := c.deadline
+	c.mu.Unlock()
+	if deadline.IsZero() {
+		select {}
+	}
+	time.Sleep(time.Until(deadline))
+	return 0, os.ErrDeadlineExceeded
+}
+
+func TestClientReconnectsAfterPingWriteTimeout(t *testing.T) {
+	ws := newFakeWSServer(t)
+	api := newFakeDeviceAPI(t, http.StatusOK)
+
+	var logs syncBuffer
+	cfg := testConfig(ws, api)
+	cfg.KeepAliveInterval = 20 * time.Millisecond
+	cfg.PingWriteTimeout = 50 * time.Millisecond
+	cfg.Logger = slog.New(slog.NewTextHandler(&logs, nil))
+	d, err := newWSDialer(cfg)
+	if err != nil {
+		t.Fatalf("newWSDialer: %v", err)
+	}
+	var mu sync.Mutex
+	var conns []*stallingConn
+	dial := d.NetDialContext
+	d.NetDialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		sc := &stallingConn{Conn: conn}
+		mu.Lock()
+		conns = append(conns, sc)
+		mu.Unlock()
+		return sc, nil
+	}
+	cfg.Dialer = d
+	c, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	stop := runClient(t, c)
+	defer stop()
+	waitFor(t, "a connection", c.Connected)
+	mu.Lock()
+	conns[0].stalled.Store(true)
+	mu.Unlock()
+	waitFor(t, "a reconnect", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(conns) == 2 && c.Connected()
+	})
+
+	if out := logs.String(); !strings.Contains(out, "event=ping_timeout") || !strings.Contains(out, "event=ws_write_failed") {
+		t.Errorf("ping timeout not logged; logs:\n%s", out)
+	}
+}
+
+func TestClientRejectsOversizedMessages(t *testing.T) {
+	big := `{"device_id":"stack-1","mode":"red","turnOn":true,"color":"` + strings.Repeat("x", 200) + `"}`
+	ws := newFakeWSServer(t, []string{big}, []string{
+		`{"device_id":"stack-1","mode":"red","turnOn":true}`,
+	})
+	api := newFakeDeviceAPI(t, http.StatusOK)
+
+	var logs syncBuffer
+	cfg := testConfig(ws, api)
+	cfg.Logger = slog.New(slog.NewTextHandler(&logs, nil))
+	cfg.MaxMessageSize = 128
+	c, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	stop := runClient(t, c)
+	waitFor(t, "a request after reconnecting", func() bool { return len(api.Requests()) == 1 })
+	stop()
+
+	if got := ws.Connections(); got != 2 {
+		t.Errorf("client connected %d times, want a reconnect after the oversized message", got)
+	}
+	if !strings.Contains(logs.String(), "event=ws_message_too_large") {
+		t.Errorf("oversized message not logged; logs:\n%s", logs.String())
+	}
+}
+
+func TestClientDrain(t *testing.T) {
+	tests := []struct {
+		name        string
+		timeout     time.Duration
+		wantOutcome string
+	}{
+		{name: "finishes in-flight command", timeout: 5 * time.Second, wantOutcome: ackOutcomeSuccess},
+		{name: "cancels at the deadline", timeout: 50 * time.Millisecond, wantOutcome: ackOutcomeError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := &chanSource{cmds: []Command{{DeviceID: "stack-1", Mode: "red", TurnOn: true}}}
+			api := newFakeDeviceAPI(t, http.StatusOK)
+			api.SetDelay(300 * time.Millisecond)
+
+			cfg := DefaultConfig()
+			cfg.APIBaseURL = api.URL
+			cfg.Source = src
+			cfg.DrainTimeout = tt.timeout
+			c := newTestClient(t, cfg)
+
+			errc := make(chan error, 1)
+			go func() { errc <- c.Run(context.Background()) }()
+			waitFor(t, "the device API request", func() bool { return len(api.Requests()) == 1 })
+			c.Drain()
+
+			select {
+			case err := <-errc:
+				if err != nil {
+					t.Fatalf("Run: %v", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("Run did not return after Drain")
+			}
+
+			acks := src.Acks()
+			if len(acks) != 1 || acks[0].Outcome != tt.wantOutcome {
+				t.Errorf("acks = %+v, want one with outcome %s", acks, tt.wantOutcome)
+			}
+		})
+	}
+}
+
+func TestClientDrainRejectsNewCommands(t *testing.T) {
+	src := &chanSource{cmds: []Command{{DeviceID: "stack-1", Mode: "red", TurnOn: true}}}
+	api := newFakeDeviceAPI(t, http.StatusOK)
+	api.SetDelay(300 * time.Millisecond)
+
+	var logs syncBuffer
+	cfg := DefaultConfig()
+	cfg.APIBaseURL = api.URL
+	cfg.Source = src
+	cfg.Logger = slog.New(slog.NewTextHandler(&logs, nil))
+	c, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	errc := make(chan error, 1)
+	go func() { errc <- c.Run(context.Background()) }()
+	waitFor(t, "the device API request", func() bool { return len(api.Requests()) == 1 })
+	c.Drain()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.Submit(ctx, Command{DeviceID: "stack-2", Mode: "red", TurnOn: true}); err != nil {
+		t.Fatalf("Submit during the drain: %v", err)
+	}
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Fatalf("Run: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after Drain")
+	}
+
+	if got := len(api.Requests()); got != 1 {
+		t.Errorf("device API got %d requests, want only the command from before the drain", got)
+	}
+	acks := src.Acks()
+	if len(acks) != 2 || acks[0].DeviceID != "stack-2" || acks[0].Outcome != ackOutcomeError || acks[1].Outcome != ackOutcomeSuccess {
+		t.Errorf("acks = %+v, want stack-2 rejected and stack-1 acked as a success", acks)
+	}
+	if want := "event=drain_finished drained=1 abandoned=1"; !strings.Contains(logs.String(), want) {
+		t.Errorf("logs do not contain %q:\n%s", want, logs.String())
+	}
+}
+
+func TestClientFlushesQueueOnShutdown(t *testing.T) {
+	tests := []struct {
+		name          string
+		timeout       time.Duration
+		wantRequests  int
+		wantPersisted int
+	}{
+		{name: "flushes pending commands", timeout: 5 * time.Second, wantRequests: 3, wantPersisted: 0},
+		{name: "persists at the deadline", timeout: 50 * time.Millisecond, wantRequests: 1, wantPersisted: 3},
+		{name: "disabled", timeout: 0, wantRequests: 1, wantPersisted: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := &chanSource{cmds: []Command{
+				{DeviceID: "stack-1", Mode: "red", TurnOn: true},
+				{DeviceID: "stack-1", Mode: "green", TurnOn: true},
+				{DeviceID: "stack-1", Mode: "blue", TurnOn: true},
+			}}
+			api := newFakeDeviceAPI(t, http.StatusOK)
+			api.SetDelay(200 * time.Millisecond)
+
+			var logs syncBuffer
+			cfg := DefaultConfig()
+			cfg.APIBaseURL = api.URL
+			cfg.Source = src
+			cfg.Logger = slog.New(slog.NewTextHandler(&logs, nil))
+			cfg.QueuePath = filepath.Join(t.TempDir(), "queue.jsonl")
+			cfg.QueueFlushTimeout = tt.timeout
+			c, err := New(cfg)
+			if err != nil {
+				t.Fatalf("New: %v", err)
+			}
+
+			stop := runClient(t, c)
+			waitFor(t, "the first device API request", func() bool { return len(api.Requests()) == 1 })
+			stop()
+
+			if got := len(api.Requests()); got != tt.wantRequests {
+				t.Errorf("device API got %d requests, want %d", got, tt.wantRequests)
+			}
+			if got := c.replay.queue.Len(); got != tt.wantPersisted {
+				t.Errorf("queue holds %d commands, want %d", got, tt.wantPersisted)
+			}
+			if tt.timeout > 0 {
+				want := fmt.Sprintf("event=flush_finished flushed=%d persisted=%d", 3-tt.wantPersisted, tt.wantPersisted)
+				if out := logs.String(); !strings.Contains(out, want) {
+					t.Errorf("logs do not contain %q:\n%s", want, out)
+				}
+			}
+		})
+	}
+}
+
+// nopSource is a CommandSource that never delivers anything and drops acks,
+// for driving dispatch directly.
+type nopSource struct{}
+
+func (nopSource) Run(ctx context.Context, out chan<- Command) error {
+	<-ctx.Done()
+	return nil
+}
+
+func (nopSource) Ack(Ack) error { return nil }
+
+func BenchmarkDispatchPipeline(b *testing.B) {
+	cfg := DefaultConfig()
+	cfg.WSURL = ""
+	cfg.Source = nopSource{}
+	cfg.HTTPDoer = nopDoer
+	cfg.Logger = slog.New(slog.DiscardHandler)
+	c, err := New(cfg)
+	if err != nil {
+		b.Fatalf("New: %v", err)
+	}
+	devices := make([]string, 64)
+	for i := range devices {
+		devices[i] = "stack-" + strconv.Itoa(i)
+	}
+	ctx := context.Background()
+	pool := c.newDispatcher(ctx)
+
+	b.ReportAllocs()
+	i := 0
+	for b.Loop() {
+		c.dispatch(ctx, pool, Command{DeviceID: devices[i%len(devices)], Mode: "red", TurnOn: true})
+		i++
+	}
+	pool.Close()
+}
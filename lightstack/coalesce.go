@@ -0,0 +1,52 @@
+package lightstack
+
+import "sync"
+
+// coalescer lets identical commands that are in flight at the same time
+// share one device API call and its result. Unlike deduper it only joins
+// calls that overlap; a command arriving after the call finished is sent
+// again. A nil *coalescer disables it.
+type coalescer struct {
+	mu    sync.Mutex
+	calls map[dedupKey]*inFlightCall
+}
+
+type inFlightCall struct {
+	done chan struct{}
+	res  Result
+	err  error
+}
+
+func newCoalescer() *coalescer {
+	return &coalescer{calls: make(map[dedupKey]*inFlightCall)}
+}
+
+// Do runs send for cmd unless an identical command is already being sent,
+// in which case it waits for that call and returns its result. shared
+// reports whether the result came from another command's call.
+func (g *coalescer) Do(cmd Command, send func() (Result, error)) (res Result, shared bool, err error) {
+	if g == nil {
+		res, err = send()
+		return res, false, err
+	}
+
+	key := newDedupKey(cmd)
+	g.mu.Lock()
+	if call, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		<-call.done
+		return call.res, true, call.err
+	}
+	call := &inFlightCall{done: make(chan struct{})}
+	g.calls[key] = call
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		close(call.done)
+	}()
+	call.res, call.err = send()
+	return call.res, false, call.err
+}
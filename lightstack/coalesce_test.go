@@ -0,0 +1,92 @@
+package lightstack
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCoalesceInFlight(t *testing.T) {
+	tests := []struct {
+		name     string
+		coalesce bool
+		cmds     []Command
+		want     int
+	}{
+		{
+			name:     "identical commands share a call",
+			coalesce: true,
+			cmds:     []Command{{DeviceID: "stack-1", Mode: "red", TurnOn: true}, {DeviceID: "stack-1", Mode: "red", TurnOn: true}},
+			want:     1,
+		},
+		{
+			name:     "different commands are both sent",
+			coalesce: true,
+			cmds:     []Command{{DeviceID: "stack-1", Mode: "red", TurnOn: true}, {DeviceID: "stack-1", Mode: "red", TurnOn: false}},
+			want:     2,
+		},
+		{
+			name:     "commands with different params are both sent",
+			coalesce: true,
+			cmds: []Command{
+				{DeviceID: "stack-1", Mode: "red", TurnOn: true, Params: map[string]string{"blink": "2"}},
+				{DeviceID: "stack-1", Mode: "red", TurnOn: true, Params: map[string]string{"blink": "5"}},
+			},
+			want: 2,
+		},
+		{
+			name:     "disabled",
+			coalesce: false,
+			cmds:     []Command{{DeviceID: "stack-1", Mode: "red", TurnOn: true}, {DeviceID: "stack-1", Mode: "red", TurnOn: true}},
+			want:     2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := newFakeDeviceAPI(t, http.StatusOK)
+			api.SetDelay(100 * time.Millisecond)
+			api.SetBody(`{"on":true}`)
+
+			cfg := DefaultConfig()
+			cfg.APIBaseURL = api.URL
+			cfg.CoalesceInFlight = tt.coalesce
+			c := newTestClient(t, cfg)
+
+			var wg sync.WaitGroup
+			results := make([]Result, len(tt.cmds))
+			for i, cmd := range tt.cmds {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					res, err := c.sendHTTPRequestWithRetry(context.Background(), cmd, c.policy)
+					if err != nil {
+						t.Errorf("command %d: %v", i, err)
+					}
+					results[i] = res
+				}()
+				// Start the first call before the second one.
+				time.Sleep(10 * time.Millisecond)
+			}
+			wg.Wait()
+
+			if got := len(api.Requests()); got != tt.want {
+				t.Errorf("device API got %d requests, want %d", got, tt.want)
+			}
+			for i, res := range results {
+				if res.StatusCode != http.StatusOK || string(res.State) != `{"on":true}` {
+					t.Errorf("command %d result = %d %s, want the device API response", i, res.StatusCode, res.State)
+				}
+			}
+
+			// Once the call is over, the same command is sent again.
+			if _, err := c.sendHTTPRequestWithRetry(context.Background(), tt.cmds[0], c.policy); err != nil {
+				t.Fatal(err)
+			}
+			if got := len(api.Requests()); got != tt.want+1 {
+				t.Errorf("device API got %d requests after a later command, want %d", got, tt.want+1)
+			}
+		})
+	}
+}
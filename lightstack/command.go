@@ -0,0 +1,212 @@
+package lightstack
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const maxBrightness = 100
+
+// Command is a light instruction sent by the server. Brightness, Color and
+// Priority are optional; fields the connector does not know about are
+// ignored. Commands with a higher Priority are dispatched first when the
+// workers are backed up. TimeoutMS, if set, replaces the device API timeout
+// for this command. RequestID is sent to the device API as X-Request-ID
+// and generated on receipt if the server did not set one. IdempotencyKey
+// is sent as Idempotency-Key on every attempt, including retries and
+// replays, and is likewise generated if missing. Commands with a
+// SchemaVersion outside MinSchemaVersion to MaxSchemaVersion are skipped.
+// Params are passed through to the device API as extra query parameters.
+type Command struct {
+	DeviceID   string `json:"device_id"`
+	Mode       string `json:"mode"`
+	TurnOn     bool   `json:"turnOn"`
+	Brightness *int   `json:"brightness,omitempty"`
+	Color      string `json:"color,omitempty"`
+	Priority   int    `json:"priority,omitempty"`
+	TimeoutMS  int    `json:"timeout_ms,omitempty"`
+	RequestID  string `json:"request_id,omitempty"`
+	// IdempotencyKey is only useful if the device API honors the header.
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+	SchemaVersion  int    `json:"schema_version,omitempty"`
+	// Params must not set the query parameters the connector sends itself.
+	Params map[string]string `json:"params,omitempty"`
+
+	// receivedAt is when the Client received the command, for the
+	// processing latency metric and to tell stale replays apart. It is
+	// kept in the queue file.
+	receivedAt time.Time
+	// seq numbers the command in the order the Client received it, for its
+	// ack. It is 0 for commands read back from the queue file.
+	seq uint64
+	// span traces the command from receipt to completion. It is nil when
+	// tracing is disabled and for replayed commands.
+	span trace.Span
+	// origin is the WebSocket subscription the command arrived on, so its
+	// ack goes back on the same connection.
+	origin *wsSource
+}
+
+// Validate rejects commands that would produce a malformed device API
+// request. An empty allowedModes accepts any non-empty mode.
+func (c Command) Validate(allowedModes []string) error {
+	if err := validateSchemaVersion(c.SchemaVersion); err != nil {
+		return err
+	}
+	if strings.TrimSpace(c.DeviceID) == "" {
+		return errors.New("device_id is required")
+	}
+	if c.Mode == "" {
+		return errors.New("mode is required")
+	}
+	if len(allowedModes) > 0 && !slices.Contains(allowedModes, c.Mode) {
+		return fmt.Errorf("mode %q is not one of %v", c.Mode, allowedModes)
+	}
+	if c.TimeoutMS < 0 {
+		return fmt.Errorf("timeout_ms must not be negative, got %d", c.TimeoutMS)
+	}
+	if c.Brightness != nil && (*c.Brightness < 0 || *c.Brightness > maxBrightness) {
+		return fmt.Errorf("brightness must be between 0 and %d, got %d", maxBrightness, *c.Brightness)
+	}
+	for name := range c.Params {
+		if name == "" {
+			return errors.New("params must not have an empty name")
+		}
+		if slices.Contains(reservedParams, name) {
+			return fmt.Errorf("params must not set %s", name)
+		}
+	}
+	return nil
+}
+
+// withModePriority gives a command without an explicit priority the one
+// configured for its mode.
+func (c Command) withModePriority(modePriorities map[string]int) Command {
+	if c.Priority == 0 {
+		c.Priority = modePriorities[c.Mode]
+	}
+	return c
+}
+
+// forModes drops brightness and color unless the command's mode supports
+// them. An empty extendedModes means every mode does.
+func (c Command) forModes(extendedModes []string) Command {
+	if len(extendedModes) == 0 || slices.Contains(extendedModes, c.Mode) {
+		return c
+	}
+	c.Brightness = nil
+	c.Color = ""
+	return c
+}
+
+func commandAttrs(cmd Command) []any {
+	attrs := []any{
+		slog.String("device_id", cmd.DeviceID),
+		slog.String("mode", cmd.Mode),
+		slog.Bool("turn_on", cmd.TurnOn),
+	}
+	if cmd.RequestID != "" {
+		attrs = append(attrs, slog.String("request_id", cmd.RequestID))
+	}
+	if cmd.Brightness != nil {
+		attrs = append(attrs, slog.Int("brightness", *cmd.Brightness))
+	}
+	if cmd.Color != "" {
+		attrs = append(attrs, slog.String("color", cmd.Color))
+	}
+	return attrs
+}
+
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// maxLoggedPayload caps how much of an undecodable message is logged.
+const maxLoggedPayload = 256
+
+// truncatePayload returns data as a string of at most maxLoggedPayload
+// bytes, marking where it was cut.
+func truncatePayload(data []byte) string {
+	if len(data) <= maxLoggedPayload {
+		return string(data)
+	}
+	return string(data[:maxLoggedPayload]) + "...(truncated)"
+}
+
+// decodeCommands parses the command in a text or binary frame, or the
+// commands if the frame holds a JSON array of them. Binary frames may be
+// gzip-compressed, and may decompress to at most maxSize bytes. Array
+// elements that are not commands are reported in the error, and the valid
+// ones are still returned in order.
+func decodeCommands(messageType int, data []byte, maxSize int) ([]Command, error) {
+	data, err := framePayload(messageType, data, maxSize)
+	if err != nil {
+		return nil, err
+	}
+	if trimmed := bytes.TrimLeft(data, " \t\r\n"); len(trimmed) == 0 || trimmed[0] != '[' {
+		var cmd Command
+		if err := json.Unmarshal(data, &cmd); err != nil {
+			return nil, fmt.Errorf("malformed command: %w", err)
+		}
+		return []Command{cmd}, nil
+	}
+
+	var elements []json.RawMessage
+	if err := json.Unmarshal(data, &elements); err != nil {
+		return nil, fmt.Errorf("malformed command array: %w", err)
+	}
+	cmds := make([]Command, 0, len(elements))
+	var errs []error
+	for i, element := range elements {
+		var cmd Command
+		if err := json.Unmarshal(element, &cmd); err != nil {
+			errs = append(errs, fmt.Errorf("malformed command at index %d: %w", i, err))
+			continue
+		}
+		cmds = append(cmds, cmd)
+	}
+	return cmds, errors.Join(errs...)
+}
+
+// framePayload returns the JSON held by a text or binary frame.
+func framePayload(messageType int, data []byte, maxSize int) ([]byte, error) {
+	switch messageType {
+	case websocket.TextMessage:
+	case websocket.BinaryMessage:
+		if bytes.HasPrefix(data, gzipMagic) {
+			zr, err := gzip.NewReader(bytes.NewReader(data))
+			if err != nil {
+				return nil, fmt.Errorf("failed to open gzip payload: %w", err)
+			}
+			defer zr.Close()
+			if data, err = io.ReadAll(io.LimitReader(zr, int64(maxSize)+1)); err != nil {
+				return nil, fmt.Errorf("failed to decompress payload: %w", err)
+			}
+			if len(data) > maxSize {
+				return nil, fmt.Errorf("decompressed payload exceeds %d bytes", maxSize)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unexpected message type %d", messageType)
+	}
+	return data, nil
+}
+
+// newRequestID returns a random (version 4) UUID.
+func newRequestID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
@@ -0,0 +1,647 @@
+package lightstack
+
+import (
+	"compress/flate"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	defaultWSURL              = "wss://laundirs-supply-chain-websocket.azurewebsites.net/light-stack"
+	defaultAPIBaseURL         = "http://localhost:8080"
+	defaultKeepAliveInterval  = 10 * time.Second
+	maxKeepAliveJitter        = 50
+	defaultPingWriteTimeout   = 5 * time.Second
+	defaultMaxMessageSize     = 8 << 10
+	defaultReadTimeout        = 60 * time.Second
+	defaultBackoffBase        = 500 * time.Millisecond
+	defaultBackoffMax         = 30 * time.Second
+	defaultBackoffResetAfter  = 30 * time.Second
+	defaultDNSBackoffBase     = 100 * time.Millisecond
+	defaultDNSBackoffMax      = 2 * time.Second
+	defaultConnectLogInterval = time.Minute
+	defaultHTTPTimeout        = 10 * time.Second
+	defaultHTTPMaxTimeout     = 60 * time.Second
+	defaultWSFailoverAfter    = 3
+	defaultWSFailbackInterval = 5 * time.Minute
+	defaultHTTPMaxIdleConns   = 16
+	defaultHTTPMaxAttempts    = 3
+	defaultHTTPRetryBase      = 200 * time.Millisecond
+	defaultHTTPRetryMax       = 2 * time.Second
+	defaultPreflightPath      = "/healthz"
+	defaultBreakerCooldown    = 30 * time.Second
+	defaultRateBurst          = 1
+	defaultWebhookTimeout     = 2 * time.Second
+	defaultDrainTimeout       = 10 * time.Second
+	defaultWorkers            = 4
+	defaultWorkerQueueSize    = 64
+	maxWorkers                = 256
+	defaultQueueMaxSize       = 1000
+	defaultQueueReplay        = 10 * time.Second
+	defaultQueueFlushTimeout  = 3 * time.Second
+	defaultBatchMaxSize       = 50
+	defaultWSCompressionLevel = flate.BestSpeed
+	defaultWSConnectTimeout   = 10 * time.Second
+	defaultWSHandshakeTimeout = 45 * time.Second
+	defaultWSBufferSize       = 1 << 10
+	defaultNATSSubject        = "lightstack.commands"
+)
+
+// Config controls a Client. Start from DefaultConfig and override fields as
+// needed.
+type Config struct {
+	WSURL string
+	// WSFailoverURLs are tried in order after WSFailoverAfter consecutive
+	// failed connection attempts to the current URL, wrapping around to
+	// WSURL. While connected to one of them, WSURL is dialed every
+	// WSFailbackInterval and used again once it answers; 0 only fails back
+	// by wrapping around.
+	WSFailoverURLs     []string
+	WSFailoverAfter    int
+	WSFailbackInterval time.Duration
+	WSToken            string
+	WSHeaders          http.Header
+	WSTLSCA            string
+	// WSInsecureSkipVerify disables verification of the WebSocket server's
+	// certificate. It is meant for local testing only.
+	WSInsecureSkipVerify bool
+	// Subscriptions, if set, replace WSURL, WSFailoverURLs and
+	// HelloMessage with one connection per subscription. If nil and
+	// SubscriptionsPath is set, they are loaded from that file.
+	Subscriptions     []Subscription
+	SubscriptionsPath string
+	// HelloMessage, if set, is sent as a text frame right after each
+	// connection is established, before any message is read. It must be
+	// valid JSON.
+	HelloMessage string
+	// AdvertiseVersions adds the supported schema versions to a hello
+	// message that is a JSON object.
+	AdvertiseVersions bool
+	// SendAcks writes an ack back to the source of every processed
+	// command. With it off the client is fire and forget: the webhook is
+	// still notified, but the server hears nothing back.
+	SendAcks bool
+	// WSCompression offers the permessage-deflate extension when dialing.
+	// Servers that do not accept it get uncompressed frames.
+	// WSCompressionLevel is the flate level for outgoing messages, from
+	// flate.HuffmanOnly (-2) to flate.BestCompression (9).
+	WSCompression      bool
+	WSCompressionLevel int
+	// WSConnectTimeout bounds the TCP connect to the WebSocket server (or
+	// its proxy), and WSHandshakeTimeout the whole dial including TLS and
+	// the upgrade.
+	WSConnectTimeout   time.Duration
+	WSHandshakeTimeout time.Duration
+	// WSReadBufferSize and WSWriteBufferSize size the connection's I/O
+	// buffers. Messages larger than a buffer still work, in several
+	// reads or writes.
+	WSReadBufferSize  int
+	WSWriteBufferSize int
+	// UserAgent is sent on device API requests and the WebSocket handshake
+	// unless APIHeaders or WSHeaders set one. Empty means DefaultUserAgent.
+	UserAgent     string
+	APIBaseURL    string
+	APIHeaders    http.Header
+	APIRoutesPath string
+	// DeviceGroupsPath is read into DeviceGroups if that is nil.
+	DeviceGroupsPath string
+	// ShadowAPIBaseURL, if set, mirrors every command to a second device
+	// API on a best-effort basis, logging responses whose status differs
+	// from the one of APIBaseURL. Only APIBaseURL's response counts.
+	ShadowAPIBaseURL string
+	// APIPath is a text/template for the device API path of a command,
+	// rendered with .DeviceID, .Mode (both path-escaped) and .TurnOn.
+	// Empty means DefaultAPIPath.
+	APIPath    string
+	APITLSCert string
+	APITLSKey  string
+	APITLSCA   string
+	// APIQuery sends the command fields as query parameters. APIBody
+	// additionally or instead sends them in the request body: BodyNone,
+	// BodyJSON or BodyForm. APIBodyFields renames body fields, keyed by
+	// their JSON name; "-" leaves a field out.
+	APIQuery bool
+	APIBody  string
+	// APIBoolFormat spells turnOn in the query string and form bodies:
+	// BoolTrueFalse, BoolOneZero or BoolOnOff, to match the device
+	// firmware.
+	APIBoolFormat string
+	APIBodyFields map[string]string
+	// APISuccessStatuses lists the device API response statuses that count
+	// as success. Empty means any 2xx.
+	APISuccessStatuses []int
+	// APIFollowRedirects follows 3xx responses from the device API. When
+	// false they are returned as is, and fail unless listed in
+	// APISuccessStatuses.
+	APIFollowRedirects bool
+	// APIMethod is the HTTP method for device API requests, and
+	// APIModeMethods overrides it for specific modes. Batch requests are
+	// always POSTs.
+	APIMethod      string
+	APIModeMethods map[string]string
+	// Proxy is an http:// or socks5:// URL that all device API and
+	// WebSocket connections go through. Empty means HTTP_PROXY,
+	// HTTPS_PROXY and NO_PROXY from the environment are honored.
+	Proxy  string
+	DryRun bool
+	// Preflight checks the device API before Run connects: PreflightOff,
+	// PreflightWarn to log failures, or PreflightFail to return them.
+	Preflight         string
+	PreflightPath     string
+	AckState          bool
+	KeepAliveInterval time.Duration
+	KeepAliveJitter   int
+	// PingWriteTimeout bounds each keepalive ping write. A ping that cannot
+	// be written in time closes the connection.
+	PingWriteTimeout time.Duration
+	ReadTimeout      time.Duration
+	// StrictPing extends the read deadline on pongs only. By default every
+	// message read from the server extends it too.
+	StrictPing bool
+	// IdleTimeout reconnects when no message, as opposed to a pong, has
+	// arrived for this long. 0 disables the watchdog.
+	IdleTimeout       time.Duration
+	MaxMessageSize    int
+	BackoffBase       time.Duration
+	BackoffMax        time.Duration
+	BackoffResetAfter time.Duration
+	// DNSBackoffBase and DNSBackoffMax replace BackoffBase and BackoffMax
+	// for dials that fail on DNS lookups or an unreachable network.
+	DNSBackoffBase time.Duration
+	DNSBackoffMax  time.Duration
+	// MaxConnectFailures makes Run give up with ErrConnectGaveUp after this
+	// many consecutive failed connection attempts. 0 retries forever.
+	MaxConnectFailures int
+	// ConnectLogInterval collapses repeated identical connection
+	// failures into one summary line per interval. 0 logs every failure.
+	ConnectLogInterval time.Duration
+	HTTPTimeout        time.Duration
+	// HTTPModeTimeouts overrides HTTPTimeout for specific modes, and a
+	// command's own timeout_ms overrides both. Command timeouts are clamped
+	// to HTTPMaxTimeout.
+	HTTPModeTimeouts map[string]time.Duration
+	HTTPMaxTimeout   time.Duration
+	HTTPMaxIdleConns int
+	HTTPMaxInFlight  int
+	HTTPMaxAttempts  int
+	HTTPRetryBase    time.Duration
+	HTTPRetryMax     time.Duration
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+	RateLimit        float64
+	RateBurst        int
+	AllowedModes     []string
+	ExtendedModes    []string
+	ModePriorities   map[string]int
+	DeviceAllow      []string
+	DeviceDeny       []string
+	WebhookURL       string
+	WebhookTimeout   time.Duration
+	Workers          int
+	WorkerQueueSize  int
+	DrainTimeout     time.Duration
+	DedupWindow      time.Duration
+	// ModeSettleTimes holds the next command for a device back until this
+	// long after a command in the given mode succeeded for it.
+	ModeSettleTimes map[string]time.Duration
+	// CoalesceInFlight makes identical commands that are sent at the same
+	// time, for example a live command and its replay, share one device API
+	// call and result.
+	CoalesceInFlight bool
+	BatchWindow      time.Duration
+	BatchMaxSize     int
+	BatchPath        string
+	QueuePath        string
+	QueueMaxSize     int
+	QueueReplay      time.Duration
+	// QueueFlushTimeout is how long Run keeps sending pending and queued
+	// commands after its context is cancelled, when the queue is enabled.
+	// Whatever is left is persisted for the next start. 0 persists them
+	// right away.
+	QueueFlushTimeout time.Duration
+
+	// ReplayPath replays newline-delimited JSON commands from a file instead
+	// of connecting to the WebSocket server; Run returns once they have all
+	// been processed. ReplayTiming waits between commands as long as their
+	// recorded_at timestamps are apart.
+	ReplayPath   string
+	ReplayTiming bool
+
+	// RecordPath appends every received command, with a recorded_at
+	// timestamp, to a JSON-lines file that ReplayPath can read back. When
+	// RecordMaxSize (bytes) is positive the file is rotated to RecordPath
+	// + ".1" once it would grow beyond that.
+	RecordPath    string
+	RecordMaxSize int
+
+	// APIRoutes sends some devices to other gateways than APIBaseURL. If nil
+	// and APIRoutesPath is set, the routes are loaded from that file.
+	APIRoutes []APIRoute
+
+	// DeviceGroups maps group names to device IDs. A command for
+	// GroupPrefix + name, or for AllDevices, is dispatched once per member.
+	// Commands for unknown groups are skipped.
+	DeviceGroups map[string][]string
+
+	// Transforms rewrite every received command, in order, before it is
+	// validated, filtered and dispatched.
+	Transforms []Transform
+
+	// Queue stores undeliverable commands for replay. If nil and QueuePath
+	// is set, a file-backed queue is opened at QueuePath.
+	Queue Queue
+
+	// Logger receives all log output. Nil means slog.Default().
+	Logger *slog.Logger
+
+	// HTTPDoer sends device API requests. Nil means an *http.Client built
+	// from the HTTP settings above.
+	HTTPDoer HTTPDoer
+
+	// Dialer opens the WebSocket connection. Nil means
+	// websocket.DefaultDialer, adjusted by the WS timeouts, WSTLSCA,
+	// WSInsecureSkipVerify, Proxy and WSCompression.
+	Dialer Dialer
+
+	// Sink acts on commands. Nil means Executor if set, the program at
+	// ExecCommand, NATS if NATSURL is set, or else the device API at
+	// APIBaseURL.
+	Sink Sink
+	// Executor acts on commands when nothing but success matters.
+	Executor Executor
+	// ExecCommand, if set, runs this program for every command instead of
+	// calling the device API. See ExecExecutor.
+	ExecCommand string
+
+	// NATSURL, if set, publishes every command as JSON to NATSSubject on
+	// this NATS server instead of calling the device API.
+	NATSURL     string
+	NATSSubject string
+
+	// Source delivers commands. Nil means the WebSocket connection
+	// described by the WS settings above.
+	Source CommandSource
+
+	// TracerProvider, if set, traces each command from receipt to
+	// completion and propagates the trace to the device API as a W3C
+	// traceparent header. Nil disables tracing.
+	TracerProvider trace.TracerProvider
+}
+
+// DefaultConfig returns the settings the connector uses when nothing is
+// overridden.
+func DefaultConfig() Config {
+	return Config{
+		WSURL:              defaultWSURL,
+		WSHeaders:          http.Header{},
+		APIBaseURL:         defaultAPIBaseURL,
+		WSFailoverAfter:    defaultWSFailoverAfter,
+		WSFailbackInterval: defaultWSFailbackInterval,
+		WSCompressionLevel: defaultWSCompressionLevel,
+		WSConnectTimeout:   defaultWSConnectTimeout,
+		WSHandshakeTimeout: defaultWSHandshakeTimeout,
+		WSReadBufferSize:   defaultWSBufferSize,
+		WSWriteBufferSize:  defaultWSBufferSize,
+		AdvertiseVersions:  true,
+		SendAcks:           true,
+		NATSSubject:        defaultNATSSubject,
+		APIHeaders:         http.Header{},
+		APIFollowRedirects: true,
+		APIMethod:          http.MethodPost,
+		APIPath:            DefaultAPIPath,
+		APIQuery:           true,
+		APIBody:            BodyNone,
+		APIBoolFormat:      BoolTrueFalse,
+		Preflight:          PreflightOff,
+		PreflightPath:      defaultPreflightPath,
+		KeepAliveInterval:  defaultKeepAliveInterval,
+		PingWriteTimeout:   defaultPingWriteTimeout,
+		ReadTimeout:        defaultReadTimeout,
+		MaxMessageSize:     defaultMaxMessageSize,
+		BackoffBase:        defaultBackoffBase,
+		BackoffMax:         defaultBackoffMax,
+		BackoffResetAfter:  defaultBackoffResetAfter,
+		DNSBackoffBase:     defaultDNSBackoffBase,
+		DNSBackoffMax:      defaultDNSBackoffMax,
+		ConnectLogInterval: defaultConnectLogInterval,
+		HTTPTimeout:        defaultHTTPTimeout,
+		HTTPMaxTimeout:     defaultHTTPMaxTimeout,
+		HTTPMaxIdleConns:   defaultHTTPMaxIdleConns,
+		HTTPMaxAttempts:    defaultHTTPMaxAttempts,
+		HTTPRetryBase:      defaultHTTPRetryBase,
+		HTTPRetryMax:       defaultHTTPRetryMax,
+		BreakerCooldown:    defaultBreakerCooldown,
+		RateBurst:          defaultRateBurst,
+		WebhookTimeout:     defaultWebhookTimeout,
+		Workers:            defaultWorkers,
+		WorkerQueueSize:    defaultWorkerQueueSize,
+		DrainTimeout:       defaultDrainTimeout,
+		QueueMaxSize:       defaultQueueMaxSize,
+		QueueReplay:        defaultQueueReplay,
+		QueueFlushTimeout:  defaultQueueFlushTimeout,
+		BatchMaxSize:       defaultBatchMaxSize,
+		BatchPath:          DefaultBatchPath,
+	}
+}
+
+// Validate reports the first setting that is missing or out of range.
+func (c Config) Validate() error {
+	if c.Source == nil && c.ReplayPath == "" && c.Subscriptions == nil && c.SubscriptionsPath == "" {
+		if err := validateURL("ws-url", c.WSURL, "ws", "wss"); err != nil {
+			return err
+		}
+		for _, u := range c.WSFailoverURLs {
+			if err := validateURL("ws-failover-url", u, "ws", "wss"); err != nil {
+				return err
+			}
+		}
+	}
+	if c.WSFailoverAfter < 1 {
+		return fmt.Errorf("ws-failover-after must be at least 1, got %d", c.WSFailoverAfter)
+	}
+	if c.WSFailbackInterval < 0 {
+		return fmt.Errorf("ws-failback-interval must not be negative, got %s", c.WSFailbackInterval)
+	}
+	if c.HelloMessage != "" && !json.Valid([]byte(c.HelloMessage)) {
+		return errors.New("hello-message must be valid JSON")
+	}
+	if c.AckState && !c.SendAcks {
+		return errors.New("ack-state requires send-acks")
+	}
+	if c.WSCompressionLevel < flate.HuffmanOnly || c.WSCompressionLevel > flate.BestCompression {
+		return fmt.Errorf("ws-compression-level must be between %d and %d, got %d", flate.HuffmanOnly, flate.BestCompression, c.WSCompressionLevel)
+	}
+	if c.WSConnectTimeout <= 0 {
+		return fmt.Errorf("ws-connect-timeout must be positive, got %s", c.WSConnectTimeout)
+	}
+	if c.WSHandshakeTimeout < c.WSConnectTimeout {
+		return fmt.Errorf("ws-handshake-timeout (%s) must not be less than ws-connect-timeout (%s)", c.WSHandshakeTimeout, c.WSConnectTimeout)
+	}
+	if c.WSReadBufferSize <= 0 {
+		return fmt.Errorf("ws-read-buffer-size must be positive, got %d", c.WSReadBufferSize)
+	}
+	if c.WSWriteBufferSize <= 0 {
+		return fmt.Errorf("ws-write-buffer-size must be positive, got %d", c.WSWriteBufferSize)
+	}
+	if err := validateURL("api-base-url", c.APIBaseURL, "http", "https"); err != nil {
+		return err
+	}
+	if c.ShadowAPIBaseURL != "" {
+		if err := validateURL("api-shadow-url", c.ShadowAPIBaseURL, "http", "https"); err != nil {
+			return err
+		}
+		if c.Sink != nil || c.Executor != nil || c.ExecCommand != "" || c.NATSURL != "" || c.BatchWindow > 0 {
+			return errors.New("api-shadow-url only works with single device API requests, not with nats-url, exec-command, batch-window or a custom Sink")
+		}
+	}
+	if c.APIPath != "" {
+		if _, err := parseAPIPath(c.APIPath); err != nil {
+			return err
+		}
+	}
+	if c.NATSURL != "" {
+		if err := validateURL("nats-url", c.NATSURL, "nats", "tls"); err != nil {
+			return err
+		}
+		if c.NATSSubject == "" || strings.ContainsAny(c.NATSSubject, " \t\r\n") {
+			return fmt.Errorf("nats-subject must be a non-empty subject without whitespace, got %q", c.NATSSubject)
+		}
+	}
+	var sinks []string
+	for name, set := range map[string]bool{"Sink": c.Sink != nil, "Executor": c.Executor != nil, "exec-command": c.ExecCommand != "", "nats-url": c.NATSURL != ""} {
+		if set {
+			sinks = append(sinks, name)
+		}
+	}
+	if len(sinks) > 1 {
+		slices.Sort(sinks)
+		return fmt.Errorf("only one of Sink, Executor, exec-command and nats-url can be set, got %s", strings.Join(sinks, " and "))
+	}
+	if len(sinks) > 0 && c.BatchWindow > 0 {
+		return errors.New("batch-window only works with the device API, not with nats-url, exec-command or a custom Sink")
+	}
+	if c.WebhookURL != "" {
+		if err := validateURL("webhook-url", c.WebhookURL, "http", "https"); err != nil {
+			return err
+		}
+		if c.WebhookTimeout <= 0 {
+			return fmt.Errorf("webhook-timeout must be positive, got %s", c.WebhookTimeout)
+		}
+	}
+	switch c.APIBody {
+	case BodyNone, BodyJSON, BodyForm:
+	default:
+		return fmt.Errorf("api-body must be none, json or form, got %q", c.APIBody)
+	}
+	switch c.APIBoolFormat {
+	case BoolTrueFalse, BoolOneZero, BoolOnOff:
+	default:
+		return fmt.Errorf("api-bool-format must be true/false, 1/0 or on/off, got %q", c.APIBoolFormat)
+	}
+	for field := range c.APIBodyFields {
+		if !slices.Contains(bodyFieldNames, field) {
+			return fmt.Errorf("api-body-field %q is not one of %v", field, bodyFieldNames)
+		}
+	}
+	if !c.APIQuery && c.APIBody == BodyNone {
+		return errors.New("api-query=false requires api-body to be json or form")
+	}
+	if err := validateMethod("api-method", c.APIMethod); err != nil {
+		return err
+	}
+	for mode, method := range c.APIModeMethods {
+		if err := validateMethod("mode-method for "+mode, method); err != nil {
+			return err
+		}
+	}
+	for _, code := range c.APISuccessStatuses {
+		if code < 100 || code > 599 {
+			return fmt.Errorf("api-success-status must be between 100 and 599, got %d", code)
+		}
+	}
+	if c.Proxy != "" {
+		if err := validateURL("proxy", c.Proxy, "http", "socks5"); err != nil {
+			return err
+		}
+	}
+	switch c.Preflight {
+	case PreflightOff, PreflightWarn, PreflightFail:
+	default:
+		return fmt.Errorf("preflight must be off, warn or fail, got %q", c.Preflight)
+	}
+	if c.Preflight != PreflightOff && !strings.HasPrefix(c.PreflightPath, "/") {
+		return fmt.Errorf("preflight-path must start with /, got %q", c.PreflightPath)
+	}
+	if (c.APITLSCert == "") != (c.APITLSKey == "") {
+		return errors.New("api-tls-cert and api-tls-key must be set together")
+	}
+	if err := validatePatterns("device-allow", c.DeviceAllow); err != nil {
+		return err
+	}
+	if err := validatePatterns("device-deny", c.DeviceDeny); err != nil {
+		return err
+	}
+	if err := validateSubscriptions(c.Subscriptions); err != nil {
+		return err
+	}
+	if err := validateAPIRoutes(c.APIRoutes); err != nil {
+		return fmt.Errorf("invalid api routes: %w", err)
+	}
+	if err := validateDeviceGroups(c.DeviceGroups); err != nil {
+		return fmt.Errorf("invalid device groups: %w", err)
+	}
+	if c.KeepAliveInterval <= 0 {
+		return fmt.Errorf("keepalive-interval must be positive, got %s", c.KeepAliveInterval)
+	}
+	if c.ReadTimeout <= 0 {
+		return fmt.Errorf("read-timeout must be positive, got %s", c.ReadTimeout)
+	}
+	// A pong can only refresh the read deadline if a ping goes out well
+	// before it expires, even when one ping or pong is delayed.
+	if c.KeepAliveInterval*3 > c.ReadTimeout {
+		return fmt.Errorf("keepalive-interval (%s) must be at most one third of read-timeout (%s)", c.KeepAliveInterval, c.ReadTimeout)
+	}
+	if c.KeepAliveJitter < 0 || c.KeepAliveJitter > maxKeepAliveJitter {
+		return fmt.Errorf("keepalive-jitter must be between 0 and %d percent, got %d", maxKeepAliveJitter, c.KeepAliveJitter)
+	}
+	if c.PingWriteTimeout <= 0 {
+		return fmt.Errorf("ping-write-timeout must be positive, got %s", c.PingWriteTimeout)
+	}
+	if c.IdleTimeout < 0 {
+		return fmt.Errorf("idle-timeout must not be negative, got %s", c.IdleTimeout)
+	}
+	if c.MaxMessageSize < 1 {
+		return fmt.Errorf("max-message-size must be at least 1 byte, got %d", c.MaxMessageSize)
+	}
+	if c.BackoffBase <= 0 {
+		return fmt.Errorf("backoff-base must be positive, got %s", c.BackoffBase)
+	}
+	if c.BackoffMax < c.BackoffBase {
+		return fmt.Errorf("backoff-max (%s) must not be less than backoff-base (%s)", c.BackoffMax, c.BackoffBase)
+	}
+	if c.DNSBackoffBase <= 0 {
+		return fmt.Errorf("dns-backoff-base must be positive, got %s", c.DNSBackoffBase)
+	}
+	if c.DNSBackoffMax < c.DNSBackoffBase {
+		return fmt.Errorf("dns-backoff-max (%s) must not be less than dns-backoff-base (%s)", c.DNSBackoffMax, c.DNSBackoffBase)
+	}
+	if c.MaxConnectFailures < 0 {
+		return fmt.Errorf("max-connect-failures must not be negative, got %d", c.MaxConnectFailures)
+	}
+	if c.ConnectLogInterval < 0 {
+		return fmt.Errorf("connect-log-interval must not be negative, got %s", c.ConnectLogInterval)
+	}
+	if c.HTTPTimeout <= 0 {
+		return fmt.Errorf("http-timeout must be positive, got %s", c.HTTPTimeout)
+	}
+	if c.HTTPMaxTimeout < c.HTTPTimeout {
+		return fmt.Errorf("http-max-timeout (%s) must not be less than http-timeout (%s)", c.HTTPMaxTimeout, c.HTTPTimeout)
+	}
+	for mode, d := range c.HTTPModeTimeouts {
+		if d <= 0 || d > c.HTTPMaxTimeout {
+			return fmt.Errorf("mode-timeout for %s must be positive and at most http-max-timeout (%s), got %s", mode, c.HTTPMaxTimeout, d)
+		}
+	}
+	if c.HTTPMaxIdleConns < 0 {
+		return fmt.Errorf("http-max-idle-conns must not be negative, got %d", c.HTTPMaxIdleConns)
+	}
+	if c.HTTPMaxInFlight < 0 {
+		return fmt.Errorf("http-max-in-flight must not be negative, got %d", c.HTTPMaxInFlight)
+	}
+	if c.HTTPMaxAttempts < 1 {
+		return fmt.Errorf("http-max-attempts must be at least 1, got %d", c.HTTPMaxAttempts)
+	}
+	if c.HTTPRetryBase <= 0 {
+		return fmt.Errorf("http-retry-base must be positive, got %s", c.HTTPRetryBase)
+	}
+	if c.HTTPRetryMax < c.HTTPRetryBase {
+		return fmt.Errorf("http-retry-max (%s) must not be less than http-retry-base (%s)", c.HTTPRetryMax, c.HTTPRetryBase)
+	}
+	if c.BreakerThreshold < 0 {
+		return fmt.Errorf("breaker-threshold must not be negative, got %d", c.BreakerThreshold)
+	}
+	if c.BreakerThreshold > 0 && c.BreakerCooldown <= 0 {
+		return fmt.Errorf("breaker-cooldown must be positive, got %s", c.BreakerCooldown)
+	}
+	if c.RateLimit < 0 {
+		return fmt.Errorf("rate-limit must not be negative, got %g", c.RateLimit)
+	}
+	if c.RateLimit > 0 && c.RateBurst < 1 {
+		return fmt.Errorf("rate-burst must be at least 1, got %d", c.RateBurst)
+	}
+	if c.Workers < 1 || c.Workers > maxWorkers {
+		return fmt.Errorf("workers must be between 1 and %d, got %d", maxWorkers, c.Workers)
+	}
+	if c.WorkerQueueSize < 0 {
+		return fmt.Errorf("worker-queue-size must not be negative, got %d", c.WorkerQueueSize)
+	}
+	if c.DrainTimeout <= 0 {
+		return fmt.Errorf("drain-timeout must be positive, got %s", c.DrainTimeout)
+	}
+	if c.DedupWindow < 0 {
+		return fmt.Errorf("dedup-window must not be negative, got %s", c.DedupWindow)
+	}
+	if c.BatchWindow < 0 {
+		return fmt.Errorf("batch-window must not be negative, got %s", c.BatchWindow)
+	}
+	for mode, d := range c.ModeSettleTimes {
+		if d <= 0 {
+			return fmt.Errorf("mode-settle for %s must be positive, got %s", mode, d)
+		}
+	}
+	if len(c.ModeSettleTimes) > 0 && c.BatchWindow > 0 {
+		return errors.New("mode-settle cannot be combined with batch-window")
+	}
+	if c.BatchMaxSize < 1 {
+		return fmt.Errorf("batch-max-size must be at least 1, got %d", c.BatchMaxSize)
+	}
+	if c.BatchPath != "" && !strings.HasPrefix(c.BatchPath, "/") {
+		return fmt.Errorf("batch-path must start with /, got %q", c.BatchPath)
+	}
+	if c.RecordMaxSize < 0 {
+		return fmt.Errorf("record-max-size must not be negative, got %d", c.RecordMaxSize)
+	}
+	if c.QueueMaxSize < 1 {
+		return fmt.Errorf("queue-max-size must be at least 1, got %d", c.QueueMaxSize)
+	}
+	if c.QueueReplay <= 0 {
+		return fmt.Errorf("queue-replay-interval must be positive, got %s", c.QueueReplay)
+	}
+	if c.QueueFlushTimeout < 0 {
+		return fmt.Errorf("queue-flush-timeout must not be negative, got %s", c.QueueFlushTimeout)
+	}
+	return nil
+}
+
+func validateMethod(name, method string) error {
+	switch method {
+	case http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		return nil
+	}
+	return fmt.Errorf("%s must be GET, POST, PUT, PATCH or DELETE, got %q", name, method)
+}
+
+func validateURL(name, raw string, schemes ...string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return fmt.Errorf("invalid %s %q: %w", name, raw, err)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("invalid %s %q: missing host", name, raw)
+	}
+	for _, s := range schemes {
+		if u.Scheme == s {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid %s %q: scheme must be one of %v", name, raw, schemes)
+}
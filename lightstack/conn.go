@@ -0,0 +1,588 @@
+package lightstack
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// safeConn serializes writes to a WebSocket connection. gorilla/websocket
+// supports one concurrent reader and one concurrent writer, so every goroutine
+// that writes must go through these methods. Reads are passed through.
+type safeConn struct {
+	*websocket.Conn
+	mu sync.Mutex
+	// writeErr is set by failWrite before it closes the connection.
+	writeErr atomic.Pointer[error]
+}
+
+func newSafeConn(conn *websocket.Conn) *safeConn {
+	return &safeConn{Conn: conn}
+}
+
+func (c *safeConn) WriteMessage(messageType int, data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Conn.WriteMessage(messageType, data)
+}
+
+func (c *safeConn) WriteJSON(v any) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Conn.WriteJSON(v)
+}
+
+// WriteControl does not take the lock: gorilla/websocket allows it
+// concurrently with other writes, and it must not wait past its deadline
+// behind a stalled one.
+func (c *safeConn) WriteControl(messageType int, data []byte, deadline time.Time) error {
+	return c.Conn.WriteControl(messageType, data, deadline)
+}
+
+// failWrite records that writing to the connection failed and closes it,
+// so that a read blocked on the dead connection returns right away.
+func (c *safeConn) failWrite(err error) {
+	c.writeErr.CompareAndSwap(nil, &err)
+	c.Conn.Close()
+}
+
+// writeFailure returns the error recorded by failWrite, if any.
+func (c *safeConn) writeFailure() error {
+	if err := c.writeErr.Load(); err != nil {
+		return *err
+	}
+	return nil
+}
+
+// sendClose writes a close frame with the given code, waiting at most
+// closeGracePeriod for the write to complete.
+func (c *safeConn) sendClose(code int, text string) error {
+	msg := websocket.FormatCloseMessage(code, text)
+	return c.WriteControl(websocket.CloseMessage, msg, time.Now().Add(closeGracePeriod))
+}
+
+// newWSDialer returns a copy of websocket.DefaultDialer with the configured
+// timeouts, proxy and compression, using the configured CA bundle or
+// skipping certificate verification.
+func newWSDialer(cfg Config) (*websocket.Dialer, error) {
+	d := *websocket.DefaultDialer
+	d.HandshakeTimeout = cfg.WSHandshakeTimeout
+	d.NetDialContext = (&net.Dialer{Timeout: cfg.WSConnectTimeout}).DialContext
+	d.Proxy = proxyFunc(cfg)
+	d.EnableCompression = cfg.WSCompression
+	d.ReadBufferSize = cfg.WSReadBufferSize
+	d.WriteBufferSize = cfg.WSWriteBufferSize
+	if cfg.WSTLSCA == "" && !cfg.WSInsecureSkipVerify {
+		return &d, nil
+	}
+
+	tlsConfig, err := loadTLSConfig("", "", cfg.WSTLSCA)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	tlsConfig.InsecureSkipVerify = cfg.WSInsecureSkipVerify
+	d.TLSClientConfig = tlsConfig
+	return &d, nil
+}
+
+// wsSource is the default CommandSource: it keeps a WebSocket connection to
+// the command server open, reconnecting with backoff, and writes acks back
+// on the current connection.
+type wsSource struct {
+	client *Client
+	// sub is what this connection subscribes to. For the default source it
+	// is built from WSURL and HelloMessage, with failover to failoverURLs.
+	sub          Subscription
+	failoverURLs []string
+	filter       deviceFilter
+	log          *slog.Logger
+	conn         atomic.Pointer[safeConn]
+	connected    atomic.Bool
+}
+
+func newWSSource(client *Client) *wsSource {
+	return &wsSource{
+		client:       client,
+		sub:          Subscription{URL: client.cfg.WSURL, HelloMessage: client.cfg.HelloMessage},
+		failoverURLs: client.cfg.WSFailoverURLs,
+		log:          client.log,
+	}
+}
+
+// urls lists the endpoints to dial, primary first.
+func (s *wsSource) urls() []string {
+	return append([]string{s.sub.URL}, s.failoverURLs...)
+}
+
+// Permits reports whether the subscription's device filter lets deviceID
+// through. A nil *wsSource permits every device.
+func (s *wsSource) Permits(deviceID string) bool {
+	return s == nil || s.filter.Permits(deviceID)
+}
+
+// emit publishes a state change of this connection.
+func (s *wsSource) emit(state State, err error, retryIn time.Duration) {
+	s.client.emit(StateEvent{State: state, Subscription: s.sub.Name, Err: err, RetryIn: retryIn})
+}
+
+// Connected reports whether the WebSocket connection is currently up.
+func (s *wsSource) Connected() bool {
+	return s.connected.Load()
+}
+
+// Ack writes ack on the current connection.
+func (s *wsSource) Ack(ack Ack) error {
+	conn := s.conn.Load()
+	if conn == nil {
+		return ErrNotConnected
+	}
+	return conn.WriteJSON(ack)
+}
+
+func (s *wsSource) Run(ctx context.Context, out chan<- Command) error {
+	c := s.client
+	clock := c.clock
+	eps := newEndpoints(c.cfg, s.urls(), clock.jitter)
+	failures := 0
+	failLog := connectFailureLog{interval: c.cfg.ConnectLogInterval}
+	dnsBackoff := newBackoff(c.cfg.DNSBackoffBase, c.cfg.DNSBackoffMax)
+	dnsBackoff.rand = clock.jitter
+	// failback is a connection to the primary endpoint opened by the
+	// failback probe, used instead of dialing on the next attempt.
+	var failback *websocket.Conn
+	var failbackResp *http.Response
+
+	for ctx.Err() == nil {
+		wsURL := eps.URL()
+		level := slog.LevelInfo
+		if failLog.Failing() {
+			level = slog.LevelDebug
+		}
+		s.log.Log(ctx, level, "Attempting to connect to WebSocket server", "event", "ws_connecting", "url", redactURL(wsURL), "endpoint", eps.Name())
+		s.emit(StateConnecting, nil, 0)
+
+		wsConn, resp, err := failback, failbackResp, error(nil)
+		failback, failbackResp = nil, nil
+		if wsConn == nil {
+			wsConn, resp, err = c.dialer.DialContext(ctx, wsURL, c.header)
+		}
+		if err == nil && c.cfg.WSCompression {
+			s.configureCompression(wsConn, resp)
+		}
+		if err == nil && s.sub.HelloMessage != "" {
+			if err = s.sendHello(wsConn); err != nil {
+				wsConn.Close()
+			}
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			err = fmt.Errorf("%w: %w", ErrDial, err)
+			failures++
+			if limit := c.cfg.MaxConnectFailures; limit > 0 && failures >= limit {
+				s.log.Error("Too many failed connection attempts, giving up", "event", "ws_gave_up", "attempts", failures, "error", err)
+				s.emit(StateDisconnected, err, 0)
+				return fmt.Errorf("%w after %d consecutive failed attempts: %w", ErrConnectGaveUp, failures, err)
+			}
+			reconnects.Inc()
+			c.stats.reconnects.Add(1)
+			switched := eps.Failed()
+			// A Retry-After only applies to the server that sent it, so it
+			// is ignored when failing over to another endpoint.
+			category := dialErrorCategory(err)
+			delay, suggested := retryAfter(resp, clock.now())
+			switch {
+			case suggested && !switched:
+				if delay > maxRetryAfter {
+					delay = maxRetryAfter
+				}
+				s.log.Warn("Server asked to retry later", "event", "ws_retry_after", "status", resp.StatusCode, "retry_after", resp.Header.Get("Retry-After"), "retry_in", delay)
+			case transientDialError(category):
+				delay = dnsBackoff.Next()
+			default:
+				delay = eps.Backoff().Next()
+			}
+			now := clock.now()
+			switch failLog.Failed(err, now) {
+			case connectLogFull:
+				s.log.Warn("Failed to connect to WebSocket", "event", "ws_connect_failed", "category", category, "error", err, "retry_in", delay)
+			case connectLogSummary:
+				s.log.Warn("Still failing to connect to WebSocket", "event", "ws_connect_failing", "attempts", failLog.attempts, "failing_for", now.Sub(failLog.since).Round(time.Second), "category", category, "error", err, "retry_in", delay)
+			default:
+				s.log.Debug("Failed to connect to WebSocket", "event", "ws_connect_failed", "category", category, "error", err, "retry_in", delay)
+			}
+			if switched {
+				s.log.Warn("Failing over to the next WebSocket endpoint", "event", "ws_failover", "from", redactURL(wsURL), "to", redactURL(eps.URL()), "endpoint", eps.Name())
+			}
+			s.emit(StateReconnecting, err, delay)
+			clock.sleep(ctx, delay)
+			continue
+		}
+
+		if attempts, outage := failLog.Recovered(clock.now()); attempts > 0 {
+			s.log.Info("Connected to WebSocket server", "event", "ws_connected", "url", redactURL(wsURL), "endpoint", eps.Name(), "failed_attempts", attempts, "outage", outage.Round(time.Millisecond))
+		} else {
+			s.log.Info("Connected to WebSocket server", "event", "ws_connected", "url", redactURL(wsURL), "endpoint", eps.Name())
+		}
+		failures = 0
+		dnsBackoff.Reset()
+		eps.Connected()
+		conn := newSafeConn(wsConn)
+		s.conn.Store(conn)
+		s.connected.Store(true)
+		s.emit(StateConnected, nil, 0)
+		c.replay.Kick()
+		connectedAt := clock.now()
+
+		done := make(chan struct{})
+		go s.keepAlive(ctx, conn, done)
+		var probe *failbackProbe
+		if !eps.OnPrimary() {
+			probe = s.startFailbackProbe(ctx, conn, eps.Primary(), done)
+		}
+
+		err = s.handleMessages(ctx, conn, done, out)
+		s.connected.Store(false)
+		s.conn.Store(nil)
+		if probe != nil {
+			failback, failbackResp = probe.Take()
+		}
+		if ctx.Err() != nil {
+			if failback != nil {
+				failback.Close()
+			}
+			s.emit(StateDisconnected, nil, 0)
+			break
+		}
+		if failback != nil {
+			wsDisconnects.WithLabelValues("failback").Inc()
+			s.log.Info("Primary WebSocket endpoint is back, failing back", "event", "ws_failback", "from", redactURL(wsURL), "to", redactURL(eps.Primary()))
+			eps.Failback()
+			s.emit(StateDisconnected, nil, 0)
+			continue
+		}
+		if errors.Is(err, websocket.ErrReadLimit) {
+			s.log.Error("Server sent a message over the size limit", "event", "ws_message_too_large", "max_message_size", c.cfg.MaxMessageSize)
+		}
+		switch {
+		case errors.Is(err, ErrIdleTimeout):
+			wsDisconnects.WithLabelValues("idle").Inc()
+			s.log.Warn("No messages from the server, reconnecting", "event", "ws_idle_timeout", "idle_timeout", c.cfg.IdleTimeout)
+		case errors.Is(err, ErrWrite):
+			wsDisconnects.WithLabelValues("write").Inc()
+			s.log.Warn("Connection can no longer be written to, reconnecting", "event", "ws_write_failed", "error", err)
+		case normalClosure(err):
+			wsDisconnects.WithLabelValues("normal").Inc()
+			s.log.Info("Server closed the connection", "event", "ws_closed", "error", err)
+		default:
+			wsDisconnects.WithLabelValues("error").Inc()
+			s.log.Error("Connection lost", "event", "ws_connection_lost", "error", err)
+		}
+		s.emit(StateDisconnected, err, 0)
+
+		bo := eps.Backoff()
+		if clock.now().Sub(connectedAt) >= c.cfg.BackoffResetAfter {
+			bo.Reset()
+		}
+
+		reconnects.Inc()
+		c.stats.reconnects.Add(1)
+		delay := bo.Next()
+		s.log.Info("Disconnected, reconnecting", "event", "ws_disconnected", "retry_in", delay)
+		s.emit(StateReconnecting, err, delay)
+		clock.sleep(ctx, delay)
+	}
+	return nil
+}
+
+// maxRetryAfter caps the reconnect delay a server can ask for, so a bogus
+// Retry-After cannot park the connector indefinitely.
+const maxRetryAfter = 10 * time.Minute
+
+// retryAfter returns the delay suggested by the Retry-After header of a 429
+// or 503 handshake response, given either in seconds or as an HTTP date.
+func retryAfter(resp *http.Response, now time.Time) (time.Duration, bool) {
+	if resp == nil || (resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable) {
+		return 0, false
+	}
+	v := strings.TrimSpace(resp.Header.Get("Retry-After"))
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		if secs < 0 {
+			return 0, false
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+	t, err := http.ParseTime(v)
+	if err != nil {
+		return 0, false
+	}
+	return max(t.Sub(now), 0), true
+}
+
+// configureCompression applies the compression level to a new connection
+// if the server accepted permessage-deflate. Otherwise messages are sent
+// uncompressed.
+func (s *wsSource) configureCompression(conn *websocket.Conn, resp *http.Response) {
+	c := s.client
+	if resp == nil || !strings.Contains(resp.Header.Get("Sec-WebSocket-Extensions"), "permessage-deflate") {
+		s.log.Info("Server did not accept compression, sending uncompressed", "event", "ws_compression", "negotiated", false)
+		return
+	}
+	conn.EnableWriteCompression(true)
+	if err := conn.SetCompressionLevel(c.cfg.WSCompressionLevel); err != nil {
+		s.log.Warn("Failed to set compression level", "event", "ws_compression_failed", "error", err)
+	}
+	s.log.Info("Negotiated permessage-deflate", "event", "ws_compression", "negotiated", true, "level", c.cfg.WSCompressionLevel)
+}
+
+// helloWriteTimeout bounds the hello write on a fresh connection.
+const helloWriteTimeout = 5 * time.Second
+
+// sendHello writes the configured hello message, advertising the supported
+// schema versions unless AdvertiseVersions is off, on a new connection
+// before anything is read from it.
+func (s *wsSource) sendHello(conn *websocket.Conn) error {
+	hello := s.sub.HelloMessage
+	if s.client.cfg.AdvertiseVersions {
+		hello = helloWithSchemaVersions(hello)
+	}
+	conn.SetWriteDeadline(time.Now().Add(helloWriteTimeout))
+	defer conn.SetWriteDeadline(time.Time{})
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(hello)); err != nil {
+		return fmt.Errorf("failed to send hello message: %w", err)
+	}
+	s.log.Info("Sent hello message", "event", "ws_hello_sent", "size", len(hello))
+	return nil
+}
+
+func (s *wsSource) handleMessages(ctx context.Context, conn *safeConn, done chan struct{}, out chan<- Command) (err error) {
+	c := s.client
+	defer close(done)
+	defer func() {
+		if ctx.Err() == nil {
+			s.closeAfterError(conn, err)
+		}
+		conn.Close()
+	}()
+
+	go s.closeOnCancel(ctx, conn, done)
+
+	// deadline is only touched from this goroutine: the pong handler runs
+	// inside ReadMessage. Unless StrictPing is set, any message read extends
+	// it as well as pongs.
+	var deadline time.Time
+	setDeadline := func(t time.Time) {
+		deadline = t
+		conn.SetReadDeadline(t)
+	}
+	conn.SetReadLimit(int64(c.cfg.MaxMessageSize))
+	setDeadline(time.Now().Add(c.cfg.ReadTimeout))
+	conn.SetPongHandler(func(appData string) error {
+		if ctx.Err() != nil {
+			return nil
+		}
+		setDeadline(time.Now().Add(c.cfg.ReadTimeout))
+		return nil
+	})
+	watchdog := s.startWatchdog(conn)
+	defer watchdog.Stop()
+
+	for {
+		messageType, data, err := conn.ReadMessage()
+		if err != nil {
+			if watchdog.Fired() {
+				return ErrIdleTimeout
+			}
+			if werr := conn.writeFailure(); werr != nil {
+				return fmt.Errorf("%w: %w", ErrWrite, werr)
+			}
+			return fmt.Errorf("%w: %w", ErrRead, err)
+		}
+		watchdog.Pause()
+		if !c.cfg.StrictPing {
+			setDeadline(time.Now().Add(c.cfg.ReadTimeout))
+		}
+
+		cmds, err := decodeCommands(messageType, data, c.cfg.MaxMessageSize)
+		if err != nil {
+			commandsMalformed.Inc()
+			c.stats.malformed.Add(1)
+			s.log.Warn("Skipping undecodable message", "event", "command_malformed", "message_type", messageType, "size", len(data), "payload", truncatePayload(data), "decoded", len(cmds), "error", err)
+		}
+
+		// Handing off blocks while the workers are busy. Pongs queue up
+		// unread meanwhile, so the time spent waiting is added back to the
+		// read deadline rather than counted against the server.
+		for _, cmd := range cmds {
+			cmd.origin = s
+			start := time.Now()
+			select {
+			case out <- cmd:
+			case <-ctx.Done():
+				// During a drain Run still takes commands to reject them.
+				select {
+				case out <- cmd:
+				default:
+				}
+				return ctx.Err()
+			}
+			if waited := time.Since(start); ctx.Err() == nil && waited > 0 {
+				setDeadline(deadline.Add(waited))
+			}
+		}
+		watchdog.Reset()
+	}
+}
+
+// idleWatchdog closes a connection on which no message has arrived for
+// IdleTimeout. Pongs do not count, so it catches sessions that are alive at
+// the transport level but no longer deliver anything. A nil *idleWatchdog,
+// used when IdleTimeout is 0, never fires.
+type idleWatchdog struct {
+	timeout time.Duration
+	timer   *time.Timer
+	fired   atomic.Bool
+}
+
+func (s *wsSource) startWatchdog(conn *safeConn) *idleWatchdog {
+	timeout := s.client.cfg.IdleTimeout
+	if timeout <= 0 {
+		return nil
+	}
+	w := &idleWatchdog{timeout: timeout}
+	w.timer = time.AfterFunc(timeout, func() {
+		w.fired.Store(true)
+		conn.sendClose(websocket.CloseGoingAway, "idle timeout")
+		conn.Close()
+	})
+	return w
+}
+
+// Pause stops the watchdog while a command is handed off, since nothing is
+// read from the connection in the meantime.
+func (w *idleWatchdog) Pause() {
+	if w != nil {
+		w.timer.Stop()
+	}
+}
+
+// Reset restarts the idle window after a message.
+func (w *idleWatchdog) Reset() {
+	if w != nil && !w.fired.Load() {
+		w.timer.Reset(w.timeout)
+	}
+}
+
+func (w *idleWatchdog) Stop() { w.Pause() }
+
+func (w *idleWatchdog) Fired() bool {
+	return w != nil && w.fired.Load()
+}
+
+// normalClosure reports whether err is the server closing the connection
+// on purpose, for example during a planned restart.
+func normalClosure(err error) bool {
+	var ce *websocket.CloseError
+	if !errors.As(err, &ce) {
+		return false
+	}
+	return ce.Code == websocket.CloseNormalClosure || ce.Code == websocket.CloseGoingAway
+}
+
+// closeOnCancel starts the close handshake when ctx is cancelled. The read
+// deadline is shortened so the pending read in handleMessages returns once
+// the server echoes the close frame, or after closeGracePeriod at the latest.
+func (s *wsSource) closeOnCancel(ctx context.Context, conn *safeConn, done chan struct{}) {
+	select {
+	case <-done:
+		return
+	case <-ctx.Done():
+	}
+
+	s.log.Info("Closing WebSocket connection", "event", "ws_closing")
+	if err := conn.sendClose(websocket.CloseNormalClosure, "client shutting down"); err != nil {
+		s.log.Warn("Failed to send close message", "event", "ws_close_failed", "error", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(closeGracePeriod))
+}
+
+// closeAfterError tells the server why the client is tearing the connection
+// down before it reconnects.
+func (s *wsSource) closeAfterError(conn *safeConn, cause error) {
+	var ce *websocket.CloseError
+	if errors.As(cause, &ce) || errors.Is(cause, websocket.ErrReadLimit) || errors.Is(cause, ErrIdleTimeout) {
+		// A close frame has already been sent: gorilla/websocket's reply
+		// to the server's, 1009 for an oversized message, or the idle
+		// watchdog's.
+		return
+	}
+
+	if err := conn.sendClose(websocket.CloseGoingAway, "client reconnecting"); err != nil {
+		s.log.Debug("Could not send close message, connection already broken", "event", "ws_close_failed", "error", err)
+	}
+}
+
+// keepAlive pings the server every KeepAliveInterval, shifted by up to
+// KeepAliveJitter percent either way so that clients reconnecting together
+// do not ping in lockstep. If a ping cannot be written, it closes the
+// connection so that handleMessages reconnects instead of reading from a
+// connection that can no longer send acks.
+func (s *wsSource) keepAlive(ctx context.Context, conn *safeConn, done chan struct{}) {
+	next := func() time.Duration {
+		return jitter(s.client.cfg.KeepAliveInterval, s.client.cfg.KeepAliveJitter, rand.Int64N)
+	}
+	timer := time.NewTimer(next())
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-done:
+			return
+		case <-timer.C:
+			err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(s.client.cfg.PingWriteTimeout))
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				s.log.Warn("Ping write timed out, closing connection", "event", "ping_timeout", "timeout", s.client.cfg.PingWriteTimeout, "error", err)
+				conn.failWrite(err)
+				return
+			}
+			if err != nil {
+				s.log.Warn("Failed to send ping, closing connection", "event", "ping_failed", "error", err)
+				conn.failWrite(err)
+				return
+			}
+			s.log.Debug("Ping sent to server", "event", "ping_sent")
+			timer.Reset(next())
+		}
+	}
+}
+
+// jitter returns a random duration within pct percent of d.
+func jitter(d time.Duration, pct int, randN func(n int64) int64) time.Duration {
+	if pct <= 0 {
+		return d
+	}
+	spread := int64(d) * int64(pct) / 100
+	return d - time.Duration(spread) + time.Duration(randN(2*spread+1))
+}
@@ -0,0 +1,60 @@
+package lightstack
+
+import "time"
+
+// connectLogAction is how a failed connection attempt should be logged.
+type connectLogAction int
+
+const (
+	connectLogFull connectLogAction = iota
+	connectLogSummary
+	connectLogQuiet
+)
+
+// connectFailureLog collapses repeated identical connection failures during
+// an outage. The first failure, and any failure with a different error, is
+// logged in full; identical ones after it only produce a summary every
+// interval. A zero interval logs every failure in full.
+type connectFailureLog struct {
+	interval time.Duration
+
+	attempts   int
+	since      time.Time
+	lastErr    string
+	lastLogged time.Time
+}
+
+// Failed records a failed attempt and reports how to log it.
+func (l *connectFailureLog) Failed(err error, now time.Time) connectLogAction {
+	l.attempts++
+	if l.attempts == 1 {
+		l.since = now
+	}
+	if msg := err.Error(); l.interval == 0 || msg != l.lastErr {
+		l.lastErr, l.lastLogged = msg, now
+		return connectLogFull
+	}
+	if now.Sub(l.lastLogged) < l.interval {
+		return connectLogQuiet
+	}
+	l.lastLogged = now
+	return connectLogSummary
+}
+
+// Failing reports whether the last attempt failed and more identical
+// failures are being collapsed, so per-attempt detail can be logged at
+// debug level.
+func (l *connectFailureLog) Failing() bool {
+	return l.interval > 0 && l.attempts > 0
+}
+
+// Recovered ends the outage and returns how many attempts failed and for
+// how long.
+func (l *connectFailureLog) Recovered(now time.Time) (attempts int, outage time.Duration) {
+	attempts, outage = l.attempts, now.Sub(l.since)
+	*l = connectFailureLog{interval: l.interval}
+	if attempts == 0 {
+		outage = 0
+	}
+	return attempts, outage
+}
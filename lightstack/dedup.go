@@ -0,0 +1,79 @@
+package lightstack
+
+import (
+	"net/url"
+	"sync"
+	"time"
+)
+
+// dedupKey identifies commands that make the same device API call. Params
+// holds the command's params query-encoded, which sorts them by name.
+type dedupKey struct {
+	DeviceID   string
+	Mode       string
+	TurnOn     bool
+	Brightness int
+	Color      string
+	Params     string
+}
+
+func newDedupKey(cmd Command) dedupKey {
+	key := dedupKey{DeviceID: cmd.DeviceID, Mode: cmd.Mode, TurnOn: cmd.TurnOn, Brightness: -1, Color: cmd.Color}
+	if cmd.Brightness != nil {
+		key.Brightness = *cmd.Brightness
+	}
+	if len(cmd.Params) > 0 {
+		params := url.Values{}
+		for name, value := range cmd.Params {
+			params.Set(name, value)
+		}
+		key.Params = params.Encode()
+	}
+	return key
+}
+
+// deduper drops commands identical to one seen within the window. A zero
+// window disables it.
+type deduper struct {
+	window    time.Duration
+	now       func() time.Time
+	mu        sync.Mutex
+	seen      map[dedupKey]time.Time
+	lastSweep time.Time
+}
+
+func newDeduper(window time.Duration) *deduper {
+	return &deduper{
+		window: window,
+		now:    time.Now,
+		seen:   make(map[dedupKey]time.Time),
+	}
+}
+
+// Duplicate reports whether cmd repeats a command seen within the window and
+// records it otherwise.
+func (d *deduper) Duplicate(cmd Command) bool {
+	if d.window <= 0 {
+		return false
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := d.now()
+	if now.Sub(d.lastSweep) >= d.window {
+		for k, t := range d.seen {
+			if now.Sub(t) >= d.window {
+				delete(d.seen, k)
+			}
+		}
+		d.lastSweep = now
+	}
+
+	key := newDedupKey(cmd)
+	if t, ok := d.seen[key]; ok && now.Sub(t) < d.window {
+		return true
+	}
+	d.seen[key] = now
+	return false
+}
@@ -0,0 +1,51 @@
+package lightstack
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDeduper(t *testing.T) {
+	red := Command{DeviceID: "stack-1", Mode: "red", TurnOn: true}
+	green := Command{DeviceID: "stack-1", Mode: "green", TurnOn: true}
+	blink2 := Command{DeviceID: "stack-1", Mode: "red", TurnOn: true, Params: map[string]string{"blink": "2"}}
+	blink5 := Command{DeviceID: "stack-1", Mode: "red", TurnOn: true, Params: map[string]string{"blink": "5"}}
+	tests := []struct {
+		name string
+		at   time.Duration
+		cmd  Command
+		want bool
+	}{
+		{"first command", 0, red, false},
+		{"repeat inside the window", 400 * time.Millisecond, red, true},
+		{"different command", 450 * time.Millisecond, green, false},
+		{"repeat after the window", 500 * time.Millisecond, red, false},
+		{"repeat of the repeat", 900 * time.Millisecond, red, true},
+		{"after the next sweep", 2 * time.Second, green, false},
+		{"params", 2100 * time.Millisecond, blink2, false},
+		{"different params", 2200 * time.Millisecond, blink5, false},
+		{"same params", 2300 * time.Millisecond, blink5, true},
+	}
+
+	start := time.Now()
+	var now time.Time
+	d := newDeduper(500 * time.Millisecond)
+	d.now = func() time.Time { return now }
+	for _, tt := range tests {
+		now = start.Add(tt.at)
+		if got := d.Duplicate(tt.cmd); got != tt.want {
+			t.Errorf("%s: Duplicate = %t, want %t", tt.name, got, tt.want)
+		}
+	}
+
+	// The sweep at 2s expired red; green and the two params commands are
+	// left.
+	if _, ok := d.seen[newDedupKey(red)]; ok || len(d.seen) != 3 {
+		t.Errorf("seen = %v, want only the commands since the last sweep", d.seen)
+	}
+
+	d = newDeduper(0)
+	if d.Duplicate(red) || d.Duplicate(red) {
+		t.Error("a zero window dropped a command")
+	}
+}
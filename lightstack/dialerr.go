@@ -0,0 +1,55 @@
+package lightstack
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"syscall"
+
+	"github.com/gorilla/websocket"
+)
+
+// Categories of failed WebSocket dials, as logged in ws_connect_failed.
+const (
+	dialErrDNS       = "dns"
+	dialErrNetwork   = "network"
+	dialErrRefused   = "refused"
+	dialErrTimeout   = "timeout"
+	dialErrTLS       = "tls"
+	dialErrHandshake = "handshake"
+	dialErrOther     = "other"
+)
+
+// dialErrorCategory classifies a failed dial by its cause.
+func dialErrorCategory(err error) string {
+	var dnsErr *net.DNSError
+	var certErr *tls.CertificateVerificationError
+	var recordErr tls.RecordHeaderError
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &dnsErr):
+		return dialErrDNS
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return dialErrRefused
+	case errors.Is(err, syscall.ENETUNREACH), errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETDOWN):
+		return dialErrNetwork
+	case errors.As(err, &certErr), errors.As(err, &recordErr), errors.As(err, &unknownAuthority), errors.As(err, &hostnameErr):
+		return dialErrTLS
+	case errors.Is(err, websocket.ErrBadHandshake):
+		return dialErrHandshake
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return dialErrTimeout
+	}
+	return dialErrOther
+}
+
+// transientDialError reports whether a dial failed in a way that usually
+// clears up within seconds, such as DNS not being ready yet after boot, so
+// it is retried on the shorter DNS backoff.
+func transientDialError(category string) bool {
+	return category == dialErrDNS || category == dialErrNetwork
+}
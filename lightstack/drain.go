@@ -0,0 +1,129 @@
+package lightstack
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// drainState tracks a graceful drain or shutdown flush: once started,
+// commands that finish are counted as drained or abandoned for the final
+// summary.
+type drainState struct {
+	requested chan struct{}
+	once      sync.Once
+	active    atomic.Bool
+	drained   atomic.Int64
+	abandoned atomic.Int64
+}
+
+func newDrainState() *drainState {
+	return &drainState{requested: make(chan struct{})}
+}
+
+// Record counts the outcome of a command completed during a drain or
+// flush.
+func (d *drainState) Record(err error) {
+	if !d.active.Load() {
+		return
+	}
+	if err == nil {
+		d.drained.Add(1)
+	} else {
+		d.abandoned.Add(1)
+	}
+}
+
+// Drain asks Run to stop taking new commands from the source, wait up to
+// Config.DrainTimeout for queued and in-flight commands to finish, and then
+// close the source and return. Commands still running at the deadline are
+// cancelled, which acks them as errors and persists them for replay if the
+// queue is enabled. Calling Drain more than once has no further effect.
+func (c *Client) Drain() {
+	c.drain.once.Do(func() { close(c.drain.requested) })
+}
+
+func (c *Client) drainPool(pool dispatcher, cancelWork context.CancelFunc) {
+	c.log.Info("Draining, no longer accepting commands", "event", "drain_started", "timeout", c.cfg.DrainTimeout)
+	c.drain.active.Store(true)
+
+	done := make(chan struct{})
+	go func() {
+		pool.Close()
+		close(done)
+	}()
+
+	timer := time.NewTimer(c.cfg.DrainTimeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+		c.log.Warn("Drain timed out, cancelling in-flight commands", "event", "drain_timeout")
+		cancelWork()
+		<-done
+	}
+}
+
+// runDrain drains pool and then stops the source. Commands the source
+// still hands over in the meantime are not processed: they are acked with
+// ErrDraining and counted as abandoned.
+func (c *Client) runDrain(pool dispatcher, cancelWork, stopSource context.CancelFunc, errc <-chan error) error {
+	done := make(chan struct{})
+	go func() {
+		c.drainPool(pool, cancelWork)
+		close(done)
+	}()
+
+	var err error
+	drained, stopped := false, false
+	for !drained || !stopped {
+		select {
+		case cmd := <-c.inbox:
+			c.rejectDraining(cmd)
+		case <-done:
+			drained, done = true, nil
+			stopSource()
+		case err = <-errc:
+			stopped = true
+		}
+	}
+	// Submit or a source racing its own shutdown may still hand one over.
+	for {
+		select {
+		case cmd := <-c.inbox:
+			c.rejectDraining(cmd)
+		default:
+			c.log.Info("Drain finished", "event", "drain_finished", "drained", c.drain.drained.Load(), "abandoned", c.drain.abandoned.Load())
+			return err
+		}
+	}
+}
+
+func (c *Client) rejectDraining(cmd Command) {
+	commandsReceived.Inc()
+	c.stats.received.Add(1)
+	c.stats.skipped.Add(1)
+	c.drain.abandoned.Add(1)
+	c.log.Warn("Rejecting command received while draining", append(commandAttrs(cmd), "event", "command_rejected_draining")...)
+	c.sendAck(cmd, newAck(cmd, Result{}, ErrDraining))
+}
+
+// flushOnShutdown gives pending commands and the persisted queue up to
+// Config.QueueFlushTimeout to reach the device API after Run's context is
+// cancelled. Commands still running at the deadline are cancelled, which
+// persists them for the next start.
+func (c *Client) flushOnShutdown(ctx context.Context, pool dispatcher, cancelWork context.CancelFunc) {
+	c.log.Info("Shutting down, flushing pending commands", "event", "flush_started", "timeout", c.cfg.QueueFlushTimeout)
+	c.drain.active.Store(true)
+	timer := time.AfterFunc(c.cfg.QueueFlushTimeout, cancelWork)
+	defer timer.Stop()
+
+	pool.Close()
+	replayed := c.replay.drain(ctx)
+	if ctx.Err() != nil {
+		c.log.Warn("Flush timed out, persisting the remaining commands", "event", "flush_timeout")
+	}
+
+	c.log.Info("Flush finished", "event", "flush_finished", "flushed", c.drain.drained.Load()+int64(replayed), "persisted", c.replay.queue.Len())
+}
@@ -0,0 +1,58 @@
+package lightstack
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors reported by a Client, in StateEvent.Err, from Run, or wrapped in
+// the errors behind failed acks. Use errors.Is to test for them; failed
+// device API responses can also be inspected with errors.As and
+// *HTTPStatusError.
+var (
+	// ErrDial wraps failures to open the WebSocket connection, including
+	// sending the hello message.
+	ErrDial = errors.New("websocket dial failed")
+	// ErrRead wraps failures reading from an open WebSocket connection,
+	// including the server closing it.
+	ErrRead = errors.New("websocket read failed")
+	// ErrWrite means the connection was closed because a keepalive ping
+	// could not be written.
+	ErrWrite = errors.New("websocket write failed")
+	// ErrConnectGaveUp is returned by Run when MaxConnectFailures
+	// consecutive connection attempts have failed.
+	ErrConnectGaveUp = errors.New("giving up on the WebSocket server")
+	// ErrIdleTimeout means the idle watchdog closed the connection.
+	ErrIdleTimeout = errors.New("no message received within idle timeout")
+	// ErrNotConnected means an ack could not be written because the
+	// WebSocket connection was down.
+	ErrNotConnected = errors.New("not connected")
+	// ErrHTTPStatus matches any *HTTPStatusError.
+	ErrHTTPStatus = errors.New("unexpected device API response status")
+	// ErrHTTPTimeout means a device API request hit HTTPTimeout.
+	ErrHTTPTimeout = errors.New("device API request timed out")
+	// ErrCircuitOpen means a device API request was not sent because the
+	// circuit breaker is open.
+	ErrCircuitOpen = errors.New("device API circuit breaker is open")
+	// ErrDraining is the error acked for commands received while Run
+	// drains.
+	ErrDraining = errors.New("client is draining")
+	// ErrPreflight wraps a failed startup check with Preflight set to
+	// PreflightFail.
+	ErrPreflight = errors.New("device API preflight check failed")
+)
+
+// HTTPStatusError is a device API or webhook response whose status does not
+// count as success.
+type HTTPStatusError struct {
+	StatusCode int
+}
+
+func (e *HTTPStatusError) Error() string {
+	return fmt.Sprintf("unexpected response status: %d", e.StatusCode)
+}
+
+// Is makes errors.Is(err, ErrHTTPStatus) true for any *HTTPStatusError.
+func (e *HTTPStatusError) Is(target error) bool {
+	return target == ErrHTTPStatus
+}
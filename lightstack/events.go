@@ -0,0 +1,69 @@
+package lightstack
+
+import (
+	"time"
+)
+
+// eventBufferSize is how many state events are held for a slow subscriber
+// before new ones are dropped.
+const eventBufferSize = 16
+
+// State is a connection state reported by Client.Events.
+type State int
+
+const (
+	StateConnecting State = iota
+	StateConnected
+	StateDisconnected
+	StateReconnecting
+)
+
+func (s State) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateDisconnected:
+		return "disconnected"
+	case StateReconnecting:
+		return "reconnecting"
+	}
+	return "unknown"
+}
+
+// StateEvent is a change in the WebSocket connection state.
+type StateEvent struct {
+	State State
+	// Subscription names the connection the event is about when
+	// Config.Subscriptions is set. It is empty otherwise.
+	Subscription string
+	Time         time.Time
+	// Err is why the dial failed or the connection was lost. It is nil for
+	// a clean shutdown and for Connecting and Connected events.
+	Err error
+	// RetryIn is the backoff delay before the next dial, set on
+	// Reconnecting events.
+	RetryIn time.Duration
+}
+
+// Events returns the channel on which connection state changes are
+// published. It is buffered, and events are dropped rather than sent when
+// the buffer is full, so a slow or absent subscriber never stalls the
+// client. The channel is shared, never closed, and meant for a single
+// subscriber.
+func (c *Client) Events() <-chan StateEvent {
+	return c.events
+}
+
+// emit timestamps ev, records it in the stats and sends it to the
+// subscriber, if there is room.
+func (c *Client) emit(ev StateEvent) {
+	ev.Time = time.Now()
+	c.stats.recordState(ev.State, ev.Err, ev.Time)
+	select {
+	case c.events <- ev:
+	default:
+		c.log.Debug("Dropping state event, subscriber is behind", "event", "state_event_dropped", "state", ev.State)
+	}
+}
@@ -0,0 +1,73 @@
+package lightstack
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxExecOutput caps how much of a failed program's output ends up in the
+// error.
+const maxExecOutput = 1 << 10
+
+// ExecExecutor runs a program on the local host for every command, for
+// devices driven directly rather than through the device API. The command
+// is written to the program's standard input as JSON, and its device ID,
+// mode and on/off state are also passed in the environment as
+// LIGHTSTACK_DEVICE_ID, LIGHTSTACK_MODE and LIGHTSTACK_TURN_ON. A non-zero
+// exit status fails the command.
+type ExecExecutor struct {
+	Path string
+	// Timeout kills the program if it runs longer. 0 means no limit.
+	Timeout time.Duration
+	// DryRun logs the command instead of running the program.
+	DryRun bool
+	Logger *slog.Logger
+}
+
+func (e *ExecExecutor) Execute(ctx context.Context, cmd Command) error {
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return fmt.Errorf("failed to encode command: %w", err)
+	}
+	logger := e.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	logger = logger.With(commandAttrs(cmd)...)
+	if e.DryRun {
+		logger.Info("Dry run, not running command", "event", "exec_dry_run", "path", e.Path, "body", string(data))
+		return nil
+	}
+
+	if e.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, e.Timeout)
+		defer cancel()
+	}
+	proc := exec.CommandContext(ctx, e.Path)
+	proc.Stdin = bytes.NewReader(data)
+	proc.Env = append(os.Environ(),
+		"LIGHTSTACK_DEVICE_ID="+cmd.DeviceID,
+		"LIGHTSTACK_MODE="+cmd.Mode,
+		"LIGHTSTACK_TURN_ON="+strconv.FormatBool(cmd.TurnOn),
+	)
+	logger.Info("Running command", "event", "exec_command", "path", e.Path)
+	start := time.Now()
+	out, err := proc.CombinedOutput()
+	if err != nil {
+		if len(out) > maxExecOutput {
+			out = out[:maxExecOutput]
+		}
+		return fmt.Errorf("%s failed: %w: %s", e.Path, err, strings.TrimSpace(string(out)))
+	}
+	logger.Debug("Command finished", "event", "exec_done", "path", e.Path, "duration", time.Since(start))
+	return nil
+}
@@ -0,0 +1,97 @@
+package lightstack
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestExecExecutor(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(dir, "out")
+	script := filepath.Join(dir, "set-light")
+	body := "#!/bin/sh\ncat > " + out + "\necho >> " + out + "\necho \"$LIGHTSTACK_DEVICE_ID $LIGHTSTACK_MODE $LIGHTSTACK_TURN_ON\" >> " + out + "\n" +
+		"[ \"$LIGHTSTACK_DEVICE_ID\" != broken ] || { echo no such pin >&2; exit 3; }\n"
+	if err := os.WriteFile(script, []byte(body), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	e := &ExecExecutor{Path: script, Timeout: 5 * time.Second, Logger: slog.New(slog.DiscardHandler)}
+
+	cmd := Command{DeviceID: "stack-1", Mode: "red", TurnOn: true}
+	if err := e.Execute(context.Background(), cmd); err != nil {
+		t.Fatalf("Execute: %v", err)
+	}
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdin, env, _ := strings.Cut(string(data), "\n")
+	var got Command
+	if err := json.Unmarshal([]byte(stdin), &got); err != nil || got.DeviceID != "stack-1" || got.Mode != "red" || !got.TurnOn {
+		t.Errorf("stdin = %s, want the command as JSON", stdin)
+	}
+	if env != "stack-1 red true\n" {
+		t.Errorf("environment = %q, want device ID, mode and on/off", env)
+	}
+
+	err = e.Execute(context.Background(), Command{DeviceID: "broken", Mode: "red"})
+	if err == nil || !strings.Contains(err.Error(), "no such pin") {
+		t.Errorf("Execute = %v, want the program's output in the error", err)
+	}
+}
+
+// countingExecutor fails each device's first command.
+type countingExecutor struct {
+	mu    sync.Mutex
+	calls map[string]int
+}
+
+func (e *countingExecutor) Execute(ctx context.Context, cmd Command) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.calls[cmd.DeviceID]++
+	if e.calls[cmd.DeviceID] == 1 {
+		return errors.New("pin busy")
+	}
+	return nil
+}
+
+func TestClientUsesExecutor(t *testing.T) {
+	src := &chanSource{cmds: []Command{
+		{DeviceID: "stack-1", Mode: "red", TurnOn: true},
+		{DeviceID: "stack-2", Mode: "green", TurnOn: true},
+	}}
+	exec := &countingExecutor{calls: map[string]int{}}
+
+	cfg := DefaultConfig()
+	cfg.WSURL = ""
+	cfg.Source = src
+	cfg.Executor = exec
+	cfg.HTTPRetryBase = time.Millisecond
+	c := newTestClient(t, cfg)
+
+	stop := runClient(t, c)
+	waitFor(t, "two acks", func() bool { return len(src.Acks()) == 2 })
+	stop()
+
+	for _, ack := range src.Acks() {
+		if ack.Outcome != ackOutcomeSuccess {
+			t.Errorf("ack = %+v, want success after a retry", ack)
+		}
+	}
+	if exec.calls["stack-1"] != 2 || exec.calls["stack-2"] != 2 {
+		t.Errorf("calls = %v, want each command retried once", exec.calls)
+	}
+
+	cfg.ExecCommand = "/bin/true"
+	if err := cfg.Validate(); err == nil {
+		t.Error("Validate accepted both Executor and exec-command")
+	}
+}
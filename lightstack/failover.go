@@ -0,0 +1,134 @@
+package lightstack
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// endpoints is the ordered list of WebSocket URLs, the primary WSURL first
+// and then WSFailoverURLs. After failoverAfter consecutive failed dials the
+// next one is tried, wrapping around to the primary. Each endpoint keeps
+// its own backoff.
+type endpoints struct {
+	urls          []string
+	backoffs      []*backoff
+	failoverAfter int
+	current       int
+	failures      int
+}
+
+func newEndpoints(cfg Config, urls []string, jitter func(n int64) int64) *endpoints {
+	e := &endpoints{urls: urls, failoverAfter: cfg.WSFailoverAfter}
+	for range e.urls {
+		bo := newBackoff(cfg.BackoffBase, cfg.BackoffMax)
+		bo.rand = jitter
+		e.backoffs = append(e.backoffs, bo)
+	}
+	return e
+}
+
+func (e *endpoints) URL() string       { return e.urls[e.current] }
+func (e *endpoints) Primary() string   { return e.urls[0] }
+func (e *endpoints) OnPrimary() bool   { return e.current == 0 }
+func (e *endpoints) Backoff() *backoff { return e.backoffs[e.current] }
+func (e *endpoints) Connected()        { e.failures = 0 }
+
+// Name identifies the current endpoint in logs without its URL.
+func (e *endpoints) Name() string {
+	if e.current == 0 {
+		return "primary"
+	}
+	return "failover-" + strconv.Itoa(e.current)
+}
+
+// Failed records a failed dial and reports whether it moved on to the next
+// endpoint. With a single URL it never does.
+func (e *endpoints) Failed() bool {
+	e.failures++
+	if len(e.urls) == 1 || e.failures < e.failoverAfter {
+		return false
+	}
+	e.current = (e.current + 1) % len(e.urls)
+	e.failures = 0
+	return true
+}
+
+// Failback switches back to the primary endpoint.
+func (e *endpoints) Failback() {
+	e.current = 0
+	e.failures = 0
+	e.backoffs[0].Reset()
+}
+
+// failbackProbe dials the primary endpoint every WSFailbackInterval while a
+// failover endpoint is in use. Once the primary accepts a connection, the
+// probe closes the current one so that Run continues on the new connection.
+type failbackProbe struct {
+	finished chan struct{}
+
+	mu   sync.Mutex
+	conn *websocket.Conn
+	resp *http.Response
+}
+
+func (s *wsSource) startFailbackProbe(ctx context.Context, conn *safeConn, primary string, done chan struct{}) *failbackProbe {
+	p := &failbackProbe{finished: make(chan struct{})}
+	interval := s.client.cfg.WSFailbackInterval
+	if interval <= 0 {
+		close(p.finished)
+		return p
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		defer close(p.finished)
+		defer cancel()
+		go func() {
+			select {
+			case <-done:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			c := s.client
+			wsConn, resp, err := c.dialer.DialContext(ctx, primary, c.header)
+			if err != nil {
+				s.log.Debug("Primary WebSocket endpoint still unavailable", "event", "ws_failback_probe_failed", "url", redactURL(primary), "error", err)
+				continue
+			}
+			p.mu.Lock()
+			p.conn, p.resp = wsConn, resp
+			p.mu.Unlock()
+			conn.sendClose(websocket.CloseGoingAway, "client failing back")
+			conn.Close()
+			return
+		}
+	}()
+	return p
+}
+
+// Take waits for the probe to stop and returns the connection it opened to
+// the primary endpoint, if any.
+func (p *failbackProbe) Take() (*websocket.Conn, *http.Response) {
+	<-p.finished
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	conn, resp := p.conn, p.resp
+	p.conn, p.resp = nil, nil
+	return conn, resp
+}
@@ -0,0 +1,86 @@
+package lightstack
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// maxReplayLine caps the length of one line in a replay file.
+const maxReplayLine = 1 << 20
+
+// recordedCommand is one line of a replay file: a command, optionally with
+// the time it was originally received.
+type recordedCommand struct {
+	Command
+	RecordedAt time.Time `json:"recorded_at,omitzero"`
+}
+
+// fileSource is the CommandSource used when ReplayPath is set: it replays
+// the newline-delimited JSON commands in a file once, then returns.
+type fileSource struct {
+	client *Client
+	path   string
+	timing bool
+}
+
+func newFileSource(client *Client, path string, timing bool) *fileSource {
+	return &fileSource{client: client, path: path, timing: timing}
+}
+
+func (s *fileSource) Run(ctx context.Context, out chan<- Command) error {
+	log := s.client.log.With("path", s.path)
+	f, err := os.Open(s.path)
+	if err != nil {
+		return fmt.Errorf("failed to open replay file: %w", err)
+	}
+	defer f.Close()
+
+	log.Info("Replaying commands from file", "event", "replay_started", "timing", s.timing)
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, maxReplayLine)
+	var prev time.Time
+	line, sent := 0, 0
+	for sc.Scan() {
+		line++
+		if len(sc.Bytes()) == 0 {
+			continue
+		}
+		var rec recordedCommand
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			commandsMalformed.Inc()
+			s.client.stats.malformed.Add(1)
+			log.Warn("Skipping undecodable replay line", "event", "command_malformed", "line", line, "payload", truncatePayload(sc.Bytes()), "error", err)
+			continue
+		}
+
+		// With timing, the gap between consecutive recorded_at values is
+		// reproduced; lines without one are sent immediately.
+		if s.timing && !rec.RecordedAt.IsZero() {
+			if !prev.IsZero() {
+				if gap := rec.RecordedAt.Sub(prev); gap > 0 {
+					sleepContext(ctx, gap)
+				}
+			}
+			prev = rec.RecordedAt
+		}
+
+		select {
+		case out <- rec.Command:
+			sent++
+		case <-ctx.Done():
+			return nil
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return fmt.Errorf("failed to read replay file at line %d: %w", line+1, err)
+	}
+	log.Info("Finished replaying commands", "event", "replay_finished", "commands", sent)
+	return nil
+}
+
+// Ack discards acks; a replay file has no return path.
+func (s *fileSource) Ack(Ack) error { return nil }
@@ -0,0 +1,85 @@
+package lightstack
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeReplayFile(t *testing.T, lines string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "commands.jsonl")
+	if err := os.WriteFile(path, []byte(lines), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestClientReplaysFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		timing  bool
+		minTime time.Duration
+	}{
+		{name: "as fast as possible"},
+		{name: "recorded timing", timing: true, minTime: 190 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeReplayFile(t, `{"device_id":"stack-1","mode":"red","turnOn":true,"recorded_at":"2024-05-01T12:00:00Z"}
+
+not json
+{"device_id":"stack-2","mode":"green","turnOn":false,"recorded_at":"2024-05-01T12:00:00.1Z"}
+{"device_id":"stack-3","mode":"red","turnOn":true,"recorded_at":"2024-05-01T12:00:00.2Z"}
+`)
+			api := newFakeDeviceAPI(t, http.StatusOK)
+
+			cfg := DefaultConfig()
+			cfg.WSURL = ""
+			cfg.APIBaseURL = api.URL
+			cfg.Workers = 1
+			cfg.ReplayPath = path
+			cfg.ReplayTiming = tt.timing
+			c := newTestClient(t, cfg)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			start := time.Now()
+			if err := c.Run(ctx); err != nil {
+				t.Fatalf("Run: %v", err)
+			}
+			if ctx.Err() != nil {
+				t.Fatal("Run did not return after the replay file was exhausted")
+			}
+			if elapsed := time.Since(start); elapsed < tt.minTime {
+				t.Errorf("replay took %s, want at least %s", elapsed, tt.minTime)
+			}
+
+			reqs := api.Requests()
+			want := []string{"stack-1", "stack-2", "stack-3"}
+			if len(reqs) != len(want) {
+				t.Fatalf("got %d requests, want %d", len(reqs), len(want))
+			}
+			for i, id := range want {
+				if got := reqs[i].Path; got != "/api/device/gpo/light/"+id {
+					t.Errorf("request %d path = %s, want %s", i, got, id)
+				}
+			}
+		})
+	}
+}
+
+func TestClientReplayFileMissing(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.ReplayPath = filepath.Join(t.TempDir(), "missing.jsonl")
+	c := newTestClient(t, cfg)
+
+	if err := c.Run(context.Background()); err == nil {
+		t.Fatal("Run succeeded with a missing replay file")
+	}
+}
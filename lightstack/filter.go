@@ -0,0 +1,51 @@
+package lightstack
+
+import (
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+)
+
+// deviceFilter decides which devices this client acts on. Patterns use
+// path.Match syntax, so "dock-*" matches every ID starting with "dock-".
+// A device is permitted if it matches an allow pattern, or the allow list is
+// empty, and matches no deny pattern.
+type deviceFilter struct {
+	allow []string
+	deny  []string
+}
+
+func validatePatterns(name string, patterns []string) error {
+	for _, p := range patterns {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("invalid %s pattern %q: %w", name, p, err)
+		}
+	}
+	return nil
+}
+
+func (f deviceFilter) Permits(deviceID string) bool {
+	if len(f.allow) > 0 && !matchAny(f.allow, deviceID) {
+		return false
+	}
+	return !matchAny(f.deny, deviceID)
+}
+
+func matchAny(patterns []string, s string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, s); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// labelledInMetrics reports whether deviceID may be used as a metric label.
+// Only devices named literally in the allow list are, not those matched by
+// a glob, which keeps the number of series bounded.
+func (c *Client) labelledInMetrics(deviceID string) bool {
+	return slices.ContainsFunc(c.live.Load().filter.allow, func(p string) bool {
+		return p == deviceID && !strings.ContainsAny(p, `*?[\`)
+	})
+}
@@ -0,0 +1,58 @@
+package lightstack
+
+import "testing"
+
+func TestDeviceFilterPermits(t *testing.T) {
+	tests := []struct {
+		name  string
+		allow []string
+		deny  []string
+		want  map[string]bool
+	}{
+		{
+			name: "no lists",
+			want: map[string]bool{"stack-1": true},
+		},
+		{
+			name:  "allow globs",
+			allow: []string{"dock-*", "stack-1"},
+			want:  map[string]bool{"dock-3": true, "stack-1": true, "stack-2": false},
+		},
+		{
+			name: "deny only",
+			deny: []string{"stack-?"},
+			want: map[string]bool{"stack-1": false, "stack-10": true},
+		},
+		{
+			name:  "deny wins",
+			allow: []string{"dock-*"},
+			deny:  []string{"dock-9"},
+			want:  map[string]bool{"dock-1": true, "dock-9": false},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := deviceFilter{allow: tt.allow, deny: tt.deny}
+			for id, want := range tt.want {
+				if got := f.Permits(id); got != want {
+					t.Errorf("Permits(%q) = %v, want %v", id, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestLabelledInMetrics(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.DeviceAllow = []string{"stack-1", "dock-*", `stack-\?`}
+	c := newTestClient(t, cfg)
+	for id, want := range map[string]bool{"stack-1": true, "dock-3": false, "dock-*": false, "stack-?": false, "stack-2": false} {
+		if got := c.labelledInMetrics(id); got != want {
+			t.Errorf("labelledInMetrics(%q) = %v, want %v", id, got, want)
+		}
+	}
+
+	if c := newTestClient(t, DefaultConfig()); c.labelledInMetrics("stack-1") {
+		t.Error("labelledInMetrics(\"stack-1\") = true without an allow list, want false")
+	}
+}
@@ -0,0 +1,106 @@
+package lightstack
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// AllDevices is the device ID of a command meant for every device in
+// Config.DeviceGroups.
+const AllDevices = "*"
+
+// GroupPrefix marks a device ID naming a group in Config.DeviceGroups, as in
+// "group:dock".
+const GroupPrefix = "group:"
+
+// isGroupTarget reports whether deviceID addresses a group rather than a
+// single device.
+func isGroupTarget(deviceID string) bool {
+	return deviceID == AllDevices || strings.HasPrefix(deviceID, GroupPrefix)
+}
+
+// LoadDeviceGroups reads a JSON object mapping group names to device IDs
+// from path.
+func LoadDeviceGroups(path string) (map[string][]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var groups map[string][]string
+	if err := json.Unmarshal(data, &groups); err != nil {
+		return nil, fmt.Errorf("invalid device groups file %s: %w", path, err)
+	}
+	if err := validateDeviceGroups(groups); err != nil {
+		return nil, fmt.Errorf("invalid device groups file %s: %w", path, err)
+	}
+	return groups, nil
+}
+
+func validateDeviceGroups(groups map[string][]string) error {
+	for name, members := range groups {
+		if strings.TrimSpace(name) == "" {
+			return errors.New("group names must not be empty")
+		}
+		for _, id := range members {
+			if strings.TrimSpace(id) == "" || isGroupTarget(id) {
+				return fmt.Errorf("group %s: %q is not a device ID", name, id)
+			}
+		}
+	}
+	return nil
+}
+
+// groupMembers returns the devices a group target expands to, in the order
+// the group lists them. AllDevices expands to the members of every group,
+// by group name, each device once.
+func groupMembers(groups map[string][]string, target string) ([]string, bool) {
+	if target != AllDevices {
+		members, ok := groups[strings.TrimPrefix(target, GroupPrefix)]
+		return members, ok
+	}
+	var all []string
+	for _, name := range slices.Sorted(maps.Keys(groups)) {
+		for _, id := range groups[name] {
+			if !slices.Contains(all, id) {
+				all = append(all, id)
+			}
+		}
+	}
+	return all, len(all) > 0
+}
+
+// dispatchGroup dispatches one copy of cmd per member of the group it
+// targets. The copies share the request ID, so their acks can be matched to
+// the original command, and get an idempotency key of their own.
+func (c *Client) dispatchGroup(ctx context.Context, pool dispatcher, cmd Command) {
+	if cmd.RequestID == "" {
+		cmd.RequestID = newRequestID()
+	}
+	logger := c.log.With(commandAttrs(cmd)...)
+	members, ok := groupMembers(c.groups, cmd.DeviceID)
+	if !ok {
+		commandsReceived.Inc()
+		c.stats.received.Add(1)
+		c.recorder.Record(cmd, time.Now())
+		logger.Warn("Skipping command for an unknown device group", "event", "command_unknown_group", "group", cmd.DeviceID)
+		c.stats.skipped.Add(1)
+		return
+	}
+
+	logger.Info("Expanding group command", "event", "command_expanded", "group", cmd.DeviceID, "devices", len(members))
+	for _, id := range members {
+		member := cmd
+		member.DeviceID = id
+		if cmd.IdempotencyKey != "" {
+			member.IdempotencyKey = cmd.IdempotencyKey + ":" + id
+		}
+		c.dispatch(ctx, pool, member)
+	}
+}
@@ -0,0 +1,121 @@
+package lightstack
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestGroupMembers(t *testing.T) {
+	groups := map[string][]string{
+		"lab":  {"lab-1", "dock-2"},
+		"dock": {"dock-2", "dock-1"},
+	}
+	tests := []struct {
+		target string
+		want   []string
+		ok     bool
+	}{
+		{"group:dock", []string{"dock-2", "dock-1"}, true},
+		{"group:lab", []string{"lab-1", "dock-2"}, true},
+		{"*", []string{"dock-2", "dock-1", "lab-1"}, true},
+		{"group:yard", nil, false},
+	}
+	for _, tt := range tests {
+		got, ok := groupMembers(groups, tt.target)
+		if ok != tt.ok || !slices.Equal(got, tt.want) {
+			t.Errorf("groupMembers(%s) = %v, %v; want %v, %v", tt.target, got, ok, tt.want, tt.ok)
+		}
+	}
+	if _, ok := groupMembers(nil, AllDevices); ok {
+		t.Error("* expanded without any groups")
+	}
+}
+
+func TestLoadDeviceGroupsRejectsGroupMembers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "groups.json")
+	if err := os.WriteFile(path, []byte(`{"dock":["dock-1","group:lab"]}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadDeviceGroups(path); err == nil {
+		t.Error("LoadDeviceGroups accepted a group as a member")
+	}
+}
+
+func TestClientExpandsGroupCommands(t *testing.T) {
+	src := &chanSource{cmds: []Command{
+		{DeviceID: "group:dock", Mode: "red", TurnOn: true, RequestID: "req-1"},
+		{DeviceID: "group:yard", Mode: "red", TurnOn: true},
+		{DeviceID: "*", Mode: "green", TurnOn: true},
+	}}
+	api := newFakeDeviceAPI(t, http.StatusOK)
+
+	cfg := DefaultConfig()
+	cfg.WSURL = ""
+	cfg.APIBaseURL = api.URL
+	cfg.Source = src
+	cfg.Workers = 1
+	cfg.DeviceDeny = []string{"lab-*"}
+	cfg.DeviceGroups = map[string][]string{
+		"dock": {"dock-1", "dock-2"},
+		"lab":  {"lab-1", "dock-2"},
+	}
+	c := newTestClient(t, cfg)
+
+	stop := runClient(t, c)
+	waitFor(t, "four acks", func() bool { return len(src.Acks()) == 4 })
+	stop()
+
+	var paths []string
+	for _, r := range api.Requests() {
+		paths = append(paths, r.Path)
+	}
+	want := []string{
+		"/api/device/gpo/light/dock-1",
+		"/api/device/gpo/light/dock-2",
+		"/api/device/gpo/light/dock-1",
+		"/api/device/gpo/light/dock-2",
+	}
+	if !slices.Equal(paths, want) {
+		t.Errorf("requests = %v, want %v", paths, want)
+	}
+	acks := src.Acks()
+	if acks[0].RequestID != "req-1" || acks[1].RequestID != "req-1" {
+		t.Errorf("acks = %+v, want the group's request ID on both dock acks", acks[:2])
+	}
+	if acks[2].RequestID == "" || acks[2].RequestID != acks[3].RequestID {
+		t.Errorf("acks = %+v, want one request ID shared by the * acks", acks[2:])
+	}
+}
+
+func TestClientRejectsTransformsToGroups(t *testing.T) {
+	src := &chanSource{cmds: []Command{
+		{DeviceID: "legacy-dock", Mode: "red", TurnOn: true},
+		{DeviceID: "dock-1", Mode: "green", TurnOn: true},
+	}}
+	api := newFakeDeviceAPI(t, http.StatusOK)
+
+	cfg := DefaultConfig()
+	cfg.WSURL = ""
+	cfg.APIBaseURL = api.URL
+	cfg.Source = src
+	cfg.DeviceGroups = map[string][]string{"dock": {"dock-1", "dock-2"}}
+	cfg.Transforms = []Transform{func(cmd Command) (Command, error) {
+		if cmd.DeviceID == "legacy-dock" {
+			cmd.DeviceID = GroupPrefix + "dock"
+		}
+		return cmd, nil
+	}}
+	c := newTestClient(t, cfg)
+
+	stop := runClient(t, c)
+	waitFor(t, "an ack", func() bool { return len(src.Acks()) == 1 })
+	waitFor(t, "the rejected command", func() bool { return c.Stats().CommandsSkipped == 1 })
+	stop()
+
+	if reqs := api.Requests(); len(reqs) != 1 || reqs[0].Path != "/api/device/gpo/light/dock-1" {
+		t.Errorf("requests = %+v, want only the dock-1 command; a transform must not produce a group target", reqs)
+	}
+}
@@ -0,0 +1,336 @@
+package lightstack
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxResponseBody caps how much of a device API response is read.
+const maxResponseBody = 64 << 10
+
+// maxDrainedBody caps how much of an unread response body is discarded
+// before closing it. Anything longer is cut off, at the cost of the
+// connection.
+const maxDrainedBody = 256 << 10
+
+// Result is the device API's answer to a command.
+type Result struct {
+	StatusCode int
+	// State is the JSON response body, typically the device's resulting
+	// state, or nil if the body was empty, not JSON, or too large.
+	State json.RawMessage
+	// Attempts is how many times the command was sent, retries included.
+	Attempts int
+
+	// timeout is the device API timeout the command was sent with, so the
+	// shadow API gets the same one.
+	timeout time.Duration
+}
+
+func newHTTPClient(cfg Config) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = cfg.HTTPMaxIdleConns
+	transport.MaxIdleConnsPerHost = cfg.HTTPMaxIdleConns
+	transport.Proxy = proxyFunc(cfg)
+
+	tlsConfig, err := loadTLSConfig(cfg.APITLSCert, cfg.APITLSKey, cfg.APITLSCA)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	client := &http.Client{Transport: transport}
+	if !cfg.APIFollowRedirects {
+		client.CheckRedirect = func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+	}
+	return client, nil
+}
+
+// successStatus reports whether the device API accepted a command with the
+// given status: any 2xx, or one of cfg.APISuccessStatuses if set.
+func successStatus(cfg Config, code int) bool {
+	if len(cfg.APISuccessStatuses) == 0 {
+		return code >= 200 && code < 300
+	}
+	return slices.Contains(cfg.APISuccessStatuses, code)
+}
+
+// Values for Config.APIBoolFormat.
+const (
+	BoolTrueFalse = "true/false"
+	BoolOneZero   = "1/0"
+	BoolOnOff     = "on/off"
+)
+
+// formatBool spells v the way format says, BoolTrueFalse if format is
+// unknown.
+func formatBool(format string, v bool) string {
+	switch format {
+	case BoolOneZero:
+		if v {
+			return "1"
+		}
+		return "0"
+	case BoolOnOff:
+		if v {
+			return "on"
+		}
+		return "off"
+	default:
+		return strconv.FormatBool(v)
+	}
+}
+
+// reservedParams are the query parameters buildAPIURL sets from the
+// command fields, which Command.Params cannot override.
+var reservedParams = []string{"mode", "turnOn", "brightness", "color"}
+
+// buildAPIURL returns the device API URL for cmd at path, with the command
+// fields as query parameters if withQuery is set and turnOn spelled per
+// boolFormat. The command's Params are always added.
+func buildAPIURL(baseURL, path string, cmd Command, withQuery bool, boolFormat string) string {
+	apiURL := strings.TrimRight(baseURL, "/") + path
+	query := url.Values{}
+	for name, value := range cmd.Params {
+		query.Set(name, value)
+	}
+	if !withQuery {
+		if len(query) == 0 {
+			return apiURL
+		}
+		return apiURL + "?" + query.Encode()
+	}
+
+	query.Set("mode", cmd.Mode)
+	query.Set("turnOn", formatBool(boolFormat, cmd.TurnOn))
+	if cmd.Brightness != nil {
+		query.Set("brightness", strconv.Itoa(*cmd.Brightness))
+	}
+	if cmd.Color != "" {
+		query.Set("color", cmd.Color)
+	}
+
+	return apiURL + "?" + query.Encode()
+}
+
+// apiRequest is the device API request for a command.
+type apiRequest struct {
+	method      string
+	url         string
+	contentType string
+	body        []byte
+}
+
+func (c *Client) newAPIRequest(cmd Command, baseURL string) (apiRequest, error) {
+	path, err := renderAPIPath(c.apiPath, cmd)
+	if err != nil {
+		return apiRequest{}, err
+	}
+	body, contentType, err := encodeBody(c.cfg.APIBody, c.cfg.APIBodyFields, c.cfg.APIBoolFormat, cmd)
+	if err != nil {
+		return apiRequest{}, err
+	}
+	return apiRequest{
+		method:      c.method(cmd.Mode),
+		url:         buildAPIURL(baseURL, path, cmd, c.cfg.APIQuery, c.cfg.APIBoolFormat),
+		contentType: contentType,
+		body:        body,
+	}, nil
+}
+
+func (c *Client) sendHTTPRequest(ctx context.Context, cmd Command) (Result, error) {
+	req, err := c.newAPIRequest(cmd, c.live.Load().router.BaseURL(cmd.DeviceID))
+	if err != nil {
+		return Result{}, err
+	}
+
+	c.log.Info("Sending HTTP "+req.method, append(commandAttrs(cmd), "event", "http_request", "method", req.method, "url", req.url)...)
+
+	timeout := c.timeout(cmd)
+	res, err := c.send(ctx, req.method, req.url, c.breakers.For(cmd.DeviceID), requestIDs{cmd.RequestID, cmd.IdempotencyKey}, req.contentType, req.body, timeout)
+	res.timeout = timeout
+	return res, err
+}
+
+// timeout returns the device API timeout for cmd: its own timeout_ms,
+// clamped to HTTPMaxTimeout, else the one for its mode, else HTTPTimeout.
+func (c *Client) timeout(cmd Command) time.Duration {
+	if cmd.TimeoutMS > 0 {
+		d := time.Duration(cmd.TimeoutMS) * time.Millisecond
+		clamped := d > c.cfg.HTTPMaxTimeout
+		if clamped {
+			d = c.cfg.HTTPMaxTimeout
+		}
+		c.log.Info("Applying command timeout", append(commandAttrs(cmd), "event", "http_timeout_override", "source", "command", "timeout", d, "clamped", clamped)...)
+		return d
+	}
+	if d, ok := c.cfg.HTTPModeTimeouts[cmd.Mode]; ok {
+		c.log.Info("Applying mode timeout", append(commandAttrs(cmd), "event", "http_timeout_override", "source", "mode", "timeout", d)...)
+		return d
+	}
+	return c.cfg.HTTPTimeout
+}
+
+// method returns the HTTP method for commands with the given mode.
+func (c *Client) method(mode string) string {
+	if m, ok := c.cfg.APIModeMethods[mode]; ok {
+		return m
+	}
+	return c.cfg.APIMethod
+}
+
+// send makes a device API request with body to apiURL that fails after
+// timeout, tagged with requestID if it is not empty, unless b is open.
+func (c *Client) send(ctx context.Context, method, apiURL string, b *breaker, ids requestIDs, contentType string, body []byte, timeout time.Duration) (res Result, err error) {
+	if c.cfg.DryRun {
+		c.log.Info("Dry run, not sending HTTP request", "event", "http_dry_run", "method", method, "url", apiURL, "headers", c.redactedAPIHeader(ids, contentType), "body", string(body))
+		return Result{StatusCode: http.StatusOK}, nil
+	}
+	if limiter := c.live.Load().limiter; limiter != nil {
+		if err := limiter.Wait(ctx); err != nil {
+			return res, fmt.Errorf("rate limiter: %w", err)
+		}
+	}
+	if err := c.acquireHTTPSlot(ctx); err != nil {
+		return res, err
+	}
+	defer c.releaseHTTPSlot()
+	if err := b.Allow(); err != nil {
+		return res, err
+	}
+	// Every allowed request must be recorded, or a half-open breaker
+	// would wait for its probe forever.
+	defer func() { b.Record(ctx, err) }()
+
+	reqCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(reqCtx, method, apiURL, bytes.NewReader(body))
+	if err != nil {
+		return res, fmt.Errorf("failed to create HTTP request: %w", err)
+	}
+	req.Header = c.apiHeader(ids, contentType)
+	span := c.startHTTPSpan(ctx, method, apiURL, req.Header)
+
+	start := time.Now()
+	defer func() {
+		observeHTTPRequest(start, err)
+		endHTTPSpan(span, res.StatusCode, err)
+	}()
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		if ctx.Err() == nil && errors.Is(reqCtx.Err(), context.DeadlineExceeded) {
+			return res, fmt.Errorf("%w after %s", ErrHTTPTimeout, timeout)
+		}
+		return res, fmt.Errorf("failed to send HTTP request: %w", err)
+	}
+	defer closeBody(resp.Body)
+
+	res.StatusCode = resp.StatusCode
+	if !successStatus(c.cfg, resp.StatusCode) {
+		return res, &HTTPStatusError{StatusCode: resp.StatusCode}
+	}
+	res.State = c.readState(resp.Body)
+	return res, nil
+}
+
+// acquireHTTPSlot waits until fewer than HTTPMaxInFlight device API
+// requests are in flight.
+func (c *Client) acquireHTTPSlot(ctx context.Context) error {
+	if c.httpSlots == nil {
+		return nil
+	}
+	select {
+	case c.httpSlots <- struct{}{}:
+		return nil
+	default:
+	}
+	httpSlotWaits.Inc()
+	start := time.Now()
+	defer func() { httpSlotWait.Observe(time.Since(start).Seconds()) }()
+	select {
+	case c.httpSlots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("waiting for a device API request slot: %w", ctx.Err())
+	}
+}
+
+func (c *Client) releaseHTTPSlot() {
+	if c.httpSlots != nil {
+		<-c.httpSlots
+	}
+}
+
+// readState returns the response body if it is JSON of at most
+// maxResponseBody bytes, and nil otherwise.
+func (c *Client) readState(body io.Reader) json.RawMessage {
+	data, err := io.ReadAll(io.LimitReader(body, maxResponseBody+1))
+	switch {
+	case err != nil:
+		c.log.Debug("Failed to read device API response", "event", "http_response_unreadable", "error", err)
+		return nil
+	case len(data) > maxResponseBody:
+		c.log.Debug("Ignoring oversized device API response", "event", "http_response_too_large", "max_bytes", maxResponseBody)
+		return nil
+	case len(bytes.TrimSpace(data)) == 0:
+		return nil
+	case !json.Valid(data):
+		c.log.Debug("Ignoring non-JSON device API response", "event", "http_response_not_json", "size", len(data))
+		return nil
+	}
+	return json.RawMessage(data)
+}
+
+// closeBody discards the rest of a response body, up to maxDrainedBody, and
+// closes it so the transport can reuse the connection for the next request.
+func closeBody(body io.ReadCloser) {
+	io.Copy(io.Discard, io.LimitReader(body, maxDrainedBody))
+	body.Close()
+}
+
+// requestIDs are sent with a device API request as X-Request-ID and
+// Idempotency-Key. The idempotency key is the same on every retry.
+type requestIDs struct {
+	RequestID      string
+	IdempotencyKey string
+}
+
+func (c *Client) apiHeader(ids requestIDs, contentType string) http.Header {
+	h := http.Header{"Content-Type": {contentType}, "User-Agent": {c.cfg.UserAgent}}
+	for name, values := range c.cfg.APIHeaders {
+		h[name] = values
+	}
+	if ids.RequestID != "" {
+		h.Set("X-Request-ID", ids.RequestID)
+	}
+	if ids.IdempotencyKey != "" {
+		h.Set("Idempotency-Key", ids.IdempotencyKey)
+	}
+	return h
+}
+
+// redactedAPIHeader is apiHeader with the configured header values hidden
+// so it can be logged.
+func (c *Client) redactedAPIHeader(ids requestIDs, contentType string) http.Header {
+	h := c.apiHeader(ids, contentType)
+	for name := range c.cfg.APIHeaders {
+		h[name] = []string{"xxxxx"}
+	}
+	return h
+}
@@ -0,0 +1,806 @@
+package lightstack
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type recordedRequest struct {
+	Method string
+	Path   string
+	Query  url.Values
+	Header http.Header
+	Body   []byte
+}
+
+// fakeDeviceAPI records every request it receives and answers with status
+// and body.
+type fakeDeviceAPI struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	status   int
+	body     []byte
+	delay    time.Duration
+	requests []recordedRequest
+}
+
+func newFakeDeviceAPI(t *testing.T, status int) *fakeDeviceAPI {
+	t.Helper()
+
+	api := &fakeDeviceAPI{status: status}
+	api.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		api.mu.Lock()
+		api.requests = append(api.requests, recordedRequest{
+			Method: r.Method,
+			Path:   r.URL.EscapedPath(),
+			Query:  r.URL.Query(),
+			Header: r.Header.Clone(),
+			Body:   body,
+		})
+		status, body, delay := api.status, api.body, api.delay
+		api.mu.Unlock()
+		time.Sleep(delay)
+		w.WriteHeader(status)
+		w.Write(body)
+	}))
+	t.Cleanup(api.Close)
+	return api
+}
+
+func (a *fakeDeviceAPI) SetDelay(d time.Duration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.delay = d
+}
+
+func (a *fakeDeviceAPI) SetBody(body string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.body = []byte(body)
+}
+
+func (a *fakeDeviceAPI) Requests() []recordedRequest {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]recordedRequest(nil), a.requests...)
+}
+
+func newTestClient(t *testing.T, cfg Config) *Client {
+	t.Helper()
+
+	cfg.Logger = slog.New(slog.DiscardHandler)
+	c, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return c
+}
+
+func intPtr(n int) *int { return &n }
+
+// doerFunc adapts a function to HTTPDoer.
+type doerFunc func(*http.Request) (*http.Response, error)
+
+func (f doerFunc) Do(req *http.Request) (*http.Response, error) { return f(req) }
+
+// nopDoer answers every device API request with an empty 200 without
+// touching the network.
+var nopDoer = doerFunc(func(req *http.Request) (*http.Response, error) {
+	return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Header: http.Header{}, Request: req}, nil
+})
+
+func TestSendHTTPRequest(t *testing.T) {
+	tests := []struct {
+		name      string
+		cmd       Command
+		status    int
+		headers   http.Header
+		wantPath  string
+		wantQuery url.Values
+		wantCode  int
+	}{
+		{
+			name:      "success",
+			cmd:       Command{DeviceID: "stack-1", Mode: "red", TurnOn: true},
+			status:    http.StatusOK,
+			wantPath:  "/api/device/gpo/light/stack-1",
+			wantQuery: url.Values{"mode": {"red"}, "turnOn": {"true"}},
+		},
+		{
+			name:      "turn off",
+			cmd:       Command{DeviceID: "stack-1", Mode: "green", TurnOn: false},
+			status:    http.StatusOK,
+			wantPath:  "/api/device/gpo/light/stack-1",
+			wantQuery: url.Values{"mode": {"green"}, "turnOn": {"false"}},
+		},
+		{
+			name:      "escapes device ID and mode",
+			cmd:       Command{DeviceID: "a/b?c d", Mode: "x&y=z", TurnOn: true},
+			status:    http.StatusOK,
+			wantPath:  "/api/device/gpo/light/a%2Fb%3Fc%20d",
+			wantQuery: url.Values{"mode": {"x&y=z"}, "turnOn": {"true"}},
+		},
+		{
+			name:      "brightness and color",
+			cmd:       Command{DeviceID: "stack-1", Mode: "steady", TurnOn: true, Brightness: intPtr(0), Color: "#ff0000"},
+			status:    http.StatusOK,
+			wantPath:  "/api/device/gpo/light/stack-1",
+			wantQuery: url.Values{"mode": {"steady"}, "turnOn": {"true"}, "brightness": {"0"}, "color": {"#ff0000"}},
+		},
+		{
+			name:      "params",
+			cmd:       Command{DeviceID: "stack-1", Mode: "red", TurnOn: true, Params: map[string]string{"blink": "2", "zone id": "a&b=c"}},
+			status:    http.StatusOK,
+			wantPath:  "/api/device/gpo/light/stack-1",
+			wantQuery: url.Values{"mode": {"red"}, "turnOn": {"true"}, "blink": {"2"}, "zone id": {"a&b=c"}},
+		},
+		{
+			name:      "static headers",
+			cmd:       Command{DeviceID: "stack-1", Mode: "red", TurnOn: true},
+			status:    http.StatusOK,
+			headers:   http.Header{"X-Api-Key": {"secret"}},
+			wantPath:  "/api/device/gpo/light/stack-1",
+			wantQuery: url.Values{"mode": {"red"}, "turnOn": {"true"}},
+		},
+		{
+			name:      "request ID",
+			cmd:       Command{DeviceID: "stack-1", Mode: "red", TurnOn: true, RequestID: "req-123"},
+			status:    http.StatusOK,
+			wantPath:  "/api/device/gpo/light/stack-1",
+			wantQuery: url.Values{"mode": {"red"}, "turnOn": {"true"}},
+		},
+		{
+			name:      "server error",
+			cmd:       Command{DeviceID: "stack-1", Mode: "red", TurnOn: true},
+			status:    http.StatusInternalServerError,
+			wantPath:  "/api/device/gpo/light/stack-1",
+			wantQuery: url.Values{"mode": {"red"}, "turnOn": {"true"}},
+			wantCode:  http.StatusInternalServerError,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := newFakeDeviceAPI(t, tt.status)
+
+			cfg := DefaultConfig()
+			cfg.APIBaseURL = api.URL
+			for name, values := range tt.headers {
+				cfg.APIHeaders[name] = values
+			}
+			c := newTestClient(t, cfg)
+
+			_, err := c.sendHTTPRequest(context.Background(), tt.cmd)
+			if tt.wantCode == 0 && err != nil {
+				t.Fatalf("sendHTTPRequest: %v", err)
+			}
+			if tt.wantCode != 0 {
+				var se *HTTPStatusError
+				if !errors.As(err, &se) || se.StatusCode != tt.wantCode {
+					t.Fatalf("sendHTTPRequest error = %v, want status %d", err, tt.wantCode)
+				}
+				if !errors.Is(err, ErrHTTPStatus) {
+					t.Errorf("errors.Is(%v, ErrHTTPStatus) = false", err)
+				}
+			}
+
+			reqs := api.Requests()
+			if len(reqs) != 1 {
+				t.Fatalf("got %d requests, want 1", len(reqs))
+			}
+			req := reqs[0]
+			if req.Method != http.MethodPost {
+				t.Errorf("method = %s, want POST", req.Method)
+			}
+			if req.Path != tt.wantPath {
+				t.Errorf("path = %s, want %s", req.Path, tt.wantPath)
+			}
+			if req.Query.Encode() != tt.wantQuery.Encode() {
+				t.Errorf("query = %s, want %s", req.Query.Encode(), tt.wantQuery.Encode())
+			}
+			if got := req.Header.Get("Content-Type"); got != "application/json" {
+				t.Errorf("Content-Type = %q, want application/json", got)
+			}
+			if got := req.Header.Get("X-Request-ID"); got != tt.cmd.RequestID {
+				t.Errorf("X-Request-ID = %q, want %q", got, tt.cmd.RequestID)
+			}
+			for name := range tt.headers {
+				if got, want := req.Header.Get(name), tt.headers.Get(name); got != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestCommandParams(t *testing.T) {
+	cmd := Command{DeviceID: "stack-1", Mode: "red", TurnOn: true, Params: map[string]string{"blink": "2"}}
+	if err := cmd.Validate(nil); err != nil {
+		t.Errorf("Validate: %v", err)
+	}
+	if got, want := buildAPIURL("http://api", "/light", cmd, false, BoolTrueFalse), "http://api/light?blink=2"; got != want {
+		t.Errorf("URL without command query = %s, want %s", got, want)
+	}
+
+	for _, name := range []string{"mode", "turnOn", ""} {
+		cmd.Params = map[string]string{name: "x"}
+		if err := cmd.Validate(nil); err == nil {
+			t.Errorf("Validate accepted a %q param", name)
+		}
+	}
+}
+
+func TestSendHTTPRequestConnectionRefused(t *testing.T) {
+	api := httptest.NewServer(http.NotFoundHandler())
+	baseURL := api.URL
+	api.Close()
+
+	cfg := DefaultConfig()
+	cfg.APIBaseURL = baseURL
+	c := newTestClient(t, cfg)
+
+	_, err := c.sendHTTPRequest(context.Background(), Command{DeviceID: "stack-1", Mode: "red", TurnOn: true})
+	if err == nil {
+		t.Fatal("sendHTTPRequest succeeded against a closed server")
+	}
+	var se *HTTPStatusError
+	if errors.As(err, &se) {
+		t.Fatalf("got status error %v, want a transport error", err)
+	}
+	if !retryable(context.Background(), err) {
+		t.Errorf("connection refused should be retryable: %v", err)
+	}
+}
+
+func TestSendHTTPRequestRateLimited(t *testing.T) {
+	api := newFakeDeviceAPI(t, http.StatusOK)
+
+	cfg := DefaultConfig()
+	cfg.APIBaseURL = api.URL
+	cfg.RateLimit = 20
+	cfg.RateBurst = 1
+	c := newTestClient(t, cfg)
+
+	cmd := Command{DeviceID: "stack-1", Mode: "red", TurnOn: true}
+	start := time.Now()
+	for range 3 {
+		if _, err := c.sendHTTPRequest(context.Background(), cmd); err != nil {
+			t.Fatalf("sendHTTPRequest: %v", err)
+		}
+	}
+	// The burst covers the first request; the other two wait 50ms each.
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Errorf("3 requests took %s, want the limiter to space them out", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := c.sendHTTPRequest(ctx, cmd); !errors.Is(err, context.Canceled) {
+		t.Errorf("error = %v, want a cancelled wait", err)
+	}
+	if got := len(api.Requests()); got != 3 {
+		t.Errorf("device API received %d requests, want 3", got)
+	}
+}
+
+func TestSendHTTPRequestMaxInFlight(t *testing.T) {
+	var inFlight, peak atomic.Int32
+	release := make(chan struct{})
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		<-release
+	}))
+	t.Cleanup(api.Close)
+
+	cfg := DefaultConfig()
+	cfg.APIBaseURL = api.URL
+	cfg.HTTPMaxInFlight = 2
+	c := newTestClient(t, cfg)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+	for i := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cmd := Command{DeviceID: fmt.Sprintf("stack-%d", i), Mode: "red", TurnOn: true}
+			_, err := c.sendHTTPRequest(context.Background(), cmd)
+			errs <- err
+		}()
+	}
+	waitFor(t, "two requests in flight", func() bool { return inFlight.Load() == 2 })
+
+	// A request waiting for a slot gives up with its context.
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := c.sendHTTPRequest(ctx, Command{DeviceID: "stack-9", Mode: "red"}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("error = %v, want the wait for a slot to end with the context", err)
+	}
+
+	close(release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("sendHTTPRequest: %v", err)
+		}
+	}
+	if got := peak.Load(); got != 2 {
+		t.Errorf("peak requests in flight = %d, want 2", got)
+	}
+}
+
+func TestSendHTTPRequestDryRun(t *testing.T) {
+	api := newFakeDeviceAPI(t, http.StatusOK)
+
+	var logs syncBuffer
+	cfg := DefaultConfig()
+	cfg.APIBaseURL = api.URL
+	cfg.APIHeaders.Set("X-Api-Key", "secret")
+	cfg.DryRun = true
+	cfg.Logger = slog.New(slog.NewTextHandler(&logs, nil))
+	c, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	if _, err := c.sendHTTPRequest(context.Background(), Command{DeviceID: "stack-1", Mode: "red", TurnOn: true}); err != nil {
+		t.Fatalf("sendHTTPRequest: %v", err)
+	}
+	if got := len(api.Requests()); got != 0 {
+		t.Errorf("device API received %d requests in dry-run mode", got)
+	}
+	out := logs.String()
+	if !strings.Contains(out, "event=http_dry_run") || !strings.Contains(out, "/api/device/gpo/light/stack-1?mode=red&turnOn=true") {
+		t.Errorf("dry run not logged with the request URL; logs:\n%s", out)
+	}
+	if strings.Contains(out, "secret") {
+		t.Errorf("dry-run log leaked a header value; logs:\n%s", out)
+	}
+}
+
+func TestSendHTTPRequestState(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{name: "json", body: `{"mode":"red","turnOn":true}`, want: `{"mode":"red","turnOn":true}`},
+		{name: "empty", body: "", want: ""},
+		{name: "whitespace", body: " \n", want: ""},
+		{name: "not json", body: "OK", want: ""},
+		{name: "too large", body: `"` + strings.Repeat("x", maxResponseBody) + `"`, want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := newFakeDeviceAPI(t, http.StatusOK)
+			api.SetBody(tt.body)
+
+			cfg := DefaultConfig()
+			cfg.APIBaseURL = api.URL
+			c := newTestClient(t, cfg)
+
+			res, err := c.sendHTTPRequest(context.Background(), Command{DeviceID: "stack-1", Mode: "red", TurnOn: true})
+			if err != nil {
+				t.Fatalf("sendHTTPRequest: %v", err)
+			}
+			if res.StatusCode != http.StatusOK {
+				t.Errorf("StatusCode = %d, want 200", res.StatusCode)
+			}
+			if string(res.State) != tt.want {
+				t.Errorf("State = %q, want %q", res.State, tt.want)
+			}
+		})
+	}
+}
+
+func TestSendHTTPRequestSuccessStatuses(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    int
+		statuses  []int
+		redirects bool
+		wantErr   bool
+	}{
+		{name: "accepted", status: http.StatusAccepted},
+		{name: "no content", status: http.StatusNoContent},
+		{name: "not in custom set", status: http.StatusNoContent, statuses: []int{200, 202}, wantErr: true},
+		{name: "in custom set", status: http.StatusAccepted, statuses: []int{200, 202}},
+		{name: "redirect not followed", status: http.StatusFound, wantErr: true},
+		{name: "redirect listed as success", status: http.StatusFound, statuses: []int{302}},
+		{name: "redirect followed", status: http.StatusTemporaryRedirect, redirects: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := newFakeDeviceAPI(t, http.StatusOK)
+			api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.status >= 300 && tt.status < 400 {
+					w.Header().Set("Location", target.URL+r.URL.RequestURI())
+				}
+				w.WriteHeader(tt.status)
+			}))
+			t.Cleanup(api.Close)
+
+			cfg := DefaultConfig()
+			cfg.APIBaseURL = api.URL
+			cfg.APISuccessStatuses = tt.statuses
+			cfg.APIFollowRedirects = tt.redirects
+			c := newTestClient(t, cfg)
+
+			res, err := c.sendHTTPRequest(context.Background(), Command{DeviceID: "stack-1", Mode: "red", TurnOn: true})
+			if tt.wantErr {
+				var se *HTTPStatusError
+				if !errors.As(err, &se) || se.StatusCode != tt.status {
+					t.Fatalf("error = %v, want status %d", err, tt.status)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("sendHTTPRequest: %v", err)
+			}
+			wantCode, wantRedirects := tt.status, 0
+			if tt.redirects {
+				wantCode, wantRedirects = http.StatusOK, 1
+			}
+			if res.StatusCode != wantCode {
+				t.Errorf("StatusCode = %d, want %d", res.StatusCode, wantCode)
+			}
+			if got := len(target.Requests()); got != wantRedirects {
+				t.Errorf("redirect target received %d requests, want %d", got, wantRedirects)
+			}
+		})
+	}
+}
+
+func TestSendHTTPRequestMethods(t *testing.T) {
+	api := newFakeDeviceAPI(t, http.StatusOK)
+
+	cfg := DefaultConfig()
+	cfg.APIBaseURL = api.URL
+	cfg.APIModeMethods = map[string]string{"off": http.MethodPut, "status": http.MethodGet}
+	c := newTestClient(t, cfg)
+
+	for _, mode := range []string{"red", "off", "status"} {
+		if _, err := c.sendHTTPRequest(context.Background(), Command{DeviceID: "stack-1", Mode: mode}); err != nil {
+			t.Fatalf("sendHTTPRequest(%s): %v", mode, err)
+		}
+	}
+	reqs := api.Requests()
+	want := []string{http.MethodPost, http.MethodPut, http.MethodGet}
+	if len(reqs) != len(want) {
+		t.Fatalf("got %d requests, want %d", len(reqs), len(want))
+	}
+	for i, method := range want {
+		if reqs[i].Method != method {
+			t.Errorf("request %d method = %s, want %s", i, reqs[i].Method, method)
+		}
+	}
+
+	cfg.APIModeMethods = map[string]string{"off": "FETCH"}
+	if _, err := New(cfg); err == nil || !strings.Contains(err.Error(), "mode-method for off") {
+		t.Errorf("New with an invalid mode method: error = %v", err)
+	}
+}
+
+func TestSendHTTPRequestTimeouts(t *testing.T) {
+	api := newFakeDeviceAPI(t, http.StatusOK)
+	api.SetDelay(100 * time.Millisecond)
+
+	var logs syncBuffer
+	cfg := DefaultConfig()
+	cfg.APIBaseURL = api.URL
+	cfg.Logger = slog.New(slog.NewTextHandler(&logs, nil))
+	cfg.HTTPTimeout = 30 * time.Millisecond
+	cfg.HTTPMaxTimeout = 300 * time.Millisecond
+	cfg.HTTPModeTimeouts = map[string]time.Duration{"slow": 300 * time.Millisecond}
+	c, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		cmd     Command
+		wantErr string
+	}{
+		{"global", Command{DeviceID: "stack-1", Mode: "red"}, "after 30ms"},
+		{"mode", Command{DeviceID: "stack-1", Mode: "slow"}, ""},
+		{"command", Command{DeviceID: "stack-1", Mode: "red", TimeoutMS: 250}, ""},
+		{"command over mode", Command{DeviceID: "stack-1", Mode: "slow", TimeoutMS: 20}, "after 20ms"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := c.sendHTTPRequest(context.Background(), tt.cmd)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("sendHTTPRequest: %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrHTTPTimeout) || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("error = %v, want ErrHTTPTimeout %s", err, tt.wantErr)
+			}
+		})
+	}
+
+	if _, err := c.sendHTTPRequest(context.Background(), Command{DeviceID: "stack-1", Mode: "red", TimeoutMS: 60000}); err != nil {
+		t.Fatalf("sendHTTPRequest with a clamped timeout: %v", err)
+	}
+	if !strings.Contains(logs.String(), "event=http_timeout_override source=command timeout=300ms clamped=true") {
+		t.Errorf("clamped command timeout not logged; logs:\n%s", logs.String())
+	}
+
+	cfg.HTTPModeTimeouts = map[string]time.Duration{"slow": time.Second}
+	if _, err := New(cfg); err == nil || !strings.Contains(err.Error(), "mode-timeout for slow") {
+		t.Errorf("New with a mode timeout above http-max-timeout: error = %v", err)
+	}
+}
+
+func TestSendHTTPRequestReusesConnections(t *testing.T) {
+	var conns atomic.Int32
+	var calls atomic.Int32
+	api := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Alternate large non-JSON successes and large error responses,
+		// neither of which is read while handling the result.
+		if calls.Add(1)%2 == 0 {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		w.Write([]byte(strings.Repeat("x", 3*maxDrainedBody/4)))
+	}))
+	api.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	api.Start()
+	t.Cleanup(api.Close)
+
+	cfg := DefaultConfig()
+	cfg.APIBaseURL = api.URL
+	cfg.HTTPMaxAttempts = 1
+	c := newTestClient(t, cfg)
+
+	for range 6 {
+		c.sendHTTPRequest(context.Background(), Command{DeviceID: "stack-1", Mode: "red"})
+	}
+	if got := conns.Load(); got != 1 {
+		t.Errorf("device API accepted %d connections for 6 sequential requests, want 1", got)
+	}
+}
+
+func TestSendHTTPRequestAPIPath(t *testing.T) {
+	tests := []struct {
+		name     string
+		path     string
+		cmd      Command
+		wantPath string
+	}{
+		{"default", "", Command{DeviceID: "stack-1", Mode: "red"}, "/api/device/gpo/light/stack-1"},
+		{"mode segment", "/v2/lights/{{.DeviceID}}/{{.Mode}}", Command{DeviceID: "stack-1", Mode: "red"}, "/v2/lights/stack-1/red"},
+		{"escapes fields", "/v2/lights/{{.DeviceID}}/{{.Mode}}", Command{DeviceID: "a/b?c", Mode: "x y"}, "/v2/lights/a%2Fb%3Fc/x%20y"},
+		{"turn on", "/gpo/{{.DeviceID}}/{{if .TurnOn}}on{{else}}off{{end}}", Command{DeviceID: "stack-1", Mode: "red", TurnOn: true}, "/gpo/stack-1/on"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := newFakeDeviceAPI(t, http.StatusOK)
+			cfg := DefaultConfig()
+			cfg.APIBaseURL = api.URL
+			cfg.APIPath = tt.path
+			c := newTestClient(t, cfg)
+
+			if _, err := c.sendHTTPRequest(context.Background(), tt.cmd); err != nil {
+				t.Fatalf("sendHTTPRequest: %v", err)
+			}
+			if got := api.Requests()[0].Path; got != tt.wantPath {
+				t.Errorf("path = %s, want %s", got, tt.wantPath)
+			}
+		})
+	}
+
+	for _, path := range []string{"api/{{.DeviceID}}", "/api/{{.DeviceID", "/api/{{.Device}}"} {
+		cfg := DefaultConfig()
+		cfg.APIPath = path
+		if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "api-path") {
+			t.Errorf("Validate with api-path %q: error = %v", path, err)
+		}
+	}
+}
+
+func TestSendHTTPRequestBoolFormat(t *testing.T) {
+	for _, tt := range []struct{ format, on, off string }{
+		{BoolTrueFalse, "true", "false"},
+		{BoolOneZero, "1", "0"},
+		{BoolOnOff, "on", "off"},
+	} {
+		t.Run(tt.format, func(t *testing.T) {
+			api := newFakeDeviceAPI(t, http.StatusOK)
+			cfg := DefaultConfig()
+			cfg.APIBaseURL = api.URL
+			cfg.APIBody = BodyForm
+			cfg.APIBoolFormat = tt.format
+			c := newTestClient(t, cfg)
+
+			for _, on := range []bool{true, false} {
+				if _, err := c.sendHTTPRequest(context.Background(), Command{DeviceID: "stack-1", Mode: "red", TurnOn: on}); err != nil {
+					t.Fatalf("sendHTTPRequest: %v", err)
+				}
+			}
+			for i, want := range []string{tt.on, tt.off} {
+				req := api.Requests()[i]
+				if got := req.Query.Get("turnOn"); got != want {
+					t.Errorf("request %d query turnOn = %q, want %q", i, got, want)
+				}
+				form, _ := url.ParseQuery(string(req.Body))
+				if got := form.Get("turnOn"); got != want {
+					t.Errorf("request %d form turnOn = %q, want %q", i, got, want)
+				}
+			}
+		})
+	}
+
+	cfg := DefaultConfig()
+	cfg.APIBoolFormat = "yes/no"
+	if _, err := New(cfg); err == nil || !strings.Contains(err.Error(), "api-bool-format") {
+		t.Errorf("New with an unknown bool format: error = %v", err)
+	}
+}
+
+func TestUserAgent(t *testing.T) {
+	tests := []struct {
+		name      string
+		userAgent string
+		header    string
+		want      string
+	}{
+		{"default", "", "", DefaultUserAgent()},
+		{"configured", "dock-7/2.0", "", "dock-7/2.0"},
+		{"explicit header", "dock-7/2.0", "edge-proxy", "edge-proxy"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := newFakeDeviceAPI(t, http.StatusOK)
+			cfg := DefaultConfig()
+			cfg.APIBaseURL = api.URL
+			cfg.UserAgent = tt.userAgent
+			if tt.header != "" {
+				cfg.APIHeaders.Set("User-Agent", tt.header)
+				cfg.WSHeaders.Set("User-Agent", tt.header)
+			}
+			c := newTestClient(t, cfg)
+
+			if _, err := c.sendHTTPRequest(context.Background(), Command{DeviceID: "stack-1", Mode: "red"}); err != nil {
+				t.Fatalf("sendHTTPRequest: %v", err)
+			}
+			if got := api.Requests()[0].Header.Get("User-Agent"); got != tt.want {
+				t.Errorf("device API User-Agent = %q, want %q", got, tt.want)
+			}
+			if got := c.header.Get("User-Agent"); got != tt.want {
+				t.Errorf("WebSocket User-Agent = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSendHTTPRequestBody(t *testing.T) {
+	cmd := Command{DeviceID: "stack-1", Mode: "steady", TurnOn: true, Brightness: intPtr(80), Color: "#ff0000", Priority: 5, RequestID: "req-1"}
+	tests := []struct {
+		name            string
+		query           bool
+		body            string
+		fields          map[string]string
+		wantQuery       string
+		wantBody        string
+		wantContentType string
+	}{
+		{
+			name:            "query only",
+			query:           true,
+			body:            BodyNone,
+			wantQuery:       "brightness=80&color=%23ff0000&mode=steady&turnOn=true",
+			wantContentType: "application/json",
+		},
+		{
+			name:            "json only",
+			body:            BodyJSON,
+			wantBody:        `{"brightness":80,"color":"#ff0000","device_id":"stack-1","mode":"steady","turnOn":true}`,
+			wantContentType: "application/json",
+		},
+		{
+			name:            "json and query with renamed fields",
+			query:           true,
+			body:            BodyJSON,
+			fields:          map[string]string{"turnOn": "on", "device_id": "-"},
+			wantQuery:       "brightness=80&color=%23ff0000&mode=steady&turnOn=true",
+			wantBody:        `{"brightness":80,"color":"#ff0000","mode":"steady","on":true}`,
+			wantContentType: "application/json",
+		},
+		{
+			name:            "form",
+			body:            BodyForm,
+			fields:          map[string]string{"color": "-"},
+			wantBody:        "brightness=80&device_id=stack-1&mode=steady&turnOn=true",
+			wantContentType: "application/x-www-form-urlencoded",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := newFakeDeviceAPI(t, http.StatusOK)
+
+			cfg := DefaultConfig()
+			cfg.APIBaseURL = api.URL
+			cfg.APIQuery = tt.query
+			cfg.APIBody = tt.body
+			cfg.APIBodyFields = tt.fields
+			c := newTestClient(t, cfg)
+
+			if _, err := c.sendHTTPRequest(context.Background(), cmd); err != nil {
+				t.Fatalf("sendHTTPRequest: %v", err)
+			}
+			req := api.Requests()[0]
+			if got := req.Query.Encode(); got != tt.wantQuery {
+				t.Errorf("query = %q, want %q", got, tt.wantQuery)
+			}
+			if got := string(req.Body); got != tt.wantBody {
+				t.Errorf("body = %s, want %s", got, tt.wantBody)
+			}
+			if got := req.Header.Get("Content-Type"); got != tt.wantContentType {
+				t.Errorf("Content-Type = %q, want %q", got, tt.wantContentType)
+			}
+		})
+	}
+
+	cfg := DefaultConfig()
+	cfg.APIQuery = false
+	if _, err := New(cfg); err == nil {
+		t.Error("New accepted a config that sends neither query parameters nor a body")
+	}
+	cfg = DefaultConfig()
+	cfg.APIBody = BodyJSON
+	cfg.APIBodyFields = map[string]string{"turnon": "on"}
+	if _, err := New(cfg); err == nil {
+		t.Error("New accepted an unknown body field")
+	}
+}
+
+func BenchmarkSendHTTPRequest(b *testing.B) {
+	cfg := DefaultConfig()
+	cfg.HTTPDoer = nopDoer
+	cfg.Logger = slog.New(slog.DiscardHandler)
+	c, err := New(cfg)
+	if err != nil {
+		b.Fatalf("New: %v", err)
+	}
+	cmd := Command{DeviceID: "stack-1", Mode: "red", TurnOn: true, RequestID: "req-1", IdempotencyKey: "key-1"}
+	ctx := context.Background()
+
+	b.ReportAllocs()
+	for b.Loop() {
+		if _, err := c.sendHTTPRequest(ctx, cmd); err != nil {
+			b.Fatalf("sendHTTPRequest: %v", err)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package lightstack
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	commandsReceived = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "lightstack_commands_received_total",
+		Help: "Commands read from the WebSocket connection.",
+	})
+	commandsMalformed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "lightstack_commands_malformed_total",
+		Help: "Messages skipped because they could not be decoded as a command.",
+	})
+	commandsFiltered = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "lightstack_commands_filtered_total",
+		Help: "Commands dropped because their device is excluded by the device allow or deny list.",
+	})
+	commandsDeduplicated = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "lightstack_commands_deduplicated_total",
+		Help: "Commands dropped because an identical one arrived within the dedup window.",
+	})
+	commandsCoalesced = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "lightstack_commands_coalesced_total",
+		Help: "Commands that shared the device API call of an identical command already in flight.",
+	})
+	commandsQueued = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "lightstack_commands_queued",
+		Help: "Commands waiting for a worker or a batch.",
+	})
+	commandsInFlight = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "lightstack_commands_in_flight",
+		Help: "Commands being sent to the device API, including retries.",
+	})
+	commandLatency = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "lightstack_command_duration_seconds",
+		Help:    "Time from receiving a command to completing it, including queueing and retries.",
+		Buckets: prometheus.ExponentialBuckets(0.01, 2, 12),
+	})
+	httpRequestsSent = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "lightstack_http_requests_total",
+		Help: "Requests sent to the device API, including retries.",
+	})
+	httpFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "lightstack_http_failures_total",
+		Help: "Failed device API requests by response status; \"error\" means no response was received.",
+	}, []string{"status"})
+	httpLatency = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "lightstack_http_request_duration_seconds",
+		Help:    "Latency of device API requests.",
+		Buckets: prometheus.DefBuckets,
+	})
+	httpSlotWaits = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "lightstack_http_in_flight_waits_total",
+		Help: "Device API requests that had to wait because http-max-in-flight requests were already in flight.",
+	})
+	httpSlotWait = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "lightstack_http_in_flight_wait_seconds",
+		Help:    "Time device API requests waited for a free slot under http-max-in-flight, for those that had to wait.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 4, 8),
+	})
+	httpShortCircuited = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "lightstack_http_short_circuited_total",
+		Help: "Device API requests failed immediately because the circuit breaker was open.",
+	})
+	circuitState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "lightstack_circuit_breaker_state",
+		Help: "Device API circuit breaker state by device: 0 closed, 1 open, 2 half-open. Only devices named in the device allow list without a glob are included.",
+	}, []string{"device"})
+	circuitsOpen = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "lightstack_circuit_breakers_open",
+		Help: "Device API circuit breakers that are open or half-open, across all devices and batch requests.",
+	})
+	shadowRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "lightstack_shadow_requests_total",
+		Help: "Commands mirrored to the shadow device API, by result: \"match\" or \"mismatch\" of its status with the primary's, or \"dropped\" when too many shadow requests were in flight.",
+	}, []string{"result"})
+	webhookFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "lightstack_webhook_failures_total",
+		Help: "Outcome webhook notifications that were dropped or could not be delivered.",
+	})
+	wsDisconnects = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "lightstack_ws_disconnects_total",
+		Help: "WebSocket connections that ended, by reason: \"normal\" for a normal or going-away close from the server, \"idle\" for the idle watchdog, \"write\" when a ping could not be written, \"failback\" when leaving a failover endpoint for the primary, \"error\" for anything else.",
+	}, []string{"reason"})
+	reconnects = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "lightstack_reconnects_total",
+		Help: "WebSocket reconnect attempts after a failed dial or a lost connection.",
+	})
+)
+
+func observeHTTPRequest(start time.Time, err error) {
+	httpRequestsSent.Inc()
+	httpLatency.Observe(time.Since(start).Seconds())
+	if err == nil {
+		return
+	}
+
+	status := "error"
+	var se *HTTPStatusError
+	if errors.As(err, &se) {
+		status = strconv.Itoa(se.StatusCode)
+	}
+	httpFailures.WithLabelValues(status).Inc()
+}
@@ -0,0 +1,73 @@
+package lightstack
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// natsSink publishes each command as JSON to a NATS subject instead of
+// calling the device API. A command counts as delivered once the server has
+// confirmed receipt with a flush.
+type natsSink struct {
+	conn    *nats.Conn
+	subject string
+	timeout time.Duration
+	dryRun  bool
+	log     *slog.Logger
+}
+
+func newNATSSink(cfg Config, logger *slog.Logger) (*natsSink, error) {
+	conn, err := nats.Connect(cfg.NATSURL,
+		nats.Name("light-stack-connector"),
+		nats.RetryOnFailedConnect(true),
+		nats.MaxReconnects(-1),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			logger.Warn("Disconnected from NATS", "event", "nats_disconnected", "error", err)
+		}),
+		nats.ReconnectHandler(func(nc *nats.Conn) {
+			logger.Info("Reconnected to NATS", "event", "nats_reconnected", "url", redactURL(nc.ConnectedUrl()))
+		}),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to NATS: %w", err)
+	}
+	logger.Info("Publishing commands to NATS", "event", "nats_sink", "url", redactURL(cfg.NATSURL), "subject", cfg.NATSSubject)
+	return &natsSink{conn: conn, subject: cfg.NATSSubject, timeout: cfg.HTTPTimeout, dryRun: cfg.DryRun, log: logger}, nil
+}
+
+func (s *natsSink) Send(ctx context.Context, cmd Command) (Result, error) {
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return Result{}, fmt.Errorf("failed to encode command: %w", err)
+	}
+	logger := s.log.With(commandAttrs(cmd)...)
+	if s.dryRun {
+		logger.Info("Dry run, not publishing to NATS", "event", "nats_dry_run", "subject", s.subject, "body", string(data))
+		return Result{}, nil
+	}
+
+	msg := nats.NewMsg(s.subject)
+	msg.Data = data
+	// JetStream streams use Nats-Msg-Id to drop redelivered duplicates.
+	msg.Header.Set(nats.MsgIdHdr, cmd.IdempotencyKey)
+	logger.Info("Publishing to NATS", "event", "nats_publish", "subject", s.subject)
+	if err := s.conn.PublishMsg(msg); err != nil {
+		return Result{}, fmt.Errorf("failed to publish to %s: %w", s.subject, err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	if err := s.conn.FlushWithContext(ctx); err != nil {
+		return Result{}, fmt.Errorf("NATS server did not confirm publish to %s: %w", s.subject, err)
+	}
+	return Result{}, nil
+}
+
+func (s *natsSink) Close() {
+	s.conn.Close()
+}
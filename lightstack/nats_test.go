@@ -0,0 +1,159 @@
+package lightstack
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeNATSServer speaks just enough of the NATS protocol to accept
+// publishes and answer flushes.
+type fakeNATSServer struct {
+	ln net.Listener
+
+	mu   sync.Mutex
+	msgs []natsMsg
+}
+
+type natsMsg struct {
+	subject string
+	header  string
+	data    string
+}
+
+func newFakeNATSServer(t *testing.T) *fakeNATSServer {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeNATSServer{ln: ln}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeNATSServer) URL() string {
+	return "nats://" + s.ln.Addr().String()
+}
+
+func (s *fakeNATSServer) serve(conn net.Conn) {
+	io.WriteString(conn, `INFO {"server_id":"fake","version":"2.10.0","proto":1,"headers":true,"max_payload":1048576}`+"\r\n")
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch strings.ToUpper(fields[0]) {
+		case "PING":
+			io.WriteString(conn, "PONG\r\n")
+		case "HPUB":
+			// HPUB <subject> [reply] <header size> <total size>
+			hdrLen, _ := strconv.Atoi(fields[len(fields)-2])
+			total, _ := strconv.Atoi(fields[len(fields)-1])
+			buf := make([]byte, total+2)
+			if _, err := io.ReadFull(r, buf); err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.msgs = append(s.msgs, natsMsg{subject: fields[1], header: string(buf[:hdrLen]), data: string(buf[hdrLen:total])})
+			s.mu.Unlock()
+		}
+	}
+}
+
+func (s *fakeNATSServer) Messages() []natsMsg {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]natsMsg(nil), s.msgs...)
+}
+
+func TestClientPublishesToNATS(t *testing.T) {
+	srv := newFakeNATSServer(t)
+	src := &chanSource{cmds: []Command{{DeviceID: "stack-1", Mode: "red", TurnOn: true, RequestID: "req-1", IdempotencyKey: "key-1"}}}
+
+	cfg := DefaultConfig()
+	cfg.Source = src
+	cfg.NATSURL = srv.URL()
+	cfg.NATSSubject = "lights.commands"
+	cfg.Preflight = PreflightFail
+	c := newTestClient(t, cfg)
+
+	stop := runClient(t, c)
+	waitFor(t, "an ack", func() bool { return len(src.Acks()) == 1 })
+	stop()
+
+	if ack := src.Acks()[0]; ack.Outcome != ackOutcomeSuccess {
+		t.Errorf("ack = %+v, want success", ack)
+	}
+	msgs := srv.Messages()
+	if len(msgs) != 1 {
+		t.Fatalf("NATS got %d messages, want 1", len(msgs))
+	}
+	got := msgs[0]
+	if got.subject != "lights.commands" || !strings.Contains(got.header, "Nats-Msg-Id: key-1") || got.data != `{"device_id":"stack-1","mode":"red","turnOn":true,"request_id":"req-1","idempotency_key":"key-1"}` {
+		t.Errorf("message = %+v", got)
+	}
+
+	cfg.BatchWindow = 100 * time.Millisecond
+	if _, err := New(cfg); err == nil || !strings.Contains(err.Error(), "batch-window") {
+		t.Errorf("New with nats-url and batch-window: error = %v", err)
+	}
+}
+
+type funcSink func(ctx context.Context, cmd Command) (Result, error)
+
+func (f funcSink) Send(ctx context.Context, cmd Command) (Result, error) { return f(ctx, cmd) }
+
+func TestClientCustomSink(t *testing.T) {
+	src := &chanSource{cmds: []Command{{DeviceID: "stack-1", Mode: "red", TurnOn: true}}}
+	var mu sync.Mutex
+	var sent []string
+
+	cfg := DefaultConfig()
+	cfg.Source = src
+	cfg.HTTPMaxAttempts = 2
+	cfg.HTTPRetryBase = time.Millisecond
+	cfg.Sink = funcSink(func(_ context.Context, cmd Command) (Result, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		sent = append(sent, cmd.DeviceID)
+		if len(sent) == 1 {
+			return Result{}, errors.New("bus unavailable")
+		}
+		return Result{}, nil
+	})
+	c := newTestClient(t, cfg)
+
+	stop := runClient(t, c)
+	waitFor(t, "an ack", func() bool { return len(src.Acks()) == 1 })
+	stop()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(sent) != 2 || src.Acks()[0].Outcome != ackOutcomeSuccess {
+		t.Errorf("sink calls = %q, ack = %+v; want the failed send retried once and acked as success", sent, src.Acks()[0])
+	}
+}
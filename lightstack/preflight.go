@@ -0,0 +1,63 @@
+package lightstack
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Values for Config.Preflight.
+const (
+	PreflightOff  = "off"
+	PreflightWarn = "warn"
+	PreflightFail = "fail"
+)
+
+// preflight checks that every device API gateway answers a GET on
+// cfg.PreflightPath with a 2xx before any command is accepted. With
+// PreflightFail the first unreachable gateway is returned as an error;
+// with PreflightWarn failures are only logged.
+func (c *Client) preflight(ctx context.Context) error {
+	if c.cfg.Preflight == PreflightOff || !c.sendsToDeviceAPI() {
+		return nil
+	}
+	for _, baseURL := range c.live.Load().router.BaseURLs() {
+		checkURL := strings.TrimRight(baseURL, "/") + c.cfg.PreflightPath
+		err := c.checkHealth(ctx, checkURL)
+		if err == nil {
+			c.log.Info("Device API is reachable", "event", "preflight_ok", "base_url", redactURL(baseURL), "url", redactURL(checkURL))
+			continue
+		}
+		if c.cfg.Preflight == PreflightFail {
+			c.log.Error("Device API preflight check failed", "event", "preflight_failed", "base_url", redactURL(baseURL), "url", redactURL(checkURL), "error", err)
+			return fmt.Errorf("%w for %s: %w", ErrPreflight, redactURL(baseURL), err)
+		}
+		c.log.Warn("Device API preflight check failed, continuing", "event", "preflight_failed", "base_url", redactURL(baseURL), "url", redactURL(checkURL), "error", err)
+	}
+	return nil
+}
+
+func (c *Client) checkHealth(ctx context.Context, checkURL string) error {
+	ctx, cancel := context.WithTimeout(ctx, c.cfg.HTTPTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, checkURL, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create HTTP request: %w", err)
+	}
+	req.Header.Set("User-Agent", c.cfg.UserAgent)
+	for name, values := range c.cfg.APIHeaders {
+		req.Header[name] = values
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send HTTP request: %w", err)
+	}
+	defer closeBody(resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return &HTTPStatusError{StatusCode: resp.StatusCode}
+	}
+	return nil
+}
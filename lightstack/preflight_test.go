@@ -0,0 +1,82 @@
+package lightstack
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestPreflight(t *testing.T) {
+	tests := []struct {
+		name    string
+		mode    string
+		status  int
+		wantErr bool
+	}{
+		{name: "healthy", mode: PreflightFail, status: http.StatusOK},
+		{name: "fail", mode: PreflightFail, status: http.StatusServiceUnavailable, wantErr: true},
+		{name: "warn", mode: PreflightWarn, status: http.StatusServiceUnavailable},
+		{name: "off", mode: PreflightOff, status: http.StatusServiceUnavailable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := newFakeDeviceAPI(t, tt.status)
+
+			cfg := DefaultConfig()
+			cfg.APIBaseURL = api.URL
+			cfg.APIHeaders.Set("X-Api-Key", "secret")
+			cfg.Preflight = tt.mode
+			c := newTestClient(t, cfg)
+
+			err := c.preflight(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("preflight error = %v, want error %t", err, tt.wantErr)
+			}
+			if tt.wantErr && (!errors.Is(err, ErrPreflight) || !errors.Is(err, ErrHTTPStatus) || !strings.Contains(err.Error(), api.URL)) {
+				t.Errorf("error = %v, want ErrPreflight naming the base URL and wrapping the status", err)
+			}
+
+			reqs := api.Requests()
+			if tt.mode == PreflightOff {
+				if len(reqs) != 0 {
+					t.Errorf("got %d requests with preflight off", len(reqs))
+				}
+				return
+			}
+			if len(reqs) != 1 || reqs[0].Method != http.MethodGet || reqs[0].Path != "/healthz" {
+				t.Fatalf("requests = %+v, want one GET /healthz", reqs)
+			}
+			if got := reqs[0].Header.Get("X-Api-Key"); got != "secret" {
+				t.Errorf("X-Api-Key = %q, want the configured API header", got)
+			}
+		})
+	}
+}
+
+func TestPreflightChecksEveryGateway(t *testing.T) {
+	fallback := newFakeDeviceAPI(t, http.StatusOK)
+	routed := newFakeDeviceAPI(t, http.StatusOK)
+
+	cfg := DefaultConfig()
+	cfg.APIBaseURL = fallback.URL
+	cfg.APIRoutes = []APIRoute{
+		{DeviceID: "stack-7", BaseURL: routed.URL},
+		{Prefix: "dock-", BaseURL: routed.URL + "/"},
+	}
+	cfg.Preflight = PreflightFail
+	cfg.PreflightPath = "/status"
+	c := newTestClient(t, cfg)
+
+	if err := c.preflight(context.Background()); err != nil {
+		t.Fatalf("preflight: %v", err)
+	}
+	if reqs := fallback.Requests(); len(reqs) != 1 || reqs[0].Path != "/status" {
+		t.Errorf("fallback requests = %+v, want one GET /status", reqs)
+	}
+	if reqs := routed.Requests(); len(reqs) != 1 {
+		t.Errorf("routed gateway got %d requests, want 1", len(reqs))
+	}
+}
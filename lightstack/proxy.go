@@ -0,0 +1,53 @@
+package lightstack
+
+import (
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// proxyFunc picks the proxy for outgoing connections: cfg.Proxy if set,
+// otherwise HTTP_PROXY, HTTPS_PROXY and NO_PROXY from the environment.
+func proxyFunc(cfg Config) func(*http.Request) (*url.URL, error) {
+	if cfg.Proxy == "" {
+		return http.ProxyFromEnvironment
+	}
+	// Validate has already checked that the URL parses.
+	u, _ := url.Parse(cfg.Proxy)
+	return http.ProxyURL(u)
+}
+
+// logProxy reports at startup which proxy, if any, the device API client
+// and the WebSocket dialer use.
+func logProxy(cfg Config, log *slog.Logger) {
+	source := "environment"
+	if cfg.Proxy != "" {
+		source = "config"
+	}
+	attrs := []any{"event", "proxy_config", "source", source}
+	if cfg.HTTPDoer == nil {
+		attrs = append(attrs, "api_proxy", resolveProxy(cfg, cfg.APIBaseURL))
+	}
+	if cfg.Dialer == nil && cfg.Source == nil {
+		// The dialer asks for the proxy of the equivalent http(s) URL.
+		wsURL := strings.Replace(strings.Replace(cfg.WSURL, "wss://", "https://", 1), "ws://", "http://", 1)
+		attrs = append(attrs, "ws_proxy", resolveProxy(cfg, wsURL))
+	}
+	log.Info("Outgoing proxy settings", attrs...)
+}
+
+func resolveProxy(cfg Config, target string) string {
+	req, err := http.NewRequest(http.MethodGet, target, nil)
+	if err != nil {
+		return "unknown"
+	}
+	u, err := proxyFunc(cfg)(req)
+	if err != nil {
+		return "invalid: " + err.Error()
+	}
+	if u == nil {
+		return "none"
+	}
+	return u.Redacted()
+}
@@ -0,0 +1,53 @@
+package lightstack
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+)
+
+func TestSendHTTPRequestUsesConfiguredProxy(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		proxied []string
+	)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		proxied = append(proxied, r.URL.String())
+		mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(proxy.Close)
+
+	cfg := DefaultConfig()
+	cfg.APIBaseURL = "http://device-api.invalid:8080"
+	cfg.Proxy = proxy.URL
+	c := newTestClient(t, cfg)
+
+	if _, err := c.sendHTTPRequest(context.Background(), Command{DeviceID: "stack-1", Mode: "red", TurnOn: true}); err != nil {
+		t.Fatalf("sendHTTPRequest: %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	want := "http://device-api.invalid:8080/api/device/gpo/light/stack-1?mode=red&turnOn=true"
+	if len(proxied) != 1 || proxied[0] != want {
+		t.Errorf("proxied requests = %q, want [%q]", proxied, want)
+	}
+}
+
+func TestWSDialerUsesConfiguredProxy(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Proxy = "socks5://127.0.0.1:1080"
+	d, err := newWSDialer(cfg)
+	if err != nil {
+		t.Fatalf("newWSDialer: %v", err)
+	}
+	req := &http.Request{URL: &url.URL{Scheme: "https", Host: "example.com"}}
+	u, err := d.Proxy(req)
+	if err != nil || u == nil || u.String() != cfg.Proxy {
+		t.Errorf("dialer proxy = %v, %v; want %s", u, err, cfg.Proxy)
+	}
+}
@@ -0,0 +1,282 @@
+package lightstack
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Queue holds commands that could not be delivered to the device API so they
+// can be replayed later.
+type Queue interface {
+	// Enqueue appends cmd, dropping the oldest entry if the queue is full.
+	Enqueue(cmd Command) error
+	// Peek returns the oldest entry without removing it.
+	Peek() (Command, bool)
+	// Dequeue removes and returns the oldest entry.
+	Dequeue() (Command, bool, error)
+	Len() int
+}
+
+// queueEntry is one line of a queue file. ReceivedAt lets a replay tell
+// whether a newer command for the device has succeeded since; entries
+// written before it was added read as received before any live command.
+type queueEntry struct {
+	Command
+	ReceivedAt time.Time `json:"received_at,omitzero"`
+}
+
+// fileQueue is a Queue persisted as a JSON-lines file. The whole file is
+// rewritten on every change, which is fine for the few hundred entries an
+// outage produces.
+type fileQueue struct {
+	path    string
+	maxSize int
+	log     *slog.Logger
+
+	mu    sync.Mutex
+	items []Command
+}
+
+func openFileQueue(path string, maxSize int, logger *slog.Logger) (*fileQueue, error) {
+	q := &fileQueue{path: path, maxSize: maxSize, log: logger}
+
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return q, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open queue file: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry queueEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("failed to parse queue file %s: %w", path, err)
+		}
+		entry.Command.receivedAt = entry.ReceivedAt
+		q.items = append(q.items, entry.Command)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read queue file: %w", err)
+	}
+	if len(q.items) > q.maxSize {
+		q.items = q.items[len(q.items)-q.maxSize:]
+	}
+	return q, nil
+}
+
+func (q *fileQueue) Enqueue(cmd Command) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.items = append(q.items, cmd)
+	if len(q.items) > q.maxSize {
+		dropped := q.items[0]
+		q.items = q.items[1:]
+		q.log.Warn("Queue full, dropping oldest command", append(commandAttrs(dropped), "event", "queue_dropped", "max_size", q.maxSize)...)
+	}
+	return q.persist()
+}
+
+func (q *fileQueue) Peek() (Command, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.items) == 0 {
+		return Command{}, false
+	}
+	return q.items[0], true
+}
+
+func (q *fileQueue) Dequeue() (Command, bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.items) == 0 {
+		return Command{}, false, nil
+	}
+	cmd := q.items[0]
+	q.items = q.items[1:]
+	return cmd, true, q.persist()
+}
+
+func (q *fileQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.items)
+}
+
+// persist atomically replaces the queue file with the current items. The
+// caller must hold q.mu.
+func (q *fileQueue) persist() error {
+	tmp, err := os.CreateTemp(filepath.Dir(q.path), filepath.Base(q.path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create queue file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	for _, cmd := range q.items {
+		if err := enc.Encode(queueEntry{Command: cmd, ReceivedAt: cmd.receivedAt}); err != nil {
+			tmp.Close()
+			return fmt.Errorf("failed to encode queued command: %w", err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write queue file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write queue file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), q.path); err != nil {
+		return fmt.Errorf("failed to replace queue file: %w", err)
+	}
+	return nil
+}
+
+// replayer persists undeliverable commands and re-sends them once the device
+// API is reachable again. A nil *replayer disables persistence.
+type replayer struct {
+	client   *Client
+	queue    Queue
+	interval time.Duration
+	kick     chan struct{}
+	// draining serializes drain between Run and the shutdown flush.
+	draining sync.Mutex
+
+	mu sync.Mutex
+	// succeeded holds, per device, when the newest command that succeeded
+	// live was received. Queued commands received before it are stale.
+	succeeded map[string]time.Time
+}
+
+func newReplayer(client *Client, queue Queue, interval time.Duration) *replayer {
+	return &replayer{client: client, queue: queue, interval: interval, kick: make(chan struct{}, 1), succeeded: make(map[string]time.Time)}
+}
+
+// Succeeded records that cmd reached the device live, superseding queued
+// commands for its device received before it, and schedules a replay.
+func (r *replayer) Succeeded(cmd Command) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	if cmd.receivedAt.After(r.succeeded[cmd.DeviceID]) {
+		r.succeeded[cmd.DeviceID] = cmd.receivedAt
+	}
+	r.mu.Unlock()
+	r.Kick()
+}
+
+// superseded reports whether a command for cmd's device received after it
+// has already succeeded. Commands without a receipt time, such as those
+// queued by an earlier run, count as received before any live command.
+func (r *replayer) superseded(cmd Command) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	newest, ok := r.succeeded[cmd.DeviceID]
+	return ok && !cmd.receivedAt.After(newest)
+}
+
+// Persist stores cmd for a later replay if the failure may be transient.
+// Commands rejected with a 4xx response are not kept, and neither are those
+// a newer command for the same device has superseded.
+func (r *replayer) Persist(cmd Command, cause error) {
+	if r == nil {
+		return
+	}
+	var se *HTTPStatusError
+	if errors.As(cause, &se) && se.StatusCode < 500 {
+		return
+	}
+
+	logger := r.client.log.With(commandAttrs(cmd)...)
+	if r.superseded(cmd) {
+		logger.Info("Not persisting command, a newer one for the device succeeded", "event", "queue_superseded")
+		return
+	}
+	if err := r.queue.Enqueue(cmd); err != nil {
+		logger.Error("Failed to persist command", "event", "queue_failed", "error", err)
+		return
+	}
+	logger.Info("Command persisted for replay", "event", "queue_enqueued", "queue_len", r.queue.Len())
+}
+
+// Kick schedules a replay attempt without waiting for the next tick.
+func (r *replayer) Kick() {
+	if r == nil {
+		return
+	}
+	select {
+	case r.kick <- struct{}{}:
+	default:
+	}
+}
+
+func (r *replayer) Run(ctx context.Context) {
+	if r == nil {
+		return
+	}
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-r.kick:
+		}
+		r.drain(ctx)
+	}
+}
+
+// drain sends queued commands oldest first and stops at the first transient
+// failure, leaving that command at the head of the queue. Superseded
+// commands are dropped without being sent. It returns how many were
+// replayed successfully.
+func (r *replayer) drain(ctx context.Context) (replayed int) {
+	r.draining.Lock()
+	defer r.draining.Unlock()
+
+	for ctx.Err() == nil {
+		cmd, ok := r.queue.Peek()
+		if !ok {
+			return replayed
+		}
+
+		logger := r.client.log.With(commandAttrs(cmd)...)
+		if r.superseded(cmd) {
+			logger.Info("Dropping queued command, a newer one for the device succeeded", "event", "replay_superseded")
+		} else if _, err := r.client.sendHTTPRequestWithRetry(ctx, cmd, r.client.policy); err != nil {
+			var se *HTTPStatusError
+			if !errors.As(err, &se) || se.StatusCode >= 500 {
+				logger.Warn("Replay failed, will retry later", "event", "replay_failed", "error", err, "queue_len", r.queue.Len())
+				return replayed
+			}
+			logger.Error("Dropping queued command rejected by device API", "event", "replay_rejected", "error", err)
+		} else {
+			logger.Info("Replayed queued command", "event", "replay_success")
+			replayed++
+		}
+
+		if _, _, err := r.queue.Dequeue(); err != nil {
+			logger.Error("Failed to update queue", "event", "queue_failed", "error", err)
+			return replayed
+		}
+	}
+	return replayed
+}
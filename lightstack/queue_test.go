@@ -0,0 +1,66 @@
+package lightstack
+
+import (
+	"context"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReplaySkipsSupersededCommands(t *testing.T) {
+	api := newFakeDeviceAPI(t, http.StatusOK)
+
+	queuePath := filepath.Join(t.TempDir(), "queue.jsonl")
+	cfg := DefaultConfig()
+	cfg.APIBaseURL = api.URL
+	cfg.QueuePath = queuePath
+	c := newTestClient(t, cfg)
+
+	start := time.Now()
+	cmd := func(id string, turnOn bool, received time.Duration) Command {
+		cmd := Command{DeviceID: id, Mode: "red", TurnOn: turnOn}
+		cmd.receivedAt = start.Add(received)
+		return cmd
+	}
+	unavailable := &HTTPStatusError{StatusCode: http.StatusServiceUnavailable}
+
+	c.replay.Persist(cmd("stack-1", true, 0), unavailable)
+	c.replay.Persist(cmd("stack-2", true, time.Second), unavailable)
+	// A newer command for stack-1 succeeds live, then one received before
+	// it fails and one received after it fails.
+	c.replay.Succeeded(cmd("stack-1", false, 2*time.Second))
+	c.replay.Persist(cmd("stack-1", true, time.Second), unavailable)
+	c.replay.Persist(cmd("stack-1", true, 3*time.Second), unavailable)
+	if got := c.replay.queue.Len(); got != 3 {
+		t.Fatalf("queue holds %d commands, want 3; the one older than the live success should not be queued", got)
+	}
+
+	// What the queue file holds survives a restart with its receipt times.
+	q, err := openFileQueue(queuePath, cfg.QueueMaxSize, c.log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head, _ := q.Peek(); !head.receivedAt.Equal(start) {
+		t.Errorf("queue file head received at %s, want %s", head.receivedAt, start)
+	}
+
+	if replayed := c.replay.drain(context.Background()); replayed != 2 {
+		t.Errorf("replayed %d commands, want 2", replayed)
+	}
+	reqs := api.Requests()
+	if len(reqs) != 2 || reqs[0].Path != "/api/device/gpo/light/stack-2" || reqs[1].Path != "/api/device/gpo/light/stack-1" {
+		t.Fatalf("requests = %+v, want stack-2 and then the newer stack-1 command", reqs)
+	}
+	if c.replay.queue.Len() != 0 {
+		t.Errorf("queue holds %d commands after the replay, want 0", c.replay.queue.Len())
+	}
+
+	// Commands queued by an earlier run are older than any live command.
+	c.replay.Persist(Command{DeviceID: "stack-1", Mode: "red", TurnOn: true}, unavailable)
+	c.replay.Persist(Command{DeviceID: "stack-3", Mode: "red", TurnOn: true}, unavailable)
+	c.replay.drain(context.Background())
+	if reqs := api.Requests(); len(reqs) != 3 || reqs[2].Path != "/api/device/gpo/light/stack-3" {
+		t.Errorf("requests = %+v, want only stack-3 replayed", reqs)
+	}
+}
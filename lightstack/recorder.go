@@ -0,0 +1,94 @@
+package lightstack
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// recorder appends every received command, with its receive time, to a
+// JSON-lines file in the format -replay reads. Once the file reaches
+// maxSize bytes it is renamed to path + ".1", replacing any earlier one,
+// and a new file is started. A nil *recorder records nothing.
+type recorder struct {
+	path    string
+	maxSize int64
+	log     *slog.Logger
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+func openRecorder(path string, maxSize int64, logger *slog.Logger) (*recorder, error) {
+	r := &recorder{path: path, maxSize: maxSize, log: logger}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *recorder) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open record file: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to open record file: %w", err)
+	}
+	r.f, r.size = f, info.Size()
+	return nil
+}
+
+// Record appends cmd. Failures are logged rather than returned so that a
+// full disk does not stop commands from being processed.
+func (r *recorder) Record(cmd Command, receivedAt time.Time) {
+	if r == nil {
+		return
+	}
+	line, err := json.Marshal(recordedCommand{Command: cmd, RecordedAt: receivedAt})
+	if err != nil {
+		r.log.Warn("Failed to encode command for the record file", append(commandAttrs(cmd), "event", "record_failed", "error", err)...)
+		return
+	}
+	line = append(line, '\n')
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(line)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			r.log.Warn("Failed to rotate record file", "event", "record_failed", "path", r.path, "error", err)
+		}
+	}
+	if r.f == nil {
+		return
+	}
+	n, err := r.f.Write(line)
+	r.size += int64(n)
+	if err != nil {
+		r.log.Warn("Failed to write command to the record file", append(commandAttrs(cmd), "event", "record_failed", "path", r.path, "error", err)...)
+	}
+}
+
+// rotate moves the current file aside and opens a new one. The caller must
+// hold r.mu.
+func (r *recorder) rotate() error {
+	r.f.Close()
+	r.f = nil
+	renameErr := os.Rename(r.path, r.path+".1")
+	if err := r.open(); err != nil {
+		return err
+	}
+	if renameErr != nil {
+		// Keep appending to the oversized file rather than losing records.
+		return renameErr
+	}
+	r.log.Info("Rotated record file", "event", "record_rotated", "path", r.path)
+	return nil
+}
@@ -0,0 +1,108 @@
+package lightstack
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func readRecords(t *testing.T, path string) []recordedCommand {
+	t.Helper()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var out []recordedCommand
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var rec recordedCommand
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			t.Fatalf("bad record line %q: %v", sc.Text(), err)
+		}
+		out = append(out, rec)
+	}
+	return out
+}
+
+func TestClientRecordsCommands(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "record.jsonl")
+	src := &chanSource{cmds: []Command{
+		{DeviceID: "stack-1", Mode: "red", TurnOn: true},
+		{DeviceID: "stack-2"},
+	}}
+	api := newFakeDeviceAPI(t, http.StatusOK)
+
+	cfg := DefaultConfig()
+	cfg.APIBaseURL = api.URL
+	cfg.Source = src
+	cfg.RecordPath = path
+	c := newTestClient(t, cfg)
+
+	before := time.Now()
+	stop := runClient(t, c)
+	waitFor(t, "an ack", func() bool { return len(src.Acks()) == 1 })
+	stop()
+
+	// The invalid command is recorded too: the file is an audit trail of
+	// everything received.
+	recs := readRecords(t, path)
+	if len(recs) != 2 || recs[0].DeviceID != "stack-1" || recs[1].DeviceID != "stack-2" {
+		t.Fatalf("records = %+v, want both commands", recs)
+	}
+	if recs[0].RequestID != src.Acks()[0].RequestID {
+		t.Errorf("recorded request ID %q, ack has %q", recs[0].RequestID, src.Acks()[0].RequestID)
+	}
+	if data, err := os.ReadFile(path); err != nil || bytes.Contains(data, []byte("idempotency_key")) {
+		t.Errorf("record file = %s, %v; want no idempotency key for commands that had none", data, err)
+	}
+	if recs[0].RecordedAt.Before(before) {
+		t.Errorf("recorded_at = %s, want the receive time", recs[0].RecordedAt)
+	}
+
+	// The file replays as is.
+	replayAPI := newFakeDeviceAPI(t, http.StatusOK)
+	cfg = DefaultConfig()
+	cfg.APIBaseURL = replayAPI.URL
+	cfg.ReplayPath = path
+	if err := newTestClient(t, cfg).Run(t.Context()); err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	if got := len(replayAPI.Requests()); got != 1 {
+		t.Errorf("replay sent %d requests, want 1", got)
+	}
+}
+
+func TestRecorderRotates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "record.jsonl")
+	r, err := openRecorder(path, 200, slog.New(slog.DiscardHandler))
+	if err != nil {
+		t.Fatalf("openRecorder: %v", err)
+	}
+
+	cmd := Command{DeviceID: "stack-1", Mode: "red", TurnOn: true, RequestID: "6f1c0a52-3a3e-4b8e-9d55-2f0e0c7b9a10"}
+	for range 5 {
+		r.Record(cmd, time.Now())
+	}
+
+	for _, p := range []string{path, path + ".1"} {
+		info, err := os.Stat(p)
+		if err != nil {
+			t.Fatalf("stat %s: %v", p, err)
+		}
+		if info.Size() > 200 {
+			t.Errorf("%s is %d bytes, want at most 200", p, info.Size())
+		}
+	}
+	if n := len(readRecords(t, path)) + len(readRecords(t, path+".1")); n < 2 || n > 5 {
+		t.Errorf("%d records kept across both files", n)
+	}
+}
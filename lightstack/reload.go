@@ -0,0 +1,102 @@
+package lightstack
+
+import (
+	"fmt"
+	"reflect"
+
+	"golang.org/x/time/rate"
+)
+
+// liveSettings are the parts of the configuration that Reload can replace
+// while the client runs. They are swapped as a whole, so a command never
+// sees the routes of one configuration and the filter of another.
+type liveSettings struct {
+	router  *router
+	filter  deviceFilter
+	limiter *rate.Limiter
+}
+
+// liveFields are the Config fields covered by liveSettings.
+var liveFields = map[string]bool{
+	"APIBaseURL":    true,
+	"APIRoutes":     true,
+	"APIRoutesPath": true,
+	"DeviceAllow":   true,
+	"DeviceDeny":    true,
+	"RateLimit":     true,
+	"RateBurst":     true,
+}
+
+func newLiveSettings(cfg Config) (*liveSettings, error) {
+	routes := cfg.APIRoutes
+	if routes == nil && cfg.APIRoutesPath != "" {
+		var err error
+		if routes, err = LoadAPIRoutes(cfg.APIRoutesPath); err != nil {
+			return nil, fmt.Errorf("failed to load api routes: %w", err)
+		}
+	}
+	s := &liveSettings{
+		router: newRouter(cfg.APIBaseURL, routes),
+		filter: deviceFilter{allow: cfg.DeviceAllow, deny: cfg.DeviceDeny},
+	}
+	if cfg.RateLimit > 0 {
+		s.limiter = rate.NewLimiter(rate.Limit(cfg.RateLimit), cfg.RateBurst)
+	}
+	return s, nil
+}
+
+// Reload validates cfg and applies its device API routing (APIBaseURL,
+// APIRoutes or APIRoutesPath, which is read again), device filter and rate
+// limit to the running client. Nothing is applied if cfg is invalid. The
+// names of other fields that differ from the configuration the client was
+// created with are returned; they only take effect after a restart. Fields
+// holding implementations, such as Source or Logger, are not compared.
+func (c *Client) Reload(cfg Config) (restartRequired []string, err error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	if cfg.UserAgent == "" {
+		cfg.UserAgent = DefaultUserAgent()
+	}
+	live, err := newLiveSettings(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	c.reloadMu.Lock()
+	defer c.reloadMu.Unlock()
+	if old := c.live.Load(); old.limiter != nil && live.limiter != nil && old.limiter.Limit() == live.limiter.Limit() && old.limiter.Burst() == live.limiter.Burst() {
+		// Keep the current limiter so an unchanged rate limit does not
+		// refill its bucket.
+		live.limiter = old.limiter
+	}
+	c.live.Store(live)
+	return changedFields(c.cfg, cfg), nil
+}
+
+// changedFields returns the names of the fields that differ between a and b,
+// other than liveFields and fields holding functions or interfaces.
+func changedFields(a, b Config) []string {
+	var changed []string
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	for i := range va.NumField() {
+		f := va.Type().Field(i)
+		if liveFields[f.Name] || holdsImplementation(f.Type) {
+			continue
+		}
+		if !reflect.DeepEqual(va.Field(i).Interface(), vb.Field(i).Interface()) {
+			changed = append(changed, f.Name)
+		}
+	}
+	return changed
+}
+
+func holdsImplementation(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Func, reflect.Interface, reflect.Pointer, reflect.Chan:
+		return true
+	case reflect.Slice:
+		return holdsImplementation(t.Elem())
+	}
+	return false
+}
@@ -0,0 +1,68 @@
+package lightstack
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestClientReload(t *testing.T) {
+	routes := filepath.Join(t.TempDir(), "routes.json")
+	if err := os.WriteFile(routes, []byte(`[{"prefix":"dock-","base_url":"http://dock"}]`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := DefaultConfig()
+	cfg.APIRoutesPath = routes
+	cfg.DeviceDeny = []string{"test-*"}
+	c := newTestClient(t, cfg)
+	limiterBefore := c.live.Load().limiter
+
+	if err := os.WriteFile(routes, []byte(`[{"prefix":"dock-","base_url":"http://dock2"}]`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	next := cfg
+	next.DeviceDeny = []string{"lab-*"}
+	next.RateLimit = 5
+	next.WSURL = "wss://other.example.com/light-stack"
+	next.Workers = 8
+	restart, err := c.Reload(next)
+	if err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	if !slices.Equal(restart, []string{"WSURL", "Workers"}) {
+		t.Errorf("restart required = %v, want WSURL and Workers", restart)
+	}
+
+	live := c.live.Load()
+	if got := live.router.BaseURL("dock-1"); got != "http://dock2" {
+		t.Errorf("dock-1 routes to %s after reload, want the routes file read again", got)
+	}
+	if !live.filter.Permits("test-1") || live.filter.Permits("lab-1") {
+		t.Error("device filter was not replaced")
+	}
+	if limiterBefore != nil || live.limiter == nil || live.limiter.Limit() != 5 {
+		t.Errorf("rate limiter = %v, want one allowing 5 requests per second", live.limiter)
+	}
+
+	invalid := next
+	invalid.DeviceDeny = []string{"["}
+	invalid.RateLimit = 10
+	if _, err := c.Reload(invalid); err == nil {
+		t.Fatal("Reload accepted an invalid device-deny pattern")
+	}
+	if c.live.Load() != live {
+		t.Error("an invalid configuration was partly applied")
+	}
+
+	same := next
+	same.BackoffMax = next.BackoffMax + time.Second
+	if restart, err := c.Reload(same); err != nil || !slices.Contains(restart, "BackoffMax") {
+		t.Errorf("Reload = %v, %v; want BackoffMax reported as requiring a restart", restart, err)
+	}
+	if c.live.Load().limiter != live.limiter {
+		t.Error("an unchanged rate limit replaced the limiter")
+	}
+}
@@ -0,0 +1,81 @@
+package lightstack
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+type retryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+func newRetryPolicy(cfg Config) retryPolicy {
+	return retryPolicy{
+		MaxAttempts: cfg.HTTPMaxAttempts,
+		BaseDelay:   cfg.HTTPRetryBase,
+		MaxDelay:    cfg.HTTPRetryMax,
+	}
+}
+
+// retryable reports whether a failed attempt is worth repeating. Network
+// errors and 5xx responses are; 4xx responses, an open circuit breaker and
+// cancellation are not.
+func retryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil || errors.Is(err, ErrCircuitOpen) {
+		return false
+	}
+	var se *HTTPStatusError
+	if errors.As(err, &se) {
+		return se.StatusCode >= 500
+	}
+	return true
+}
+
+func (c *Client) sendHTTPRequestWithRetry(ctx context.Context, cmd Command, policy retryPolicy) (Result, error) {
+	logger := c.log.With(commandAttrs(cmd)...)
+	res, shared, err := c.coalesce.Do(cmd, func() (Result, error) {
+		var res Result
+		attempts := 0
+		err := withRetry(ctx, policy, logger, func() error {
+			var err error
+			attempts++
+			res, err = c.sink.Send(ctx, cmd)
+			return err
+		})
+		res.Attempts = attempts
+		return res, err
+	})
+	if shared {
+		commandsCoalesced.Inc()
+		logger.Info("Shared the result of an identical in-flight command", "event", "command_coalesced", "error", err)
+	}
+	return res, err
+}
+
+// withRetry calls send until it succeeds, fails with a non-retryable error,
+// or policy.MaxAttempts is reached.
+func withRetry(ctx context.Context, policy retryPolicy, logger *slog.Logger, send func() error) error {
+	bo := newBackoff(policy.BaseDelay, policy.MaxDelay)
+
+	var err error
+	for attempt := 1; attempt <= policy.MaxAttempts; attempt++ {
+		err = send()
+		if err == nil {
+			logger.Info("HTTP request was successful", "event", "http_success", "attempt", attempt, "max_attempts", policy.MaxAttempts)
+			return nil
+		}
+		if !retryable(ctx, err) || attempt == policy.MaxAttempts {
+			return fmt.Errorf("attempt %d/%d: %w", attempt, policy.MaxAttempts, err)
+		}
+
+		delay := bo.Next()
+		logger.Warn("HTTP request failed, retrying", "event", "http_retry", "attempt", attempt, "max_attempts", policy.MaxAttempts, "error", err, "retry_in", delay)
+		sleepContext(ctx, delay)
+	}
+	return err
+}
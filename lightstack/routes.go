@@ -0,0 +1,106 @@
+package lightstack
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// APIRoute sends commands for matching devices to a different device API
+// gateway. Exactly one of DeviceID and Prefix is set.
+type APIRoute struct {
+	DeviceID string `json:"device_id,omitempty"`
+	Prefix   string `json:"prefix,omitempty"`
+	BaseURL  string `json:"base_url"`
+}
+
+// LoadAPIRoutes reads a JSON array of routes from path.
+func LoadAPIRoutes(path string) ([]APIRoute, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var routes []APIRoute
+	if err := json.Unmarshal(data, &routes); err != nil {
+		return nil, fmt.Errorf("invalid routes file %s: %w", path, err)
+	}
+	if err := validateAPIRoutes(routes); err != nil {
+		return nil, fmt.Errorf("invalid routes file %s: %w", path, err)
+	}
+	return routes, nil
+}
+
+func validateAPIRoutes(routes []APIRoute) error {
+	for i, r := range routes {
+		if (r.DeviceID == "") == (r.Prefix == "") {
+			return fmt.Errorf("route %d: exactly one of device_id and prefix must be set", i)
+		}
+		if err := validateURL("base_url", r.BaseURL, "http", "https"); err != nil {
+			return fmt.Errorf("route %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// router picks the device API base URL for a device: an exact device ID
+// match first, then the longest matching prefix, then the fallback.
+type router struct {
+	fallback string
+	exact    map[string]string
+	prefixes []APIRoute
+}
+
+func newRouter(fallback string, routes []APIRoute) *router {
+	r := &router{fallback: fallback, exact: map[string]string{}}
+	for _, route := range routes {
+		if route.DeviceID != "" {
+			r.exact[route.DeviceID] = route.BaseURL
+		} else {
+			r.prefixes = append(r.prefixes, route)
+		}
+	}
+	sort.SliceStable(r.prefixes, func(i, j int) bool {
+		return len(r.prefixes[i].Prefix) > len(r.prefixes[j].Prefix)
+	})
+	return r
+}
+
+func (r *router) BaseURL(deviceID string) string {
+	if u, ok := r.exact[deviceID]; ok {
+		return u
+	}
+	for _, route := range r.prefixes {
+		if strings.HasPrefix(deviceID, route.Prefix) {
+			return route.BaseURL
+		}
+	}
+	return r.fallback
+}
+
+// BaseURLs returns every distinct base URL the router can pick, starting
+// with the fallback. URLs that differ only by a trailing slash count once.
+func (r *router) BaseURLs() []string {
+	var out []string
+	seen := map[string]bool{}
+	add := func(u string) {
+		if key := strings.TrimRight(u, "/"); !seen[key] {
+			seen[key] = true
+			out = append(out, u)
+		}
+	}
+	add(r.fallback)
+	for _, route := range r.prefixes {
+		add(route.BaseURL)
+	}
+	ids := make([]string, 0, len(r.exact))
+	for id := range r.exact {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		add(r.exact[id])
+	}
+	return out
+}
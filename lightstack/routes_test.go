@@ -0,0 +1,82 @@
+package lightstack
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRouterBaseURL(t *testing.T) {
+	r := newRouter("http://default", []APIRoute{
+		{Prefix: "dock-", BaseURL: "http://dock"},
+		{Prefix: "dock-7", BaseURL: "http://dock7"},
+		{DeviceID: "dock-7a", BaseURL: "http://exact"},
+	})
+
+	tests := map[string]string{
+		"stack-1": "http://default",
+		"dock-1":  "http://dock",
+		"dock-71": "http://dock7",
+		"dock-7a": "http://exact",
+		"dock":    "http://default",
+	}
+	for id, want := range tests {
+		if got := r.BaseURL(id); got != want {
+			t.Errorf("BaseURL(%q) = %s, want %s", id, got, want)
+		}
+	}
+}
+
+func TestLoadAPIRoutes(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, body string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(body), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	routes, err := LoadAPIRoutes(write("ok.json", `[{"prefix":"dock-","base_url":"http://10.0.1.1:8080"}]`))
+	if err != nil {
+		t.Fatalf("LoadAPIRoutes: %v", err)
+	}
+	if len(routes) != 1 || routes[0].Prefix != "dock-" {
+		t.Errorf("routes = %+v", routes)
+	}
+
+	for name, body := range map[string]string{
+		"syntax.json":     `[{"prefix":`,
+		"both.json":       `[{"prefix":"a","device_id":"b","base_url":"http://x"}]`,
+		"neither.json":    `[{"base_url":"http://x"}]`,
+		"bad-scheme.json": `[{"prefix":"a","base_url":"ftp://x"}]`,
+	} {
+		if _, err := LoadAPIRoutes(write(name, body)); err == nil {
+			t.Errorf("%s: LoadAPIRoutes succeeded, want an error", name)
+		}
+	}
+}
+
+func TestSendHTTPRequestRouted(t *testing.T) {
+	fallback := newFakeDeviceAPI(t, http.StatusOK)
+	dock := newFakeDeviceAPI(t, http.StatusOK)
+
+	cfg := DefaultConfig()
+	cfg.APIBaseURL = fallback.URL
+	cfg.APIRoutes = []APIRoute{{Prefix: "dock-", BaseURL: dock.URL}}
+	c := newTestClient(t, cfg)
+
+	for _, id := range []string{"dock-1", "stack-1"} {
+		if _, err := c.sendHTTPRequest(context.Background(), Command{DeviceID: id, Mode: "red", TurnOn: true}); err != nil {
+			t.Fatalf("sendHTTPRequest(%s): %v", id, err)
+		}
+	}
+	if got := dock.Requests(); len(got) != 1 || got[0].Path != "/api/device/gpo/light/dock-1" {
+		t.Errorf("dock gateway requests = %+v, want dock-1 only", got)
+	}
+	if got := fallback.Requests(); len(got) != 1 || got[0].Path != "/api/device/gpo/light/stack-1" {
+		t.Errorf("default gateway requests = %+v, want stack-1 only", got)
+	}
+}
@@ -0,0 +1,52 @@
+package lightstack
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// MinSchemaVersion and MaxSchemaVersion are the range of command
+// schema_version values the connector understands. Commands without a
+// schema_version are treated as version 1.
+const (
+	MinSchemaVersion = 1
+	MaxSchemaVersion = 1
+)
+
+// schemaVersionsKey is the hello message field advertising the supported
+// schema versions.
+const schemaVersionsKey = "schema_versions"
+
+func validateSchemaVersion(v int) error {
+	if v != 0 && (v < MinSchemaVersion || v > MaxSchemaVersion) {
+		return fmt.Errorf("schema_version %d is not supported, want %d to %d", v, MinSchemaVersion, MaxSchemaVersion)
+	}
+	return nil
+}
+
+// helloWithSchemaVersions adds the supported schema versions to a hello
+// message that is a JSON object, unless it already lists them. Other hello
+// messages are sent unchanged.
+func helloWithSchemaVersions(hello string) string {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(hello), &fields); err != nil || fields == nil {
+		return hello
+	}
+	if _, ok := fields[schemaVersionsKey]; ok {
+		return hello
+	}
+
+	var versions []string
+	for v := MinSchemaVersion; v <= MaxSchemaVersion; v++ {
+		versions = append(versions, strconv.Itoa(v))
+	}
+	field := `"` + schemaVersionsKey + `":[` + strings.Join(versions, ",") + `]`
+
+	obj := strings.TrimSuffix(strings.TrimSpace(hello), "}")
+	if len(fields) > 0 {
+		field = "," + field
+	}
+	return obj + field + "}"
+}
@@ -0,0 +1,50 @@
+package lightstack
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestHelloWithSchemaVersions(t *testing.T) {
+	tests := []struct {
+		hello string
+		want  string
+	}{
+		{`{"type":"hello"}`, `{"type":"hello","schema_versions":[1]}`},
+		{` {"a":{"b":1}} `, `{"a":{"b":1},"schema_versions":[1]}`},
+		{`{}`, `{"schema_versions":[1]}`},
+		{`{"schema_versions":[3]}`, `{"schema_versions":[3]}`},
+		{`["hello"]`, `["hello"]`},
+		{`null`, `null`},
+	}
+	for _, tt := range tests {
+		if got := helloWithSchemaVersions(tt.hello); got != tt.want {
+			t.Errorf("helloWithSchemaVersions(%s) = %s, want %s", tt.hello, got, tt.want)
+		}
+	}
+}
+
+func TestClientSkipsUnsupportedSchemaVersion(t *testing.T) {
+	src := &chanSource{cmds: []Command{
+		{DeviceID: "stack-1", Mode: "red", TurnOn: true, SchemaVersion: MaxSchemaVersion + 1},
+		{DeviceID: "stack-2", Mode: "red", TurnOn: true, SchemaVersion: MaxSchemaVersion},
+		{DeviceID: "stack-3", Mode: "red", TurnOn: true},
+	}}
+	api := newFakeDeviceAPI(t, http.StatusOK)
+
+	cfg := DefaultConfig()
+	cfg.WSURL = ""
+	cfg.APIBaseURL = api.URL
+	cfg.Source = src
+	cfg.Workers = 1
+	c := newTestClient(t, cfg)
+
+	stop := runClient(t, c)
+	waitFor(t, "two acks", func() bool { return len(src.Acks()) == 2 })
+	stop()
+
+	reqs := api.Requests()
+	if len(reqs) != 2 || reqs[0].Path != "/api/device/gpo/light/stack-2" || reqs[1].Path != "/api/device/gpo/light/stack-3" {
+		t.Errorf("requests = %+v, want stack-2 and stack-3 only", reqs)
+	}
+}
@@ -0,0 +1,55 @@
+package lightstack
+
+import (
+	"sync"
+	"time"
+)
+
+// settler spaces out commands to the same device: once a command succeeds,
+// the next one for that device waits for the settle time of the mode that
+// succeeded. A nil settler never waits.
+type settler struct {
+	times   map[string]time.Duration
+	mu      sync.Mutex
+	readyAt map[string]time.Time
+}
+
+func newSettler(times map[string]time.Duration) *settler {
+	if len(times) == 0 {
+		return nil
+	}
+	return &settler{times: times, readyAt: make(map[string]time.Time)}
+}
+
+// Wait returns how long a command for deviceID has to wait before it is
+// sent.
+func (s *settler) Wait(deviceID string, now time.Time) time.Duration {
+	if s == nil {
+		return 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ready, ok := s.readyAt[deviceID]
+	if !ok {
+		return 0
+	}
+	if !now.Before(ready) {
+		delete(s.readyAt, deviceID)
+		return 0
+	}
+	return ready.Sub(now)
+}
+
+// Succeeded starts the settle time of cmd's mode for its device.
+func (s *settler) Succeeded(cmd Command, now time.Time) {
+	if s == nil {
+		return
+	}
+	d, ok := s.times[cmd.Mode]
+	if !ok || d <= 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.readyAt[cmd.DeviceID] = now.Add(d)
+}
@@ -0,0 +1,85 @@
+package lightstack
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"time"
+)
+
+// shadow mirrors commands to a second device API, such as a gateway being
+// migrated to, and compares its response status with the primary's. It
+// never delays or fails a command: requests run in the background, are not
+// retried, and are dropped while maxInFlight are outstanding. A nil
+// *shadow mirrors nothing.
+type shadow struct {
+	client  *Client
+	baseURL string
+	slots   chan struct{}
+}
+
+func newShadow(client *Client, baseURL string, maxInFlight int) *shadow {
+	return &shadow{client: client, baseURL: baseURL, slots: make(chan struct{}, maxInFlight)}
+}
+
+// Mirror sends cmd to the shadow API in the background, given the result
+// of sending it to the primary. The request is cancelled with ctx.
+func (s *shadow) Mirror(ctx context.Context, cmd Command, primary Result, primaryErr error) {
+	if s == nil {
+		return
+	}
+	logger := s.client.log.With(commandAttrs(cmd)...)
+	select {
+	case s.slots <- struct{}{}:
+	default:
+		shadowRequests.WithLabelValues("dropped").Inc()
+		logger.Debug("Too many shadow requests in flight, not mirroring command", "event", "shadow_dropped")
+		return
+	}
+
+	go func() {
+		defer func() { <-s.slots }()
+		status, err := s.send(ctx, cmd, primary.timeout)
+		if status == primary.StatusCode {
+			shadowRequests.WithLabelValues("match").Inc()
+			logger.Debug("Shadow device API agreed", "event", "shadow_match", "status", status)
+			return
+		}
+		shadowRequests.WithLabelValues("mismatch").Inc()
+		attrs := []any{"event", "shadow_mismatch", "primary_status", primary.StatusCode, "shadow_status", status}
+		if primaryErr != nil {
+			attrs = append(attrs, "primary_error", primaryErr)
+		}
+		if err != nil {
+			attrs = append(attrs, "shadow_error", err)
+		}
+		logger.Warn("Shadow device API response differs", attrs...)
+	}()
+}
+
+// send makes cmd's request to the shadow API with the primary's timeout,
+// or HTTPTimeout if the primary did not get as far as sending it, and
+// returns the response status, or 0 if there was no response.
+func (s *shadow) send(ctx context.Context, cmd Command, timeout time.Duration) (int, error) {
+	c := s.client
+	req, err := c.newAPIRequest(cmd, s.baseURL)
+	if err != nil {
+		return 0, err
+	}
+	if timeout == 0 {
+		timeout = c.cfg.HTTPTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	httpReq, err := http.NewRequestWithContext(ctx, req.method, req.url, bytes.NewReader(req.body))
+	if err != nil {
+		return 0, err
+	}
+	httpReq.Header = c.apiHeader(requestIDs{cmd.RequestID, cmd.IdempotencyKey}, req.contentType)
+	resp, err := c.httpClient.Do(httpReq)
+	if err != nil {
+		return 0, err
+	}
+	closeBody(resp.Body)
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,107 @@
+package lightstack
+
+import (
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClientMirrorsCommandsToShadow(t *testing.T) {
+	api := newFakeDeviceAPI(t, http.StatusOK)
+	shadowAPI := newFakeDeviceAPI(t, http.StatusServiceUnavailable)
+	shadowAPI.SetDelay(300 * time.Millisecond)
+
+	src := &chanSource{cmds: []Command{{DeviceID: "stack-1", Mode: "red", TurnOn: true, RequestID: "req-1"}}}
+	var logs syncBuffer
+	cfg := DefaultConfig()
+	cfg.WSURL = ""
+	cfg.APIBaseURL = api.URL
+	cfg.ShadowAPIBaseURL = shadowAPI.URL
+	cfg.Source = src
+	cfg.Logger = slog.New(slog.NewTextHandler(&logs, nil))
+	c, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	stop := runClient(t, c)
+	start := time.Now()
+	waitFor(t, "the ack", func() bool { return len(src.Acks()) == 1 })
+	if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+		t.Errorf("ack took %s, want it not to wait for the shadow API", elapsed)
+	}
+	if ack := src.Acks()[0]; ack.Outcome != ackOutcomeSuccess {
+		t.Errorf("ack = %+v, want the primary's success", ack)
+	}
+	waitFor(t, "the mismatch", func() bool { return strings.Contains(logs.String(), "event=shadow_mismatch") })
+	stop()
+
+	reqs := shadowAPI.Requests()
+	if len(reqs) != 1 || reqs[0].Path != "/api/device/gpo/light/stack-1" || reqs[0].Header.Get("X-Request-ID") != "req-1" {
+		t.Errorf("shadow requests = %+v, want the command's request", reqs)
+	}
+	if out := logs.String(); !strings.Contains(out, "primary_status=200 shadow_status=503") {
+		t.Errorf("mismatch does not report both statuses; logs:\n%s", out)
+	}
+	if got := len(api.Requests()); got != 1 {
+		t.Errorf("primary received %d requests, want 1 despite the failing shadow", got)
+	}
+}
+
+func TestShadowFollowsPrimaryTimeoutAndShutdown(t *testing.T) {
+	tests := []struct {
+		name      string
+		cmd       Command
+		stopFirst bool
+		wantErr   string
+	}{
+		{"primary timeout", Command{DeviceID: "stack-1", Mode: "red", TimeoutMS: 100}, false, "context deadline exceeded"},
+		{"shutdown", Command{DeviceID: "stack-1", Mode: "red"}, true, "context canceled"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := newFakeDeviceAPI(t, http.StatusOK)
+			shadowAPI := newFakeDeviceAPI(t, http.StatusOK)
+			shadowAPI.SetDelay(700 * time.Millisecond)
+
+			src := &chanSource{cmds: []Command{tt.cmd}}
+			var logs syncBuffer
+			cfg := DefaultConfig()
+			cfg.WSURL = ""
+			cfg.APIBaseURL = api.URL
+			cfg.ShadowAPIBaseURL = shadowAPI.URL
+			cfg.Source = src
+			cfg.HTTPTimeout = 5 * time.Second
+			cfg.Logger = slog.New(slog.NewTextHandler(&logs, nil))
+			c, err := New(cfg)
+			if err != nil {
+				t.Fatalf("New: %v", err)
+			}
+
+			stop := runClient(t, c)
+			waitFor(t, "the ack", func() bool { return len(src.Acks()) == 1 })
+			waitFor(t, "the shadow request", func() bool { return len(shadowAPI.Requests()) == 1 })
+			start := time.Now()
+			if tt.stopFirst {
+				stop()
+			}
+			waitFor(t, "the mismatch", func() bool { return strings.Contains(logs.String(), "event=shadow_mismatch") })
+			if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+				t.Errorf("shadow request ended after %s, want it cut short", elapsed)
+			}
+			if !tt.stopFirst {
+				stop()
+			}
+
+			out := logs.String()
+			if !strings.Contains(out, tt.wantErr) {
+				t.Errorf("mismatch does not report %q; logs:\n%s", tt.wantErr, out)
+			}
+			if tt.cmd.TimeoutMS > 0 && strings.Count(out, "event=http_timeout_override") != 1 {
+				t.Errorf("command timeout logged %d times, want once; logs:\n%s", strings.Count(out, "event=http_timeout_override"), out)
+			}
+		})
+	}
+}
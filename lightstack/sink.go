@@ -0,0 +1,51 @@
+package lightstack
+
+import "context"
+
+// Sink acts on a validated command, by default by calling the device API.
+// It parallels CommandSource on the ingress side: the Client retries,
+// coalesces, queues and acks whatever a sink does the same way.
+type Sink interface {
+	// Send delivers cmd. Errors are retried unless they wrap an
+	// *HTTPStatusError with a 4xx status or ErrCircuitOpen.
+	Send(ctx context.Context, cmd Command) (Result, error)
+}
+
+// Executor is a Sink for actions that only succeed or fail, such as
+// driving GPIO on the same host. Set Config.Executor to use one.
+type Executor interface {
+	// Execute acts on cmd. Errors are retried like those of Sink.Send.
+	Execute(ctx context.Context, cmd Command) error
+}
+
+// ExecutorFunc adapts a function to an Executor.
+type ExecutorFunc func(ctx context.Context, cmd Command) error
+
+func (f ExecutorFunc) Execute(ctx context.Context, cmd Command) error {
+	return f(ctx, cmd)
+}
+
+// executorSink runs an Executor as a Sink.
+type executorSink struct {
+	exec Executor
+}
+
+func (s executorSink) Send(ctx context.Context, cmd Command) (Result, error) {
+	return Result{}, s.exec.Execute(ctx, cmd)
+}
+
+// httpSink is the default Sink: one device API request per command.
+type httpSink struct {
+	client *Client
+}
+
+func (s httpSink) Send(ctx context.Context, cmd Command) (Result, error) {
+	return s.client.sendHTTPRequest(ctx, cmd)
+}
+
+// sendsToDeviceAPI reports whether commands go to the device API, which
+// preflight checks and batch requests depend on.
+func (c *Client) sendsToDeviceAPI() bool {
+	_, ok := c.sink.(httpSink)
+	return ok
+}
@@ -0,0 +1,19 @@
+package lightstack
+
+import "context"
+
+// CommandSource delivers commands from a transport such as a WebSocket
+// connection or a message broker. The Client validates, deduplicates and
+// dispatches whatever a source delivers, regardless of where it came from.
+type CommandSource interface {
+	// Run sends received commands on out until ctx is cancelled, handling
+	// reconnects itself. It must not close out, and returns nil once ctx is
+	// cancelled or an error if the source cannot continue. A finite source
+	// may also return nil once it has sent everything; the Client then
+	// finishes the commands already dispatched and Run returns.
+	Run(ctx context.Context, out chan<- Command) error
+
+	// Ack reports the outcome of a delivered command back over the
+	// transport. Sources without a return channel can return nil.
+	Ack(ack Ack) error
+}
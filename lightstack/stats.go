@@ -0,0 +1,93 @@
+package lightstack
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Stats is a snapshot of a Client's activity since it was created.
+type Stats struct {
+	// State is the most recent connection state, StateDisconnected before
+	// Run is first called.
+	State            State
+	Connected        bool
+	LastConnected    time.Time
+	LastDisconnected time.Time
+	// LastError is the most recent dial or connection error, or nil.
+	LastError  error
+	Reconnects uint64
+
+	CommandsReceived  uint64
+	CommandsMalformed uint64
+	// CommandsSkipped counts commands that were received but not sent:
+	// invalid, rejected by a transform, filtered, duplicate, or dropped at
+	// shutdown.
+	CommandsSkipped   uint64
+	CommandsSucceeded uint64
+	CommandsFailed    uint64
+	CommandsQueued    int64
+	CommandsInFlight  int64
+}
+
+// clientStats backs Client.Stats. Counters are atomics; the connection
+// fields change together and share a mutex.
+type clientStats struct {
+	received, malformed, skipped, succeeded, failed, reconnects atomic.Uint64
+	queued, inFlight                                            atomic.Int64
+
+	mu               sync.Mutex
+	state            State
+	lastConnected    time.Time
+	lastDisconnected time.Time
+	lastErr          error
+}
+
+func newClientStats() *clientStats {
+	return &clientStats{state: StateDisconnected}
+}
+
+func (s *clientStats) recordState(state State, err error, at time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.state = state
+	switch state {
+	case StateConnected:
+		s.lastConnected = at
+	case StateDisconnected:
+		s.lastDisconnected = at
+	}
+	if err != nil {
+		s.lastErr = err
+	}
+}
+
+// Stats returns a snapshot of the client's counters and connection state.
+// It is safe to call from any goroutine.
+func (c *Client) Stats() Stats {
+	s := c.stats
+	st := Stats{
+		Connected:         c.Connected(),
+		Reconnects:        s.reconnects.Load(),
+		CommandsReceived:  s.received.Load(),
+		CommandsMalformed: s.malformed.Load(),
+		CommandsSkipped:   s.skipped.Load(),
+		CommandsSucceeded: s.succeeded.Load(),
+		CommandsFailed:    s.failed.Load(),
+		CommandsQueued:    s.queued.Load(),
+		CommandsInFlight:  s.inFlight.Load(),
+	}
+	s.mu.Lock()
+	st.State, st.LastConnected, st.LastDisconnected, st.LastError = s.state, s.lastConnected, s.lastDisconnected, s.lastErr
+	s.mu.Unlock()
+	return st
+}
+
+// startProcessing moves n commands from queued to in flight.
+func (c *Client) startProcessing(n int) {
+	commandsQueued.Sub(float64(n))
+	commandsInFlight.Add(float64(n))
+	c.stats.queued.Add(int64(-n))
+	c.stats.inFlight.Add(int64(n))
+}
@@ -0,0 +1,134 @@
+package lightstack
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// Subscription is one WebSocket connection to a command channel. Each
+// subscription connects, reconnects and acks independently, while all of
+// them share the Client's device API client, workers and metrics.
+type Subscription struct {
+	// Name identifies the subscription in logs and state events. It
+	// defaults to "subscription-N", counting from 1.
+	Name string `json:"name,omitempty"`
+	URL  string `json:"url"`
+	// HelloMessage is sent after each connection instead of
+	// Config.HelloMessage.
+	HelloMessage string `json:"hello,omitempty"`
+	// DeviceAllow and DeviceDeny filter the commands received on this
+	// subscription, on top of Config.DeviceAllow and Config.DeviceDeny.
+	DeviceAllow []string `json:"device_allow,omitempty"`
+	DeviceDeny  []string `json:"device_deny,omitempty"`
+}
+
+// LoadSubscriptions reads a JSON array of subscriptions from path.
+func LoadSubscriptions(path string) ([]Subscription, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var subs []Subscription
+	if err := json.Unmarshal(data, &subs); err != nil {
+		return nil, fmt.Errorf("invalid subscriptions file %s: %w", path, err)
+	}
+	if err := validateSubscriptions(subs); err != nil {
+		return nil, fmt.Errorf("invalid subscriptions file %s: %w", path, err)
+	}
+	return subs, nil
+}
+
+func validateSubscriptions(subs []Subscription) error {
+	names := map[string]bool{}
+	for i, sub := range subs {
+		name := subscriptionName(sub, i)
+		if names[name] {
+			return fmt.Errorf("subscription %d: duplicate name %q", i, name)
+		}
+		names[name] = true
+		if err := validateURL("url", sub.URL, "ws", "wss"); err != nil {
+			return fmt.Errorf("subscription %s: %w", name, err)
+		}
+		if sub.HelloMessage != "" && !json.Valid([]byte(sub.HelloMessage)) {
+			return fmt.Errorf("subscription %s: hello must be valid JSON", name)
+		}
+		if err := validatePatterns("device_allow", sub.DeviceAllow); err != nil {
+			return fmt.Errorf("subscription %s: %w", name, err)
+		}
+		if err := validatePatterns("device_deny", sub.DeviceDeny); err != nil {
+			return fmt.Errorf("subscription %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func subscriptionName(sub Subscription, i int) string {
+	if sub.Name != "" {
+		return sub.Name
+	}
+	return "subscription-" + strconv.Itoa(i+1)
+}
+
+// multiSource runs one wsSource per subscription. Acks for commands they
+// delivered go back through the command's origin rather than through
+// multiSource.Ack.
+type multiSource struct {
+	sources []*wsSource
+}
+
+func newMultiSource(client *Client, subs []Subscription) *multiSource {
+	m := &multiSource{}
+	for i, sub := range subs {
+		sub.Name = subscriptionName(sub, i)
+		m.sources = append(m.sources, &wsSource{
+			client: client,
+			sub:    sub,
+			filter: deviceFilter{allow: sub.DeviceAllow, deny: sub.DeviceDeny},
+			log:    client.log.With("subscription", sub.Name),
+		})
+	}
+	return m
+}
+
+// Run runs every subscription until ctx is cancelled. If one of them fails,
+// the others are stopped and the failures are returned.
+func (m *multiSource) Run(ctx context.Context, out chan<- Command) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(m.sources))
+	for i, s := range m.sources {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if errs[i] = s.Run(ctx, out); errs[i] != nil {
+				errs[i] = fmt.Errorf("subscription %s: %w", s.sub.Name, errs[i])
+				cancel()
+			}
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// Ack is only reached by commands passed to Client.Submit, which did not
+// arrive on any subscription and are not acked.
+func (m *multiSource) Ack(Ack) error {
+	return nil
+}
+
+// Connected reports whether every subscription is connected.
+func (m *multiSource) Connected() bool {
+	for _, s := range m.sources {
+		if !s.Connected() {
+			return false
+		}
+	}
+	return true
+}
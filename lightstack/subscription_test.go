@@ -0,0 +1,81 @@
+package lightstack
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestClientSubscriptions(t *testing.T) {
+	north := newFakeWSServer(t, []string{
+		`{"device_id":"north-1","mode":"red","turnOn":true}`,
+		`{"device_id":"south-1","mode":"red","turnOn":true}`,
+	})
+	south := newFakeWSServer(t, []string{`{"device_id":"south-2","mode":"red","turnOn":true}`})
+	api := newFakeDeviceAPI(t, http.StatusOK)
+
+	cfg := testConfig(north, api)
+	cfg.WSURL = ""
+	cfg.HelloMessage = `{"type":"default"}`
+	cfg.Subscriptions = []Subscription{
+		{Name: "north", URL: north.wsURL(), HelloMessage: `{"channel":"north"}`, DeviceAllow: []string{"north-*"}},
+		{URL: south.wsURL()},
+	}
+	c := newTestClient(t, cfg)
+
+	stop := runClient(t, c)
+	waitFor(t, "both subscriptions", c.Connected)
+	waitFor(t, "an ack on each subscription", func() bool {
+		return len(north.Received()) == 2 && len(south.Received()) == 1
+	})
+	stop()
+
+	if got := north.Received(); got[0] != `{"channel":"north","schema_versions":[1]}` || !strings.Contains(got[1], `"device_id":"north-1"`) {
+		t.Errorf("north received %q, want its hello and the ack for north-1", got)
+	}
+	if got := south.Received(); !strings.Contains(got[0], `"device_id":"south-2"`) {
+		t.Errorf("south received %q, want only the ack for south-2", got)
+	}
+	if reqs := api.Requests(); len(reqs) != 2 {
+		t.Errorf("device API got %d requests, want 2; south-1 is filtered on the north subscription", len(reqs))
+	}
+
+	names := map[string]bool{}
+	for len(c.Events()) > 0 {
+		names[(<-c.Events()).Subscription] = true
+	}
+	if !names["north"] || !names["subscription-2"] || len(names) != 2 {
+		t.Errorf("event subscriptions = %v, want north and subscription-2", names)
+	}
+}
+
+func TestLoadSubscriptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		json    string
+		wantErr string
+	}{
+		{"valid", `[{"name":"a","url":"ws://a/x","hello":"{}"},{"url":"wss://b/y","device_deny":["x-*"]}]`, ""},
+		{"http url", `[{"url":"http://a/x"}]`, "url"},
+		{"duplicate name", `[{"url":"ws://a/x"},{"name":"subscription-1","url":"ws://b/y"}]`, "duplicate name"},
+		{"bad hello", `[{"url":"ws://a/x","hello":"hi"}]`, "hello must be valid JSON"},
+		{"bad pattern", `[{"url":"ws://a/x","device_allow":["["]}]`, "device_allow"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "subscriptions.json")
+			if err := os.WriteFile(path, []byte(tt.json), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			_, err := LoadSubscriptions(path)
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("LoadSubscriptions: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("LoadSubscriptions error = %v, want it to mention %q", err, tt.wantErr)
+			}
+		})
+	}
+}
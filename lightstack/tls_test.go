@@ -0,0 +1,162 @@
+package lightstack
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// writeTestCert writes a self-signed certificate for 127.0.0.1, valid for
+// both server and client auth, and returns the PEM file paths.
+func writeTestCert(t *testing.T) (certFile, keyFile string, cert tls.Certificate) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "lightstack test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, certPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, keyPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cert, err = tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile, cert
+}
+
+func TestSendHTTPRequestMutualTLS(t *testing.T) {
+	certFile, keyFile, cert := writeTestCert(t)
+	pool, err := loadCertPool(certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	api := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	api.TLS = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	}
+	api.StartTLS()
+	defer api.Close()
+
+	cfg := DefaultConfig()
+	cfg.APIBaseURL = api.URL
+	cfg.APITLSCA = certFile
+	cmd := Command{DeviceID: "stack-1", Mode: "red", TurnOn: true}
+
+	if _, err := newTestClient(t, cfg).sendHTTPRequest(context.Background(), cmd); err == nil {
+		t.Error("request without a client certificate succeeded")
+	}
+
+	cfg.APITLSCert = certFile
+	cfg.APITLSKey = keyFile
+	if _, err := newTestClient(t, cfg).sendHTTPRequest(context.Background(), cmd); err != nil {
+		t.Errorf("request with a client certificate: %v", err)
+	}
+}
+
+func TestNewRejectsBadTLSFiles(t *testing.T) {
+	certFile, _, _ := writeTestCert(t)
+
+	cfg := DefaultConfig()
+	cfg.APITLSCert = certFile
+	cfg.APITLSKey = certFile
+	if _, err := New(cfg); err == nil {
+		t.Error("New accepted a certificate file as the private key")
+	}
+
+	cfg = DefaultConfig()
+	cfg.APITLSCA = filepath.Join(t.TempDir(), "missing.pem")
+	if _, err := New(cfg); err == nil {
+		t.Error("New accepted a missing CA bundle")
+	}
+}
+
+func TestWSDialerTLS(t *testing.T) {
+	certFile, _, cert := writeTestCert(t)
+
+	upgrader := websocket.Upgrader{}
+	ws := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err == nil {
+			conn.Close()
+		}
+	}))
+	ws.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	ws.StartTLS()
+	defer ws.Close()
+	wsURL := "wss" + strings.TrimPrefix(ws.URL, "https")
+
+	tests := []struct {
+		name    string
+		cfg     func(*Config)
+		wantErr bool
+	}{
+		{name: "system roots", cfg: func(*Config) {}, wantErr: true},
+		{name: "custom CA", cfg: func(c *Config) { c.WSTLSCA = certFile }},
+		{name: "skip verify", cfg: func(c *Config) { c.WSInsecureSkipVerify = true }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			tt.cfg(&cfg)
+			d, err := newWSDialer(cfg)
+			if err != nil {
+				t.Fatalf("newWSDialer: %v", err)
+			}
+			conn, _, err := d.DialContext(context.Background(), wsURL, nil)
+			if err == nil {
+				conn.Close()
+			}
+			if gotErr := err != nil; gotErr != tt.wantErr {
+				t.Errorf("dial error = %v, want error: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
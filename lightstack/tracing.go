@@ -0,0 +1,90 @@
+package lightstack
+
+import (
+	"context"
+	"net/http"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName identifies this package's spans.
+const tracerName = "gt-linens-light-stack/lightstack"
+
+// traceContext propagates spans to the device API as W3C traceparent and
+// tracestate headers.
+var traceContext = propagation.TraceContext{}
+
+// startCommandSpan starts the span covering cmd from receipt to completion
+// and stores it on the command. It does nothing if tracing is disabled.
+func (c *Client) startCommandSpan(ctx context.Context, cmd Command) Command {
+	if c.tracer == nil {
+		return cmd
+	}
+	_, cmd.span = c.tracer.Start(ctx, "lightstack.command",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("lightstack.device_id", cmd.DeviceID),
+			attribute.String("lightstack.mode", cmd.Mode),
+			attribute.Bool("lightstack.turn_on", cmd.TurnOn),
+			attribute.String("lightstack.request_id", cmd.RequestID),
+		))
+	return cmd
+}
+
+// endCommandSpan ends cmd's span with outcome, marking it as an error if
+// err is not nil.
+func endCommandSpan(cmd Command, outcome string, err error) {
+	if cmd.span == nil {
+		return
+	}
+	cmd.span.SetAttributes(attribute.String("lightstack.outcome", outcome))
+	if err != nil {
+		cmd.span.RecordError(err)
+		cmd.span.SetStatus(codes.Error, err.Error())
+	}
+	cmd.span.End()
+}
+
+// commandContext returns ctx carrying cmd's span, so that device API
+// requests made for it become its children.
+func commandContext(ctx context.Context, cmd Command) context.Context {
+	if cmd.span == nil {
+		return ctx
+	}
+	return trace.ContextWithSpan(ctx, cmd.span)
+}
+
+// startHTTPSpan starts a client span for one device API request and injects
+// its trace context into h. The returned span is nil if tracing is
+// disabled.
+func (c *Client) startHTTPSpan(ctx context.Context, method, apiURL string, h http.Header) trace.Span {
+	if c.tracer == nil {
+		return nil
+	}
+	ctx, span := c.tracer.Start(ctx, "lightstack.http_request",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("http.request.method", method),
+			attribute.String("url.full", redactURL(apiURL)),
+		))
+	traceContext.Inject(ctx, propagation.HeaderCarrier(h))
+	return span
+}
+
+// endHTTPSpan records the outcome of a device API request on span.
+func endHTTPSpan(span trace.Span, statusCode int, err error) {
+	if span == nil {
+		return
+	}
+	if statusCode != 0 {
+		span.SetAttributes(attribute.Int("http.response.status_code", statusCode))
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,71 @@
+package lightstack
+
+import (
+	"net/http"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestClientTracing(t *testing.T) {
+	src := &chanSource{cmds: []Command{
+		{DeviceID: "stack-1", Mode: "red", TurnOn: true, RequestID: "req-1"},
+		{DeviceID: "stack-2"},
+	}}
+	api := newFakeDeviceAPI(t, http.StatusOK)
+	spans := tracetest.NewSpanRecorder()
+
+	cfg := DefaultConfig()
+	cfg.APIBaseURL = api.URL
+	cfg.Source = src
+	cfg.TracerProvider = sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans))
+	c := newTestClient(t, cfg)
+
+	stop := runClient(t, c)
+	waitFor(t, "three ended spans", func() bool { return len(spans.Ended()) == 3 })
+	stop()
+
+	var command, invalid, request sdktrace.ReadOnlySpan
+	for _, s := range spans.Ended() {
+		switch {
+		case s.Name() == "lightstack.http_request":
+			request = s
+		case hasAttr(s, attribute.String("lightstack.device_id", "stack-1")):
+			command = s
+		default:
+			invalid = s
+		}
+	}
+	if command == nil || request == nil || invalid == nil {
+		t.Fatalf("spans = %v, want a command span, an HTTP request span and an invalid command span", spans.Ended())
+	}
+	if !hasAttr(command, attribute.String("lightstack.request_id", "req-1")) || !hasAttr(command, attribute.String("lightstack.outcome", ackOutcomeSuccess)) {
+		t.Errorf("command span attributes = %v, want request_id req-1 and outcome success", command.Attributes())
+	}
+	if request.Parent().SpanID() != command.SpanContext().SpanID() {
+		t.Error("HTTP request span is not a child of the command span")
+	}
+	if !hasAttr(request, attribute.Int("http.response.status_code", http.StatusOK)) {
+		t.Errorf("HTTP request span attributes = %v, want status code 200", request.Attributes())
+	}
+	if invalid.Status().Code != codes.Error || !hasAttr(invalid, attribute.String("lightstack.outcome", "invalid")) {
+		t.Errorf("invalid command span status = %v, attributes = %v, want an error with outcome invalid", invalid.Status(), invalid.Attributes())
+	}
+
+	want := "00-" + request.SpanContext().TraceID().String() + "-" + request.SpanContext().SpanID().String() + "-01"
+	if got := api.Requests()[0].Header.Get("Traceparent"); got != want {
+		t.Errorf("traceparent = %q, want %q", got, want)
+	}
+}
+
+func hasAttr(s sdktrace.ReadOnlySpan, want attribute.KeyValue) bool {
+	for _, kv := range s.Attributes() {
+		if kv == want {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,35 @@
+package lightstack
+
+import "fmt"
+
+// Transform rewrites a received command before it is validated and
+// dispatched, for example to map legacy device IDs or mode names. Returning
+// an error skips the command. Group commands are expanded before any
+// transform runs, so a transform that returns a group target or
+// AllDevices has the command skipped as well.
+type Transform func(Command) (Command, error)
+
+// applyTransforms runs cmd through transforms in order. The request ID and
+// idempotency key are carried over if a transform clears them, and the
+// trace span and origin always are.
+func applyTransforms(transforms []Transform, cmd Command) (Command, error) {
+	for i, t := range transforms {
+		next, err := t(cmd)
+		if err != nil {
+			return cmd, fmt.Errorf("transform %d: %w", i, err)
+		}
+		if next.RequestID == "" {
+			next.RequestID = cmd.RequestID
+		}
+		if next.IdempotencyKey == "" {
+			next.IdempotencyKey = cmd.IdempotencyKey
+		}
+		next.span = cmd.span
+		next.origin = cmd.origin
+		cmd = next
+		if isGroupTarget(cmd.DeviceID) {
+			return cmd, fmt.Errorf("transform %d: %q is a group target, which only the server can address", i, cmd.DeviceID)
+		}
+	}
+	return cmd, nil
+}
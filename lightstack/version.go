@@ -0,0 +1,17 @@
+package lightstack
+
+// Build information, set at link time, for example with
+//
+//	go build -ldflags "-X gt-linens-light-stack/lightstack.Version=1.4.0 -X gt-linens-light-stack/lightstack.Commit=$(git rev-parse --short HEAD) -X gt-linens-light-stack/lightstack.BuildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+//
+// Version also appears in the default User-Agent.
+var (
+	Version   = "dev"
+	Commit    = "unknown"
+	BuildDate = "unknown"
+)
+
+// DefaultUserAgent is the User-Agent sent when Config.UserAgent is empty.
+func DefaultUserAgent() string {
+	return "laundris-light-stack/" + Version
+}
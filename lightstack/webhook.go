@@ -0,0 +1,113 @@
+package lightstack
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// webhookBufferSize is how many notifications may wait for delivery before
+// new ones are dropped.
+const webhookBufferSize = 256
+
+type webhookEvent struct {
+	DeviceID   string    `json:"device_id"`
+	Mode       string    `json:"mode"`
+	TurnOn     bool      `json:"turnOn"`
+	Success    bool      `json:"success"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Timestamp  time.Time `json:"timestamp"`
+}
+
+// webhook posts the outcome of every processed command to a URL. Delivery
+// is best effort: notifications are queued without blocking and dropped when
+// the queue is full or the request fails. All methods are no-ops on a nil
+// *webhook.
+type webhook struct {
+	url    string
+	client *http.Client
+	log    *slog.Logger
+	events chan webhookEvent
+}
+
+func newWebhook(url string, timeout time.Duration, logger *slog.Logger) *webhook {
+	return &webhook{
+		url:    url,
+		client: &http.Client{Timeout: timeout},
+		log:    logger,
+		events: make(chan webhookEvent, webhookBufferSize),
+	}
+}
+
+// Notify queues a notification for cmd's outcome.
+func (w *webhook) Notify(cmd Command, ack Ack) {
+	if w == nil {
+		return
+	}
+	ev := webhookEvent{
+		DeviceID:   cmd.DeviceID,
+		Mode:       cmd.Mode,
+		TurnOn:     cmd.TurnOn,
+		Success:    ack.Outcome == ackOutcomeSuccess,
+		StatusCode: ack.StatusCode,
+		Timestamp:  time.Now().UTC(),
+	}
+	select {
+	case w.events <- ev:
+	default:
+		webhookFailures.Inc()
+		w.log.Warn("Dropping webhook notification, delivery is behind", append(commandAttrs(cmd), "event", "webhook_dropped")...)
+	}
+}
+
+// Run delivers queued notifications until Close. Deliveries are not
+// cancelled with ctx, so the outcomes of commands finished while shutting
+// down still go out, each within the webhook timeout.
+func (w *webhook) Run(ctx context.Context) {
+	if w == nil {
+		return
+	}
+	ctx = context.WithoutCancel(ctx)
+	for ev := range w.events {
+		if err := w.send(ctx, ev); err != nil {
+			webhookFailures.Inc()
+			w.log.Warn("Failed to deliver webhook notification", "event", "webhook_failed", "device_id", ev.DeviceID, "error", err)
+		}
+	}
+}
+
+// Close makes Run return once the queued notifications are delivered. Notify
+// must not be called after Close.
+func (w *webhook) Close() {
+	if w == nil {
+		return
+	}
+	close(w.events)
+}
+
+func (w *webhook) send(ctx context.Context, ev webhookEvent) error {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return fmt.Errorf("failed to encode notification: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create webhook request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer closeBody(resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &HTTPStatusError{StatusCode: resp.StatusCode}
+	}
+	return nil
+}
@@ -0,0 +1,201 @@
+package lightstack
+
+import (
+	"container/heap"
+	"context"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// workerPool runs commands on a fixed set of goroutines. Commands for the
+// same device always hash to the same worker. Each worker takes the
+// highest-priority command first and, among equal priorities, the oldest,
+// so commands for a device of the same priority run in arrival order.
+// Commands for a device that wait reports as not ready yet are passed over
+// until it is, without holding up the other devices on the worker. A nil
+// wait never holds a device back.
+type workerPool struct {
+	queues []*priorityQueue
+	wg     sync.WaitGroup
+}
+
+func newWorkerPool(size, queueSize int, wait func(deviceID string) time.Duration, handle func(Command)) *workerPool {
+	p := &workerPool{queues: make([]*priorityQueue, size)}
+	for i := range p.queues {
+		q := newPriorityQueue(queueSize, wait)
+		p.queues[i] = q
+
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			for {
+				cmd, ok := q.Pop()
+				if !ok {
+					return
+				}
+				handle(cmd)
+			}
+		}()
+	}
+	return p
+}
+
+// Submit queues cmd on its device's worker, blocking while that worker's
+// queue is full.
+func (p *workerPool) Submit(ctx context.Context, cmd Command) error {
+	h := fnv.New32a()
+	h.Write([]byte(cmd.DeviceID))
+	return p.queues[h.Sum32()%uint32(len(p.queues))].Push(ctx, cmd)
+}
+
+// Wake makes the workers ask wait again for the commands they pass over.
+func (p *workerPool) Wake() {
+	for _, q := range p.queues {
+		q.signal()
+	}
+}
+
+// Close stops accepting commands and waits for queued ones to finish.
+func (p *workerPool) Close() {
+	for _, q := range p.queues {
+		q.Close()
+	}
+	p.wg.Wait()
+}
+
+type queuedCommand struct {
+	cmd Command
+	seq uint64
+}
+
+type commandHeap []queuedCommand
+
+func (h commandHeap) Len() int { return len(h) }
+func (h commandHeap) Less(i, j int) bool {
+	if h[i].cmd.Priority != h[j].cmd.Priority {
+		return h[i].cmd.Priority > h[j].cmd.Priority
+	}
+	return h[i].seq < h[j].seq
+}
+func (h commandHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *commandHeap) Push(x any)   { *h = append(*h, x.(queuedCommand)) }
+func (h *commandHeap) Pop() any {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
+
+// priorityQueue is a bounded queue with a single consumer. Push blocks while
+// it is full.
+type priorityQueue struct {
+	slots chan struct{}
+	ready chan struct{}
+	wait  func(deviceID string) time.Duration
+
+	mu     sync.Mutex
+	items  commandHeap
+	seq    uint64
+	closed bool
+}
+
+func newPriorityQueue(size int, wait func(string) time.Duration) *priorityQueue {
+	return &priorityQueue{
+		slots: make(chan struct{}, max(size, 1)),
+		ready: make(chan struct{}, 1),
+		wait:  wait,
+	}
+}
+
+func (q *priorityQueue) Push(ctx context.Context, cmd Command) error {
+	select {
+	case q.slots <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	q.mu.Lock()
+	heap.Push(&q.items, queuedCommand{cmd: cmd, seq: q.seq})
+	q.seq++
+	q.mu.Unlock()
+	q.signal()
+	return nil
+}
+
+// Pop waits for the next command whose device is ready. It returns false
+// once the queue is closed and empty.
+func (q *priorityQueue) Pop() (Command, bool) {
+	for {
+		q.mu.Lock()
+		item, delay, ok := q.next()
+		if ok {
+			q.mu.Unlock()
+			<-q.slots
+			return item.cmd, true
+		}
+		closed := q.closed && len(q.items) == 0
+		q.mu.Unlock()
+		if closed {
+			return Command{}, false
+		}
+		if delay <= 0 {
+			<-q.ready
+			continue
+		}
+		t := time.NewTimer(delay)
+		select {
+		case <-q.ready:
+		case <-t.C:
+		}
+		t.Stop()
+	}
+}
+
+// next removes the first command in priority order whose device is ready.
+// Otherwise it returns how long until the first device becomes ready, or 0
+// if the queue is empty. The caller must hold q.mu.
+func (q *priorityQueue) next() (queuedCommand, time.Duration, bool) {
+	var skipped []queuedCommand
+	defer func() {
+		for _, item := range skipped {
+			heap.Push(&q.items, item)
+		}
+	}()
+
+	var delay time.Duration
+	waits := map[string]time.Duration{}
+	for len(q.items) > 0 {
+		item := heap.Pop(&q.items).(queuedCommand)
+		if q.wait == nil {
+			return item, 0, true
+		}
+		d, ok := waits[item.cmd.DeviceID]
+		if !ok {
+			d = q.wait(item.cmd.DeviceID)
+			waits[item.cmd.DeviceID] = d
+		}
+		if d <= 0 {
+			return item, 0, true
+		}
+		skipped = append(skipped, item)
+		if delay == 0 || d < delay {
+			delay = d
+		}
+	}
+	return queuedCommand{}, delay, false
+}
+
+func (q *priorityQueue) Close() {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+	q.signal()
+}
+
+func (q *priorityQueue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
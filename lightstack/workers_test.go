@@ -0,0 +1,49 @@
+package lightstack
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestWorkerPoolPriority(t *testing.T) {
+	release := make(chan struct{})
+	var mu sync.Mutex
+	var order []string
+
+	p := newWorkerPool(1, 8, nil, func(cmd Command) {
+		if cmd.Mode == "first" {
+			<-release
+		}
+		mu.Lock()
+		order = append(order, cmd.Mode)
+		mu.Unlock()
+	})
+
+	ctx := context.Background()
+	submit := func(mode string, priority int) {
+		if err := p.Submit(ctx, Command{DeviceID: "stack-1", Mode: mode, Priority: priority}); err != nil {
+			t.Fatalf("Submit: %v", err)
+		}
+	}
+	submit("first", 0)
+	// Wait for the worker to pick up "first" before queueing the rest.
+	waitFor(t, "the first command to start", func() bool {
+		p.queues[0].mu.Lock()
+		defer p.queues[0].mu.Unlock()
+		return len(p.queues[0].items) == 0
+	})
+	submit("low-1", 0)
+	submit("low-2", 0)
+	submit("alarm", 10)
+	submit("low-3", 0)
+	submit("alarm-2", 10)
+	close(release)
+	p.Close()
+
+	got := strings.Join(order, ",")
+	if want := "first,alarm,alarm-2,low-1,low-2,low-3"; got != want {
+		t.Errorf("dispatch order = %s, want %s", got, want)
+	}
+}
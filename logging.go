@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logOptions configures the process logger.
+type logOptions struct {
+	Format string
+	Level  string
+	// SampleBurst, if positive, keeps at most this many debug and info
+	// entries per event every SampleInterval.
+	SampleBurst    int
+	SampleInterval time.Duration
+}
+
+func newLogger(opts logOptions, w io.Writer) (*slog.Logger, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(opts.Level)); err != nil {
+		return nil, fmt.Errorf("unknown log level %q", opts.Level)
+	}
+	handlerOpts := &slog.HandlerOptions{Level: level}
+
+	var h slog.Handler
+	switch opts.Format {
+	case "text":
+		h = slog.NewTextHandler(w, handlerOpts)
+	case "json":
+		h = slog.NewJSONHandler(w, handlerOpts)
+	default:
+		return nil, fmt.Errorf("unknown log format %q", opts.Format)
+	}
+	if opts.SampleBurst > 0 {
+		h = &samplingHandler{Handler: h, sampler: newSampler(opts.SampleBurst, opts.SampleInterval)}
+	}
+	return slog.New(h), nil
+}
+
+// samplingHandler drops debug and info entries once an event has been
+// logged sampler.burst times in the current interval. Warnings, errors and
+// connection state changes (ws_* events) always pass. The first entry let
+// through after some were dropped carries their count as sampled_out.
+type samplingHandler struct {
+	slog.Handler
+	sampler *sampler
+}
+
+func (h *samplingHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level >= slog.LevelWarn {
+		return h.Handler.Handle(ctx, r)
+	}
+	event := recordEvent(r)
+	if event == "" || strings.HasPrefix(event, "ws_") {
+		return h.Handler.Handle(ctx, r)
+	}
+
+	ok, dropped := h.sampler.Allow(event)
+	if !ok {
+		return nil
+	}
+	if dropped > 0 {
+		r = r.Clone()
+		r.AddAttrs(slog.Int("sampled_out", dropped))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *samplingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &samplingHandler{Handler: h.Handler.WithAttrs(attrs), sampler: h.sampler}
+}
+
+func (h *samplingHandler) WithGroup(name string) slog.Handler {
+	return &samplingHandler{Handler: h.Handler.WithGroup(name), sampler: h.sampler}
+}
+
+func recordEvent(r slog.Record) string {
+	var event string
+	r.Attrs(func(a slog.Attr) bool {
+		if a.Key == "event" {
+			event = a.Value.String()
+			return false
+		}
+		return true
+	})
+	return event
+}
+
+// sampler counts entries per event in fixed windows of interval.
+type sampler struct {
+	burst    int
+	interval time.Duration
+	now      func() time.Time
+
+	mu      sync.Mutex
+	windows map[string]*sampleWindow
+}
+
+type sampleWindow struct {
+	start   time.Time
+	n       int
+	dropped int
+}
+
+func newSampler(burst int, interval time.Duration) *sampler {
+	return &sampler{burst: burst, interval: interval, now: time.Now, windows: map[string]*sampleWindow{}}
+}
+
+// Allow reports whether an entry for event may be logged, and how many
+// were dropped since the last one that was.
+func (s *sampler) Allow(event string) (bool, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	w, ok := s.windows[event]
+	if !ok {
+		w = &sampleWindow{start: now}
+		s.windows[event] = w
+	}
+	if now.Sub(w.start) >= s.interval {
+		w.start, w.n = now, 0
+	}
+	if w.n >= s.burst {
+		w.dropped++
+		return false, 0
+	}
+	w.n++
+	dropped := w.dropped
+	w.dropped = 0
+	return true, dropped
+}
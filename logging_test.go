@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoggerSamplesRepeatedEvents(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := newLogger(logOptions{Format: "json", Level: "debug", SampleBurst: 2, SampleInterval: time.Second}, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var now time.Time
+	start := time.Now()
+	logger.Handler().(*samplingHandler).sampler.now = func() time.Time { return now }
+
+	now = start
+	for range 5 {
+		logger.Info("Received command", "event", "command_received")
+		logger.Error("Device API request failed", "event", "http_failed")
+		logger.Info("Connected", "event", "ws_connected")
+	}
+	logger.Debug("No event")
+	logger.Warn("Retrying", "event", "http_retry")
+	now = start.Add(time.Second)
+	logger.Info("Received command", "event", "command_received")
+
+	counts := map[string]int{}
+	var last map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var entry map[string]any
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("log line %q: %v", line, err)
+		}
+		event, _ := entry["event"].(string)
+		counts[event]++
+		if event == "command_received" {
+			last = entry
+		}
+	}
+
+	want := map[string]int{"command_received": 3, "http_failed": 5, "ws_connected": 5, "": 1, "http_retry": 1}
+	for event, n := range want {
+		if counts[event] != n {
+			t.Errorf("logged %d %q entries, want %d", counts[event], event, n)
+		}
+	}
+	if got := last["sampled_out"]; got != 3.0 {
+		t.Errorf("sampled_out = %v after the window ended, want 3", got)
+	}
+}
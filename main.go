@@ -1,122 +1,120 @@
 package main
 
 import (
-	"bytes"
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
-	"net/http"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
-	"github.com/gorilla/websocket"
+	"gt-linens-light-stack/lightstack"
 )
 
-type Command struct {
-	DeviceID string `json:"device_id"`
-	Mode     string `json:"mode"`
-	TurnOn   bool   `json:"turnOn"`
-}
+// exitConnectGaveUp is the exit status after -max-connect-failures
+// consecutive failed connection attempts, so orchestrators can tell it apart
+// from other failures.
+const exitConnectGaveUp = 3
 
-const (
-	wsURL               = "wss://laundirs-supply-chain-websocket.azurewebsites.net/light-stack"
-	keepAliveInterval   = 10 * time.Second
-	connectionReadLimit = 60 * time.Second
-)
+// exitShutdownTimeout is the exit status when shutting down takes longer
+// than -shutdown-timeout.
+const exitShutdownTimeout = 4
 
 func main() {
-	for {
-		log.Println("Attempting to connect to WebSocket server...")
-
-		conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
-		if err != nil {
-			log.Printf("Failed to connect to WebSocket: %v. Retrying in 2 seconds...", err)
-			time.Sleep(2 * time.Second)
-			continue
-		}
-
-		log.Println("Connected to WebSocket server")
-
-		done := make(chan struct{})
-		go keepAlive(conn, done)
-
-		err = handleMessages(conn, done)
-		if err != nil {
-			log.Printf("Connection lost: %v", err)
-		}
+	opts, err := loadOptions(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	if opts.ShowVersion {
+		fmt.Printf("light-stack-connector %s (commit %s, built %s)\n", lightstack.Version, lightstack.Commit, lightstack.BuildDate)
+		return
+	}
 
-		log.Println("Disconnected. Reconnecting...")
-		time.Sleep(2 * time.Second)
+	logger, err := newLogger(opts.Log, os.Stderr)
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
 	}
+	slog.SetDefault(logger)
+	opts.Config.Logger = logger
+	slog.Info("Starting light-stack connector", "event", "startup", "version", lightstack.Version, "commit", lightstack.Commit, "build_date", lightstack.BuildDate)
+	os.Exit(run(opts))
 }
 
-func handleMessages(conn *websocket.Conn, done chan struct{}) error {
-	defer close(done)
-	defer conn.Close()
-
-	conn.SetReadDeadline(time.Now().Add(connectionReadLimit))
-	conn.SetPongHandler(func(appData string) error {
-		conn.SetReadDeadline(time.Now().Add(connectionReadLimit))
-		return nil
-	})
+// run runs the connector until it stops and returns the exit status. It
+// returns rather than exiting so that its deferred cleanup, such as
+// flushing traces, always happens.
+func run(opts options) int {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	for {
-		var cmd Command
-
-		err := conn.ReadJSON(&cmd)
-		if err != nil {
-			return fmt.Errorf("error reading message: %w", err)
-		}
-
-		log.Printf("Received command: %+v", cmd)
-
-		err = sendHTTPRequest(cmd)
+	if opts.OTelEndpoint != "" {
+		provider, err := newTracerProvider(ctx, opts.OTelEndpoint)
 		if err != nil {
-			log.Printf("Failed to process command: %v", err)
+			log.Printf("Failed to configure tracing: %v", err)
+			return 1
 		}
+		defer shutdownTracerProvider(provider)
+		opts.Config.TracerProvider = provider
 	}
-}
 
-func keepAlive(conn *websocket.Conn, done chan struct{}) {
-	ticker := time.NewTicker(keepAliveInterval)
-	defer ticker.Stop()
+	client, err := lightstack.New(opts.Config)
+	if err != nil {
+		log.Printf("Failed to create client: %v", err)
+		return 1
+	}
 
-	for {
-		select {
-		case <-done:
-			return
-		case <-ticker.C:
-			err := conn.WriteMessage(websocket.PingMessage, nil)
-			if err != nil {
-				log.Printf("Failed to send ping: %v", err)
-				return
-			}
-			log.Println("Ping sent to server")
+	go drainOnSignal(ctx, client)
+	go forceExitAfter(ctx, opts.ShutdownTimeout, client)
+	go serveHTTP(ctx, "metrics", opts.MetricsAddr, metricsHandler())
+	go serveHTTP(ctx, "health", opts.HealthAddr, healthHandler(client))
+	go serveHTTP(ctx, "inject", opts.InjectAddr, injectHandler(client))
+	reload := newReloader(os.Args[1:], opts, client)
+	go reloadOnSignal(ctx, reload)
+	go serveHTTP(ctx, "admin", opts.AdminAddr, adminHandler(opts.AdminToken, reload))
+
+	if err := client.Run(ctx); err != nil {
+		slog.Error("Client stopped", "event", "client_failed", "error", err)
+		if errors.Is(err, lightstack.ErrConnectGaveUp) {
+			return exitConnectGaveUp
 		}
+		return 1
 	}
+	slog.Info("Shutting down", "event", "shutdown")
+	return 0
 }
 
-func sendHTTPRequest(cmd Command) error {
-	apiURL := fmt.Sprintf("http://localhost:8080/api/device/gpo/light/%s?mode=%s&turnOn=%t", cmd.DeviceID, cmd.Mode, cmd.TurnOn)
-
-	log.Printf("Sending HTTP POST to %s", apiURL)
-
-	req, err := http.NewRequest("POST", apiURL, bytes.NewBuffer([]byte{}))
-	if err != nil {
-		return fmt.Errorf("failed to create HTTP request: %w", err)
-	}
-
-	req.Header.Set("Content-Type", "application/json")
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return fmt.Errorf("failed to send HTTP request: %w", err)
+// drainOnSignal starts a graceful drain when the process receives SIGUSR1.
+func drainOnSignal(ctx context.Context, client *lightstack.Client) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGUSR1)
+	defer signal.Stop(sig)
+
+	select {
+	case <-sig:
+		slog.Info("Received SIGUSR1, draining", "event", "drain_requested")
+		client.Drain()
+	case <-ctx.Done():
 	}
-	defer resp.Body.Close()
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("unexpected response status: %d", resp.StatusCode)
+// forceExitAfter exits the process if it is still running timeout after ctx
+// is cancelled, so a wedged device API call or goroutine cannot outlast the
+// orchestrator's grace period. A zero timeout disables it.
+func forceExitAfter(ctx context.Context, timeout time.Duration, client *lightstack.Client) {
+	if timeout == 0 {
+		return
 	}
+	<-ctx.Done()
+	time.Sleep(timeout)
 
-	log.Printf("HTTPRequest to device_id=%s was successful", cmd.DeviceID)
-	return nil
+	st := client.Stats()
+	slog.Error("Shutdown timed out, forcing exit", "event", "shutdown_forced", "timeout", timeout, "queued", st.CommandsQueued, "in_flight", st.CommandsInFlight, "connected", st.Connected)
+	os.Exit(exitShutdownTimeout)
 }
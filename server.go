@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const shutdownTimeout = time.Second
+
+func metricsHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	return mux
+}
+
+// serveHTTP runs an HTTP server on addr until ctx is cancelled. An empty addr
+// disables the server.
+func serveHTTP(ctx context.Context, name, addr string, handler http.Handler) {
+	if addr == "" {
+		return
+	}
+
+	srv := &http.Server{Addr: addr, Handler: handler}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	slog.Info("Starting "+name+" server", "event", "http_server_started", "server", name, "addr", addr)
+	err := srv.ListenAndServe()
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("HTTP server failed", "event", "http_server_failed", "server", name, "addr", addr, "error", err)
+	}
+}
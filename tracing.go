@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+
+	"gt-linens-light-stack/lightstack"
+)
+
+// tracerShutdownTimeout bounds how long buffered spans may take to flush on
+// exit.
+const tracerShutdownTimeout = 2 * time.Second
+
+// newTracerProvider returns a provider that batches spans and exports them
+// over OTLP/HTTP to endpoint.
+func newTracerProvider(ctx context.Context, endpoint string) (*sdktrace.TracerProvider, error) {
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(endpoint))
+	if err != nil {
+		return nil, err
+	}
+	res := resource.NewSchemaless(
+		semconv.ServiceName("light-stack-connector"),
+		semconv.ServiceVersion(lightstack.Version),
+	)
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	), nil
+}
+
+// shutdownTracerProvider flushes any spans still buffered in provider.
+func shutdownTracerProvider(provider *sdktrace.TracerProvider) {
+	ctx, cancel := context.WithTimeout(context.Background(), tracerShutdownTimeout)
+	defer cancel()
+	if err := provider.Shutdown(ctx); err != nil {
+		slog.Warn("Failed to flush traces", "event", "tracing_shutdown_failed", "error", err)
+	}
+}